@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiDevicesHandler serves /api/v1/devices, /api/v1/devices/{devEui} and
+// /api/v1/devices/{devEui}/...
+func (e *Exporter) apiDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/devices"), "/")
+	devEui, resource, _ := strings.Cut(path, "/")
+	devEui = strings.ToLower(devEui)
+	e.reloadMutex.RLock()
+	defer e.reloadMutex.RUnlock()
+	switch {
+	case len(devEui) == 0:
+		e.devicesHandler(w, r)
+	case len(resource) == 0:
+		e.deviceHandler(w, r, devEui)
+	case resource == "history":
+		e.history.handler(w, r, devEui)
+	case resource == "dumps" || strings.HasPrefix(resource, "dumps/"):
+		e.deviceDumpHandler(w, r, devEui, strings.TrimPrefix(strings.TrimPrefix(resource, "dumps"), "/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -3,125 +3,68 @@ package main
 import (
 	"bufio"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+
 	"github.com/chirpstack/chirpstack/api/go/v4/api"
-	"github.com/guregu/null"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
 	"google.golang.org/grpc"
-	"os"
-	"strings"
-	"time"
 )
 
-type WebHookSensecapMessage struct {
-	MeasurementValue json.Number `json:"measurementValue"`
-	MeasurementID    json.Number `json:"measurementId"`
-	Battery          json.Number `json:"battery"`
-	Interval         json.Number `json:"interval"`
-	Type             string      `json:"type"`
+// Uplink is a parsed webhook of any event with the measurements the decoders
+// found, only up events have measurements
+type Uplink struct {
+	chirpstack.Header
+	// Doc is the typed event, eg *chirpstack.UplinkEvent for up
+	Doc    chirpstack.Event
+	DevEui string
+	OUI    string
+	// Labels are the device labels of the series, without the type
+	Labels       prometheus.Labels
+	Measurements []decoder.Measurement
+	Location     DeviceLocation
+	Errors       []string
+	// Sensecap measurement ids without a type in decoder.SenseCAPMeasurementTypes
+	UnsupportedMeasurementIDs []string
+	// Decoder is the vendor decoder used, empty for an unsupported OUI
+	Decoder string
+	// UsedFields are the object fields the decoder looked at, set or not
+	UsedFields []string
 }
 
-type WebHookDoc struct {
-	DeduplicationID string    `json:"deduplicationId"`
-	Time            time.Time `json:"time"`
-	DeviceInfo      struct {
-		TenantID           string `json:"tenantId"`
-		TenantName         string `json:"tenantName"`
-		ApplicationID      string `json:"applicationId"`
-		ApplicationName    string `json:"applicationName"`
-		DeviceProfileID    string `json:"deviceProfileId"`
-		DeviceProfileName  string `json:"deviceProfileName"`
-		DeviceName         string `json:"deviceName"`
-		DevEui             string `json:"devEui"`
-		DeviceClassEnabled string `json:"deviceClassEnabled"`
-		Tags               struct {
-		} `json:"tags"`
-	} `json:"deviceInfo"`
-	Level                   string  `json:"level"`
-	Code                    string  `json:"code"`
-	Description             string  `json:"description"`
-	DevAddr                 string  `json:"devAddr"`
-	Adr                     bool    `json:"adr"`
-	Dr                      int     `json:"dr"`
-	FCnt                    int     `json:"fCnt"`
-	FPort                   int     `json:"fPort"`
-	Confirmed               bool    `json:"confirmed"`
-	Data                    string  `json:"data"`
-	Margin                  int     `json:"margin"`
-	ExternalPowerSource     bool    `json:"externalPowerSource"`
-	BatteryLevelUnavailable bool    `json:"batteryLevelUnavailable"`
-	BatteryLevel            float64 `json:"batteryLevel"`
-	Object                  struct {
-		Battery null.Float `json:"battery"`
-		// sensecap
-		Err      null.Float      `json:"err"`
-		Valid    bool            `json:"valid"`
-		Payload  string          `json:"payload"`
-		Messages json.RawMessage `json:"messages"`
-		// dragino-lht52
-		TempCDS      null.Float `json:"TempC_DS"`
-		Ext          null.Float `json:"Ext"`
-		TempCSHT     null.Float `json:"TempC_SHT"`
-		HumSHT       null.Float `json:"Hum_SHT"`
-		Systimestamp null.Float `json:"Systimestamp"`
-		// dragino-ld02 (door sensor)
-		LastDoorOpenDuration null.Float `json:"LAST_DOOR_OPEN_DURATION"`
-		Alarm                null.Float `json:"ALARM"`
-		DoorOpenTimes        null.Float `json:"DOOR_OPEN_TIMES"`
-		BatV                 null.Float `json:"BAT_V"`
-		Mod                  null.Float `json:"MOD"`
-		DoorOpenStatus       null.Float `json:"DOOR_OPEN_STATUS"`
-		// dragino-lwl02 (water sensor)
-		WaterLeakStatus       null.Float `json:"WATER_LEAK_STATUS"`
-		WaterLeakLastDuration null.Float `json:"LAST_WATER_LEAK_DURATION"`
-		WaterLeakCount        null.Float `json:"WATER_LEAK_TIMES"`
-		// rejee
-		Vol         null.Float `json:"vol"`
-		Temperature null.Float `json:"temperature"`
-		Humidity    null.Float `json:"humidity"`
-		// milesight
-		Position string     `json:"position"`
-		Distance null.Float `json:"distance"`
-		Decoded  struct {
-			Humidity    null.Float `json:"humidity"`
-			Temperature null.Float `json:"temperature"`
-			Battery     null.Float `json:"battery"`
-		} `json:"decoded"`
-	} `json:"object"`
-	RxInfo []RxInfoDoc `json:"rxInfo"`
-	TxInfo struct {
-		Frequency  int `json:"frequency"`
-		Modulation struct {
-			Lora struct {
-				Bandwidth       int    `json:"bandwidth"`
-				SpreadingFactor int    `json:"spreadingFactor"`
-				CodeRate        string `json:"codeRate"`
-			} `json:"lora"`
-		} `json:"modulation"`
-	} `json:"txInfo"`
-	Context struct {
-		DeduplicationID string `json:"deduplication_id"`
-	} `json:"context"`
+// addError records a decode error, the uplink is still used
+func (u *Uplink) addError(err error) {
+	u.Errors = append(u.Errors, err.Error())
 }
 
-type RxInfoDoc struct {
-	GatewayID string  `json:"gatewayId"`
-	UplinkID  int     `json:"uplinkId"`
-	Rssi      int     `json:"rssi"`
-	Snr       float64 `json:"snr"`
-	Channel   int     `json:"channel"`
-	Location  struct {
-		Latitude  float64 `json:"latitude"`
-		Longitude float64 `json:"longitude"`
-	} `json:"location"`
-	Context  string `json:"context"`
-	Metadata struct {
-		RegionConfigID   string `json:"region_config_id"`
-		RegionCommonName string `json:"region_common_name"`
-	} `json:"metadata"`
-	CrcStatus string `json:"crcStatus"`
+// MeasurementMap returns the measurements by type, the last value wins
+func (u *Uplink) MeasurementMap() map[string]float64 {
+	m := make(map[string]float64, len(u.Measurements))
+	for _, measurement := range u.Measurements {
+		m[measurement.Type] = measurement.Value
+	}
+	return m
+}
+
+// RxInfo returns the gateways that received an up event, nil for the others
+func (u *Uplink) RxInfo() []chirpstack.RxInfo {
+	if up, ok := u.Doc.(*chirpstack.UplinkEvent); ok {
+		return up.RxInfo
+	}
+	return nil
+}
+
+// FCnt returns the frame counter of an up event, 0 for the others
+func (u *Uplink) FCnt() int {
+	if up, ok := u.Doc.(*chirpstack.UplinkEvent); ok {
+		return up.FCnt
+	}
+	return 0
 }
 
 type APIToken string
@@ -136,44 +79,53 @@ func (a APIToken) RequireTransportSecurity() bool {
 	return false
 }
 
-func getDeviceStatus() {
-	if len(getApiKey()) > 0 {
-		if len(labelsMap) > 0 {
+// getDeviceStatus queries chirpstack for the battery and name of the known
+// devices
+func (e *Exporter) getDeviceStatus() {
+	e.reloadMutex.RLock()
+	apiKey, apiServer := e.apiKey(), e.config.ApiServer
+	e.reloadMutex.RUnlock()
+	if len(apiKey) > 0 {
+		if devices := e.devices.knownDevices(); len(devices) > 0 {
 			log.Debug().Msg("Using GRPC to query chirpstack for deviceStatus")
 			dialOpts := []grpc.DialOption{
 				grpc.WithBlock(),
-				grpc.WithPerRPCCredentials(APIToken(getApiKey())),
+				grpc.WithPerRPCCredentials(APIToken(apiKey)),
 				grpc.WithInsecure(), // remove this when using TLS
 			}
 
-			conn, dialErr := grpc.Dial(config.ApiServer, dialOpts...)
+			conn, dialErr := grpc.Dial(apiServer, dialOpts...)
 			defer conn.Close()
 			if dialErr != nil {
-				log.Error().Caller().Err(dialErr).Msgf("Failed to dial to %s", config.ApiServer)
-				grpcConnectionErrorTotal.Inc()
+				log.Error().Caller().Err(dialErr).Msgf("Failed to dial to %s", apiServer)
+				e.metrics.grpcConnectionErrorTotal.Inc()
 				return
 			}
 			deviceClient := api.NewDeviceServiceClient(conn)
-			for devEui := range labelsMap {
+			for _, devEui := range devices {
 				deviceResponse, err := deviceClient.Get(context.Background(), &api.GetDeviceRequest{DevEui: devEui})
+				e.reloadMutex.RLock()
 				if err != nil {
-					grpcApiErrorTotal.Inc()
-					delete(labelsMap, devEui)
+					e.metrics.grpcApiErrorTotal.Inc()
+					e.devices.forgetDevice(devEui)
 					log.Error().Caller().Err(err).Str("devEui", devEui).Msgf("Failed to get device, will not try again for now.")
 				} else {
-					grpcApiTotal.Inc()
+					e.metrics.grpcApiTotal.Inc()
+					deviceLabel := e.devices.updateDeviceFromApi(devEui, deviceResponse.GetDevice())
+					e.devices.recordDeviceStatus(devEui, float64(deviceResponse.GetDeviceStatus().GetBatteryLevel()), deviceResponse.GetDeviceStatus().GetExternalPowerSource())
 					if deviceResponse.GetDeviceStatus().GetBatteryLevel() > 0 {
-						deviceBattery.With(labelsMap[devEui]).Set(float64(deviceResponse.GetDeviceStatus().GetBatteryLevel()))
+						e.deviceMetrics.battery.With(deviceLabel).Set(float64(deviceResponse.GetDeviceStatus().GetBatteryLevel()))
 					}
 					if deviceResponse.GetDeviceStatus().GetExternalPowerSource() {
-						deviceExternalPower.With(labelsMap[devEui]).Set(1)
+						e.deviceMetrics.externalPower.With(deviceLabel).Set(1)
 					} else {
-						deviceExternalPower.With(labelsMap[devEui]).Set(0)
+						e.deviceMetrics.externalPower.With(deviceLabel).Set(0)
 					}
 
 				}
+				e.reloadMutex.RUnlock()
 			}
-			grpcConnectionTotal.Inc()
+			e.metrics.grpcConnectionTotal.Inc()
 		} else {
 			log.Debug().Msg("No deviceEui to query device status")
 		}
@@ -183,11 +135,11 @@ func getDeviceStatus() {
 
 }
 
-func getApiKey() string {
-	if len(config.ApiKey) > 0 {
-		return config.ApiKey
+func (e *Exporter) apiKey() string {
+	if len(e.config.ApiKey) > 0 {
+		return e.config.ApiKey
 	}
-	if file, err := os.Open(config.ApiFile); err == nil {
+	if file, err := os.Open(e.config.ApiFile); err == nil {
 		defer file.Close()
 		scanner := bufio.NewScanner(file)
 		scanner.Scan()
@@ -196,273 +148,115 @@ func getApiKey() string {
 	return ""
 }
 
-// https://sensecap-docs.seeed.cc/measurement_list.html
-var senseCapMeasurementIdTypeMap = map[float64]string{
-	3000: "battery",
-	3940: "sosMode",
-	3941: "workMode",
-	4097: "airTemperature",
-	4098: "airHumidity",
-	4099: "lightIntensity",
-	4100: "co2",
-	4101: "barometricPressure",
-	4102: "soilTemperature",
-	4103: "soilMoisture",
-	4104: "windDirection",
-	4105: "windSpeed",
-	4106: "pH",
-	4107: "lightQuantum",
-	4108: "electricalConductivity",
-	4109: "dissolvedOxygen",
-	4204: "soilPoreWaterEletricalConductivity",
-	4205: "epsilon",
-	4197: "longitude",
-	4198: "latitude",
-	4199: "lightIntensityPercent",
-	4200: "sosEvent",
-}
-
-func parseChirpstackWebhook(body []byte) (string, bool, error) {
-	var payload WebHookDoc
-	var payloadSensecap []WebHookSensecapMessage
-	var lastLat, lastLon float64
-	metricGeoFlag := false
-
-	// set needDump to true if we need a dump, we do this so we don't dump twice
-	needDump := false
-	if err := json.Unmarshal(body, &payload); err != nil {
-		return "", true, err
+// parseChirpstackWebhook decodes a webhook body of event, updates the
+// metrics and returns the decoded uplink and why the body is worth dumping, if
+// it is. The parse and decode stages are recorded as children of root, if set.
+func (e *Exporter) parseChirpstackWebhook(event string, body []byte, root *span) (*Uplink, []string, error) {
+	uplink := &Uplink{}
+	// the reasons to dump, we collect them so we don't dump twice
+	var dumpReasons []string
+	parseSpan := root.child("parse")
+	doc, err := chirpstack.ParseEvent(event, body)
+	if errors.Is(err, chirpstack.ErrUnknownEvent) {
+		parseSpan.finish(nil)
+		return nil, nil, err
 	}
-	if len(payload.Object.Messages) > 0 {
-		// This is a sensecap device
-		if err := json.Unmarshal(payload.Object.Messages, &payloadSensecap); err != nil {
-			// If it fails to unmarshal its because its an array of array of messages. So we dearray it
-			var deArray []json.RawMessage
-			if err := json.Unmarshal(payload.Object.Messages, &deArray); err != nil {
-				// Its not an array of array i guess :P return error
-				return "", true, err
-			}
-			for _, rawJson := range deArray {
-				var newMessages []WebHookSensecapMessage
-				if err := json.Unmarshal(rawJson, &newMessages); err != nil {
-					return "", true, err
-				}
-				payloadSensecap = append(payloadSensecap, newMessages...)
-			}
-		}
+	if err != nil {
+		parseSpan.finish(err)
+		return nil, []string{dumpReasonParseError}, err
 	}
+	parseSpan.finish(nil)
+	uplink.Doc = doc
+	uplink.Header = doc.EventHeader()
 
-	devEui := payload.DeviceInfo.DevEui
-	OUI := getOui(devEui)
-	if len(payload.RxInfo) > 0 {
-		for _, rxinfo := range payload.RxInfo {
-			deviceGatewayLabel := prometheus.Labels{"gatewayId": rxinfo.GatewayID, "deviceName": payload.DeviceInfo.DeviceName, "deviceEui": payload.DeviceInfo.DevEui}
-			deviceLastseen.With(deviceGatewayLabel).Set(float64(payload.Time.Unix()))
-			deviceRxInfoRssi.With(deviceGatewayLabel).Set(float64(rxinfo.Rssi))
-			deviceRxInfoSnr.With(deviceGatewayLabel).Set(float64(rxinfo.Snr))
+	devEui := uplink.DeviceInfo.DevEui
+	OUI := decoder.OUI(devEui)
+	uplink.DevEui = devEui
+	uplink.OUI = OUI
+	decodeSpan := root.child("decode")
+	decodeSpan.setString("lora.oui", OUI)
+
+	var result *decoder.Result
+	if up, ok := doc.(*chirpstack.UplinkEvent); ok {
+		if result, err = decoder.Decode(up); err != nil {
+			decodeSpan.finish(err)
+			return nil, []string{dumpReasonParseError}, err
 		}
 	}
 
+	baseLabel, firstTime := e.devices.updateDevice(uplink.DeviceInfo)
+	uplink.Labels = baseLabel
+
 	// We check if this is the first time
-	_, proccesedBefore := labelsMap[devEui]
-	if !proccesedBefore {
-		log.Info().Str("deviceName", payload.DeviceInfo.DeviceName).Str("deviceEui", payload.DeviceInfo.DevEui).Msg("First time procesing this deviceEUI, dumping in case.")
-		needDump = true
+	if firstTime {
+		log.Info().Str("deviceName", uplink.DeviceInfo.DeviceName).Str("deviceEui", devEui).Msg("First time procesing this deviceEUI, dumping in case.")
+		dumpReasons = append(dumpReasons, dumpReasonFirstSeen)
 	}
 
-	labelsMap[devEui] = prometheus.Labels{"deviceName": payload.DeviceInfo.DeviceName, "deviceEui": payload.DeviceInfo.DevEui}
-	deviceLabel := labelsMap[devEui]
-
-	if payload.BatteryLevel > 0 {
-		log.Debug().Str("devEui", devEui).Msg("Got battery level")
-		deviceBattery.With(labelsMap[devEui]).Set(float64(payload.BatteryLevel))
+	// Every event sets the fcnt and counts as a confirmed or unconfirmed
+	// message, only up has them so the others set 0 and count as unconfirmed
+	fcnt, confirmed := 0, false
+	if up, ok := doc.(*chirpstack.UplinkEvent); ok {
+		fcnt, confirmed = up.FCnt, up.Confirmed
 	}
-	deviceFcnt.With(deviceLabel).Set(float64(payload.FCnt))
-	if payload.Confirmed {
-		deviceConfirmed.With(deviceLabel).Inc()
+	e.deviceMetrics.fcnt.With(baseLabel).Set(float64(fcnt))
+	if confirmed {
+		e.deviceMetrics.confirmed.With(baseLabel).Inc()
 	} else {
-		deviceUnconfirmed.With(deviceLabel).Inc()
+		e.deviceMetrics.unconfirmed.With(baseLabel).Inc()
 	}
-	if payload.Level != "" {
-		deviceMsgLevelCount.With(prometheus.Labels{"deviceName": payload.DeviceInfo.DeviceName, "deviceEui": payload.DeviceInfo.DevEui, "level": payload.Level, "code": payload.Code}).Inc()
-		log.Warn().Str("devEui", devEui).Str("OUI", OUI).Str("level", payload.Level).Str("code", payload.Code).Msgf("Webhook posted an error")
-	}
-	switch OUI {
-	// Sensecap
-	case "2c:f7:f1":
-		// https://sensecap-docs.seeed.cc/measurement_list.html
-		for _, m := range payloadSensecap {
-			switch m.Type {
-			case "upload_battery":
-				deviceLabel["type"] = "battery"
-				deviceMetric.With(deviceLabel).Set(castToFloat64(m.Battery))
-			case "upload_interval":
-				deviceLabel["type"] = "interval"
-				deviceMetric.With(deviceLabel).Set(castToFloat64(m.Interval))
-			default:
-				id := castToFloat64(m.MeasurementID)
-				if id > 0 {
-					if metricType, ok := senseCapMeasurementIdTypeMap[id]; ok {
-						deviceLabel["type"] = metricType
-						deviceMetric.With(deviceLabel).Set(castToFloat64(m.MeasurementValue))
-						if metricType == "longitude" {
-							metricGeoFlag = config.MetricsGeo
-							lastLon = castToFloat64(m.MeasurementValue)
-						} else if metricType == "latitude" {
-							metricGeoFlag = config.MetricsGeo
-							lastLat = castToFloat64(m.MeasurementValue)
-						}
-					} else {
-						log.Error().Caller().Str("DevEUI", payload.DeviceInfo.DevEui).Msgf("MeasurementId %0f is not supported", m.MeasurementID)
-					}
-				}
-			}
 
+	switch doc := doc.(type) {
+	case *chirpstack.UplinkEvent:
+		for _, rxinfo := range doc.RxInfo {
+			deviceGatewayLabel := mergeLabels(baseLabel, prometheus.Labels{"gatewayId": rxinfo.GatewayID})
+			e.deviceMetrics.lastseen.With(deviceGatewayLabel).Set(float64(doc.Time.Unix()))
+			e.deviceMetrics.rxInfoRssi.With(deviceGatewayLabel).Set(float64(rxinfo.Rssi))
+			e.deviceMetrics.rxInfoSnr.With(deviceGatewayLabel).Set(float64(rxinfo.Snr))
 		}
-		if metricGeoFlag {
-			// We have to loop through the data again to create new metrics with geo data
-			for _, m := range payloadSensecap {
-				id := castToFloat64(m.MeasurementID)
-				if id > 0 {
-					if metricType, ok := senseCapMeasurementIdTypeMap[id]; ok {
-						if metricType != "longitude" && metricType != "latitude" {
-							label := prometheus.Labels{"deviceName": payload.DeviceInfo.DeviceName, "deviceEui": payload.DeviceInfo.DevEui, "type": metricType, "lat": fmt.Sprintf("%f", lastLat), "lon": fmt.Sprintf("%f", lastLon)}
-							deviceMetricGeo.With(label).Set(castToFloat64(m.MeasurementValue))
-						}
-					}
-				}
-			}
-		}
-
-	// REJEE
-	case "ca:cb:b8":
-		if payload.Object.Battery.Valid {
-			deviceLabel["type"] = "battery"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Battery.Float64)
-		}
-		if payload.Object.Temperature.Valid {
-			deviceLabel["type"] = "airTemperature"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Temperature.Float64)
-		}
-		if payload.Object.Humidity.Valid {
-			deviceLabel["type"] = "airHumidity"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Humidity.Float64)
-		}
-		if payload.Object.Vol.Valid {
-			deviceLabel["type"] = "vol"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Vol.Float64)
-		}
-	// DRAGINO
-	case "a8:40:41":
-		if payload.Object.TempCSHT.Valid {
-			deviceLabel["type"] = "airTemperature"
-			deviceMetric.With(deviceLabel).Set(payload.Object.TempCSHT.Float64)
-		}
-		if payload.Object.TempCDS.Valid {
-			deviceLabel["type"] = "externalTemperature"
-			deviceMetric.With(deviceLabel).Set(payload.Object.TempCDS.Float64)
-		}
-		if payload.Object.HumSHT.Valid {
-			deviceLabel["type"] = "airHumidity"
-			deviceMetric.With(deviceLabel).Set(payload.Object.HumSHT.Float64)
-		}
-		if payload.Object.LastDoorOpenDuration.Valid {
-			deviceLabel["type"] = "lastOpenDuration"
-			deviceMetric.With(deviceLabel).Set(payload.Object.LastDoorOpenDuration.Float64)
-		}
-		if payload.Object.Alarm.Valid {
-			deviceLabel["type"] = "alarm"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Alarm.Float64)
-		}
-		if payload.Object.DoorOpenTimes.Valid {
-			deviceLabel["type"] = "openCount"
-			deviceMetric.With(deviceLabel).Set(payload.Object.DoorOpenTimes.Float64)
-		}
-		if payload.Object.BatV.Valid {
-			deviceLabel["type"] = "batteryVolts"
-			deviceMetric.With(deviceLabel).Set(payload.Object.BatV.Float64)
-		}
-		if payload.Object.Mod.Valid {
-			deviceLabel["type"] = "mod"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Mod.Float64)
+		uplink.Decoder = result.Decoder
+		uplink.Measurements = result.Measurements
+		uplink.Location = DeviceLocation(result.Location)
+		uplink.UnsupportedMeasurementIDs = result.UnsupportedMeasurementIDs
+		uplink.UsedFields = result.UsedFields
+		for _, err := range result.Errors {
+			uplink.addError(err)
 		}
-		if payload.Object.DoorOpenStatus.Valid {
-			deviceLabel["type"] = "openStatus"
-			deviceMetric.With(deviceLabel).Set(payload.Object.DoorOpenStatus.Float64)
+		for _, id := range result.UnsupportedMeasurementIDs {
+			log.Error().Caller().Str("DevEUI", devEui).Msgf("MeasurementId %s is not supported", id)
 		}
-		if payload.Object.WaterLeakStatus.Valid {
-			deviceLabel["type"] = "waterLeakStatus"
-			deviceMetric.With(deviceLabel).Set(payload.Object.WaterLeakStatus.Float64)
+		if len(result.Decoder) == 0 {
+			dumpReasons = append(dumpReasons, dumpReasonUnsupportedOUI)
+			log.Warn().Str("devEui", devEui).Str("OUI", OUI).Msgf("Unsupported OUI")
 		}
-		if payload.Object.WaterLeakLastDuration.Valid {
-			deviceLabel["type"] = "waterLeakLastDuration"
-			deviceMetric.With(deviceLabel).Set(payload.Object.WaterLeakLastDuration.Float64)
+	case *chirpstack.StatusEvent:
+		if doc.BatteryLevel > 0 {
+			log.Debug().Str("devEui", devEui).Msg("Got battery level")
+			e.deviceMetrics.battery.With(baseLabel).Set(doc.BatteryLevel)
 		}
-		if payload.Object.WaterLeakCount.Valid {
-			deviceLabel["type"] = "waterLeakCount"
-			deviceMetric.With(deviceLabel).Set(payload.Object.WaterLeakCount.Float64)
+	case *chirpstack.LogEvent:
+		e.deviceMetrics.msgLevelCount.With(mergeLabels(baseLabel, prometheus.Labels{"level": doc.Level, "code": doc.Code})).Inc()
+		log.Warn().Str("devEui", devEui).Str("OUI", OUI).Str("level", doc.Level).Str("code", doc.Code).Msgf("Webhook posted an error")
+		if doc.Level == "ERROR" {
+			uplink.addError(fmt.Errorf("%s: %s", doc.Code, doc.Description))
 		}
-	// Milesight
-	case "24:e1:24":
-		if payload.Object.Temperature.Valid {
-			deviceLabel["type"] = "temperature" // We use temperatuer when we don't know if its for liquid or air
-			deviceMetric.With(deviceLabel).Set(payload.Object.Temperature.Float64)
-		}
-		if payload.Object.Humidity.Valid {
-			deviceLabel["type"] = "airHumidity"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Humidity.Float64)
-		}
-		if payload.Object.Decoded.Temperature.Valid {
-			deviceLabel["type"] = "airTemperature"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Decoded.Temperature.Float64)
-		}
-		if payload.Object.Decoded.Humidity.Valid {
-			deviceLabel["type"] = "airHumidity"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Decoded.Humidity.Float64)
-		}
-		if payload.Object.Distance.Valid {
-			deviceLabel["type"] = "distance"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Distance.Float64)
-		}
-		if len(payload.Object.Position) > 0 {
-			deviceLabel["type"] = "position"
-			if payload.Object.Position == "normal" {
-				deviceMetric.With(deviceLabel).Set(float64(0))
-			} else { // "tilt"
-				deviceMetric.With(deviceLabel).Set(float64(1))
-			}
-		}
-		if payload.Object.Decoded.Battery.Valid {
-			deviceLabel["type"] = "battery"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Decoded.Battery.Float64)
-		}
-		if payload.Object.Battery.Valid {
-			deviceLabel["type"] = "battery"
-			deviceMetric.With(deviceLabel).Set(payload.Object.Battery.Float64)
-		}
-	default:
-		needDump = true
-		log.Warn().Str("devEui", devEui).Str("OUI", OUI).Msgf("Unsupported OUI")
 	}
 
-	// deviceLabel is a pointer to labelsMap[devEui] so we need to remove type which is not used by deviceLabel
-	delete(deviceLabel, "type")
-
-	log.Debug().Str("devEui", devEui).Str("OUI", OUI).Bool("needDump", needDump).Msg("Parsed Webhook")
-	return devEui, needDump, nil
-}
+	for _, m := range uplink.Measurements {
+		e.deviceMetrics.metric.With(mergeLabels(baseLabel, prometheus.Labels{"type": m.Type})).Set(m.Value)
+	}
+	e.geo.updateDeviceLocation(baseLabel, devEui, uplink.Location)
+	e.forwardGeofenceEvents(devEui, e.geo.checkGeofences(baseLabel, devEui, uplink.Time, uplink.Location))
+	e.geo.updateGatewayDistance(baseLabel, devEui, uplink.DeviceInfo.Tags, uplink.Location, uplink.RxInfo())
 
-// Get OUI in XX:XX:XX hex format
-func getOui(s string) string {
-	if len(s) >= 6 {
-		return strings.ToLower(fmt.Sprintf("%s:%s:%s", s[0:2], s[2:4], s[4:6]))
-	} else {
-		return "00:00:00"
+	decodeSpan.setString("lora.vendor", decoder.Vendor(devEui))
+	decodeSpan.setInt("lora.measurements", len(uplink.Measurements))
+	var decodeErr error
+	if len(uplink.Errors) > 0 {
+		decodeErr = errors.New(strings.Join(uplink.Errors, "; "))
 	}
-}
+	decodeSpan.finish(decodeErr)
 
-// This casts json.Nubmer without the error
-func castToFloat64(num json.Number) float64 {
-	f, _ := num.Float64()
-	return f
+	log.Debug().Str("devEui", devEui).Str("OUI", OUI).Strs("dumpReasons", dumpReasons).Msg("Parsed Webhook")
+	return uplink, dumpReasons, nil
 }
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/caarlos0/env/v9"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// The config file keys of the sections without an env var, the other keys
+// are the env var names
+const (
+	configForwardRules = "FORWARD_RULES"
+	configDevices      = "DEVICES"
+)
+
+// DeviceSettings are the settings of one device in the devices section of
+// the config file
+type DeviceSettings struct {
+	// Location is the fixed lat, lon and optional altitude, like
+	// DEVICE_LOCATIONS
+	Location []float64 `json:"location"`
+	// StaleAfter overrides DEVICE_STALE_AFTER for the device
+	StaleAfter *int `json:"staleAfter"`
+}
+
+// configSections are the parts of the config file without an env var
+type configSections struct {
+	forwardRules []*ForwardRule
+	devices      map[string]*DeviceSettings
+}
+
+// reloadableSettings are applied by Exporter.Reload, the others need a restart
+var reloadableSettings = map[string]bool{
+	"FORWARD":                    true,
+	"FORWARD_RULES_FILE":         true,
+	"DEVICE_STALE_AFTER":         true,
+	"DEVICE_LOCATIONS":           true,
+	"DUMP_COMPRESS":              true,
+	"DUMP_RETENTION_DAYS":        true,
+	"DUMP_MAX_SIZE_MB":           true,
+	"DUMP_MAX_PER_DEVICE":        true,
+	"GEOFENCE_FILE":              true,
+	"GEOFENCE_FORWARD":           true,
+	"TENANT_TOKENS":              true,
+	"APPLICATION_TOKENS":         true,
+	"AUTHKEY":                    true,
+	"METRICS_DEVICE_TAGS":        true,
+	"METRICS_DEVICE_VARIABLES":   true,
+	"METRICS_APPLICATION_LABELS": true,
+	"DEBUG":                      true,
+}
+
+// loadConfig reads the config and validates it
+func loadConfig() (EnvConfig, error) {
+	c, err := readConfig()
+	if err != nil {
+		return c, err
+	}
+	return c, c.validate()
+}
+
+// readConfig reads CONFIG_FILE if it is set and overrides it with the
+// environment
+func readConfig() (EnvConfig, error) {
+	var c EnvConfig
+	environment := map[string]string{}
+	var sections configSections
+	if file := os.Getenv("CONFIG_FILE"); len(file) > 0 {
+		var err error
+		if environment, sections, err = readConfigFile(file); err != nil {
+			return c, fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		environment[name] = value
+	}
+	if err := env.ParseWithOptions(&c, env.Options{Environment: environment}); err != nil {
+		return c, err
+	}
+	c.ForwardRules = sections.forwardRules
+	c.Devices = sections.devices
+	return c, nil
+}
+
+// readConfigFile reads a yaml (.yaml, .yml) or toml (.toml) config file into
+// the env vars it sets and the sections without one
+func readConfigFile(filename string) (map[string]string, configSections, error) {
+	var sections configSections
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, sections, err
+	}
+	doc := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		err = fmt.Errorf("unsupported config file type %q, use .yaml, .yml or .toml", filepath.Ext(filename))
+	}
+	if err != nil {
+		return nil, sections, err
+	}
+	names := configSettings()
+	environment := map[string]string{}
+	var errs []error
+	for _, key := range sortedKeys(doc) {
+		name := strings.ToUpper(key)
+		switch {
+		case name == configForwardRules:
+			if sections.forwardRules, err = parseConfigForwardRules(doc[key]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		case name == configDevices:
+			if sections.devices, err = parseConfigDevices(doc[key]); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			}
+		case !names[name]:
+			errs = append(errs, fmt.Errorf("unknown setting %q", key))
+		default:
+			separator := ","
+			if name == "DEVICE_LOCATIONS" {
+				separator = ";"
+			}
+			environment[name] = configValue(doc[key], separator)
+		}
+	}
+	return environment, sections, errors.Join(errs...)
+}
+
+// configSettings returns the env var names of EnvConfig
+func configSettings() map[string]bool {
+	names := map[string]bool{}
+	t := reflect.TypeOf(EnvConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		if name, _, _ := strings.Cut(t.Field(i).Tag.Get("env"), ","); len(name) > 0 {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// configValue turns a config file value into its env var form, lists are
+// joined with separator and maps become key=value entries
+func configValue(value interface{}, separator string) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			items = append(items, configValue(item, ","))
+		}
+		return strings.Join(items, separator)
+	case map[string]interface{}:
+		entries := make([]string, 0, len(v))
+		for _, key := range sortedKeys(v) {
+			entries = append(entries, key+"="+configValue(v[key], ","))
+		}
+		return strings.Join(entries, separator)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseConfigForwardRules parses the inline forward rules, they have the same
+// fields as FORWARD_RULES_FILE
+func parseConfigForwardRules(value interface{}) ([]*ForwardRule, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return parseForwardRules(b)
+}
+
+// parseConfigDevices parses the devices section, keyed by devEui
+func parseConfigDevices(value interface{}) (map[string]*DeviceSettings, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var parsed map[string]*DeviceSettings
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	devices := map[string]*DeviceSettings{}
+	for devEui, device := range parsed {
+		if device == nil {
+			device = &DeviceSettings{}
+		}
+		devices[strings.ToLower(devEui)] = device
+	}
+	return devices, nil
+}
+
+// validate checks the settings that would otherwise fail (or misbehave) later
+func (c EnvConfig) validate() error {
+	var errs []error
+	positive := map[string]int{
+		"INTERVAL":                    c.Interval,
+		"FORWARD_QUEUE_SIZE":          c.ForwardQueueSize,
+		"FORWARD_TIMEOUT":             c.ForwardTimeout,
+		"INFLUX_QUEUE_SIZE":           c.InfluxQueueSize,
+		"INFLUX_BATCH_SIZE":           c.InfluxBatchSize,
+		"INFLUX_FLUSH_INTERVAL":       c.InfluxFlushInterval,
+		"REMOTE_WRITE_QUEUE_SIZE":     c.RemoteWriteQueueSize,
+		"REMOTE_WRITE_BATCH_SIZE":     c.RemoteWriteBatchSize,
+		"OTEL_METRIC_EXPORT_INTERVAL": c.OtlpMetricInterval,
+		"STREAM_BUFFER_SIZE":          c.StreamBufferSize,
+	}
+	for _, name := range sortedKeys(positive) {
+		if positive[name] <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be more than 0, got %d", name, positive[name]))
+		}
+	}
+	notNegative := map[string]int{
+		"DUMP_RETENTION_DAYS":    c.DumpRetentionDays,
+		"DUMP_MAX_SIZE_MB":       c.DumpMaxSizeMB,
+		"DUMP_MAX_PER_DEVICE":    c.DumpMaxPerDevice,
+		"FORWARD_MAX_RETRIES":    c.ForwardMaxRetries,
+		"DEVICE_STALE_AFTER":     c.DeviceStaleAfter,
+		"HISTORY_RETENTION_DAYS": c.HistoryRetentionDays,
+		"HISTORY_MAX_POINTS":     c.HistoryMaxPoints,
+		"STREAM_MAX_CLIENTS":     c.StreamMaxClients,
+		"CONFIG_RELOAD_INTERVAL": c.ConfigReloadInterval,
+	}
+	for _, name := range sortedKeys(notNegative) {
+		if notNegative[name] < 0 {
+			errs = append(errs, fmt.Errorf("%s can't be negative, got %d", name, notNegative[name]))
+		}
+	}
+	if c.ForwardRetryInitial > c.ForwardRetryMax {
+		errs = append(errs, fmt.Errorf("FORWARD_RETRY_INITIAL (%d) is more than FORWARD_RETRY_MAX (%d)", c.ForwardRetryInitial, c.ForwardRetryMax))
+	}
+	if c.MetricsGeohashPrecision < 0 || c.MetricsGeohashPrecision > 12 {
+		errs = append(errs, fmt.Errorf("METRICS_GEOHASH_PRECISION must be 0 to 12, got %d", c.MetricsGeohashPrecision))
+	}
+	if c.OtlpProtocol != otlpProtocolGrpc && c.OtlpProtocol != otlpProtocolHttp {
+		errs = append(errs, fmt.Errorf("OTEL_EXPORTER_OTLP_PROTOCOL must be %s or %s, got %q", otlpProtocolGrpc, otlpProtocolHttp, c.OtlpProtocol))
+	}
+	if _, err := parseScopeTokens(c.TenantTokens); err != nil {
+		errs = append(errs, fmt.Errorf("TENANT_TOKENS: %w", err))
+	}
+	if _, err := parseScopeTokens(c.ApplicationTokens); err != nil {
+		errs = append(errs, fmt.Errorf("APPLICATION_TOKENS: %w", err))
+	}
+	if _, err := fixedLocations(c); err != nil {
+		errs = append(errs, err)
+	}
+	for _, devEui := range sortedKeys(c.Devices) {
+		if _, err := hex.DecodeString(devEui); err != nil || len(devEui) != 16 {
+			errs = append(errs, fmt.Errorf("devices: %q is not a devEui", devEui))
+		}
+		if staleAfter := c.Devices[devEui].StaleAfter; staleAfter != nil && *staleAfter < 0 {
+			errs = append(errs, fmt.Errorf("devices: %s staleAfter can't be negative, got %d", devEui, *staleAfter))
+		}
+	}
+	if err := checkDeviceLabelKeys(c); err != nil {
+		errs = append(errs, err)
+	}
+	// Two rules for one url would share its spool folder
+	if _, err := forwardRules(c); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// restartRequired returns the settings that differ between a and b and can
+// only change with a restart
+func restartRequired(a EnvConfig, b EnvConfig) []string {
+	var names []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		name, _, _ := strings.Cut(va.Type().Field(i).Tag.Get("env"), ",")
+		if len(name) == 0 || reloadableSettings[name] {
+			continue
+		}
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// withReloadable returns c with the reloadable settings of next. Fields
+// without an env var only come from the config file and are reloadable too.
+func (c EnvConfig) withReloadable(next EnvConfig) EnvConfig {
+	vc, vn := reflect.ValueOf(&c).Elem(), reflect.ValueOf(next)
+	for i := 0; i < vc.NumField(); i++ {
+		name, _, _ := strings.Cut(vc.Type().Field(i).Tag.Get("env"), ",")
+		if len(name) == 0 || reloadableSettings[name] {
+			vc.Field(i).Set(vn.Field(i))
+		}
+	}
+	return c
+}
+
+// configWatcher reloads the config on SIGHUP and when one of the files it
+// was read from changes
+type configWatcher struct {
+	exporter *Exporter
+	mutex    sync.Mutex
+	modTimes map[string]time.Time
+}
+
+func newConfigWatcher(exporter *Exporter) *configWatcher {
+	w := &configWatcher{exporter: exporter, modTimes: map[string]time.Time{}}
+	for _, file := range exporter.watchedFiles() {
+		if info, err := os.Stat(file); err == nil {
+			w.modTimes[file] = info.ModTime()
+		}
+	}
+	return w
+}
+
+// watchSignals reloads on every SIGHUP
+func (w *configWatcher) watchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		log.Info().Msg("Got SIGHUP, reloading configuration")
+		w.reload()
+	}
+}
+
+// checkFiles reloads if CONFIG_FILE, FORWARD_RULES_FILE, GEOFENCE_FILE or a
+// template file of the forward rules changed since the last check. A file
+// that was not watched before was just read, so it only starts being watched.
+func (w *configWatcher) checkFiles() {
+	changed := ""
+	modTimes := map[string]time.Time{}
+	w.mutex.Lock()
+	for _, file := range w.exporter.watchedFiles() {
+		info, err := os.Stat(file)
+		if err != nil {
+			log.Error().Err(err).Str("file", file).Msg("Failed to check config file")
+			continue
+		}
+		if last, found := w.modTimes[file]; found && !last.Equal(info.ModTime()) {
+			changed = file
+		}
+		modTimes[file] = info.ModTime()
+	}
+	w.modTimes = modTimes
+	w.mutex.Unlock()
+	if len(changed) > 0 {
+		log.Info().Str("file", changed).Msg("Config file changed, reloading configuration")
+		w.reload()
+	}
+}
+
+// reload applies the reloadable settings of the current config, an invalid
+// config is logged and the running one kept
+func (w *configWatcher) reload() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	next, err := loadConfig()
+	if err != nil {
+		log.Error().Err(err).Msg("Invalid configuration, keeping the running one")
+		return
+	}
+	restart, err := w.exporter.Reload(next)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to reload configuration, keeping the running one")
+		return
+	}
+	if next.Debug {
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	} else {
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+	if len(restart) > 0 {
+		log.Warn().Strs("settings", restart).Msg("Changed settings need a restart to apply")
+	}
+	log.Info().Msg("Reloaded configuration")
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		content     string
+		want        map[string]string
+		wantRules   []string
+		wantDevices []string
+		wantErr     string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `interval: 60
+debug: true
+metrics_device_tags: [site, room]
+tenant_tokens:
+  t1: s3cret
+device_locations:
+  a84041093187f23c: [1.4437, 103.8074]
+  24e124713d322618: [1.4438, 103.8076, 15]
+forward_rules:
+  - url: https://example.com/hook
+    events: [up]
+devices:
+  A84041FBD1889410:
+    location: [1.4, 103.8]
+    staleAfter: 600
+`,
+			want: map[string]string{
+				"INTERVAL":            "60",
+				"DEBUG":               "true",
+				"METRICS_DEVICE_TAGS": "site,room",
+				"TENANT_TOKENS":       "t1=s3cret",
+				"DEVICE_LOCATIONS":    "24e124713d322618=1.4438,103.8076,15;a84041093187f23c=1.4437,103.8074",
+			},
+			wantRules:   []string{"https://example.com/hook"},
+			wantDevices: []string{"a84041fbd1889410"},
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			content: `INTERVAL = 60
+Forward = ["http://a", "http://b"]
+
+[[forward_rules]]
+url = "https://example.com/hook"
+
+[devices.a84041fbd1889410]
+staleAfter = 600
+`,
+			want:        map[string]string{"INTERVAL": "60", "FORWARD": "http://a,http://b"},
+			wantRules:   []string{"https://example.com/hook"},
+			wantDevices: []string{"a84041fbd1889410"},
+		},
+		{
+			name:    "unknown keys",
+			file:    "config.yml",
+			content: "interval: 60\nintervall: 60\nfoo: bar\n",
+			wantErr: `unknown setting "foo"` + "\n" + `unknown setting "intervall"`,
+		},
+		{
+			name:    "unknown device field",
+			file:    "config.yaml",
+			content: "devices:\n  a84041fbd1889410:\n    lat: 1\n",
+			wantErr: `devices: json: unknown field "lat"`,
+		},
+		{
+			name:    "invalid forward rule",
+			file:    "config.yaml",
+			content: "forward_rules:\n  - events: [up]\n",
+			wantErr: "forward_rules:",
+		},
+		{
+			name:    "unsupported type",
+			file:    "config.json",
+			content: "{}",
+			wantErr: `unsupported config file type ".json"`,
+		},
+		{
+			name:    "invalid yaml",
+			file:    "config.yaml",
+			content: "interval: [60\n",
+			wantErr: "yaml:",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			environment, sections, err := readConfigFile(writeConfigFile(t, test.file, test.content))
+			if len(test.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("got error %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(environment, test.want) {
+				t.Errorf("got %v, want %v", environment, test.want)
+			}
+			var rules []string
+			for _, rule := range sections.forwardRules {
+				rules = append(rules, rule.URL)
+			}
+			if !reflect.DeepEqual(rules, test.wantRules) {
+				t.Errorf("got forward rules %v, want %v", rules, test.wantRules)
+			}
+			if devices := sortedKeys(sections.devices); !reflect.DeepEqual(devices, test.wantDevices) {
+				t.Errorf("got devices %v, want %v", devices, test.wantDevices)
+			}
+		})
+	}
+}
+
+// TestReadConfig checks env vars override the config file
+func TestReadConfig(t *testing.T) {
+	file := writeConfigFile(t, "config.yaml", `interval: 60
+listen: 127.0.0.1:1
+device_stale_after: 600
+devices:
+  a84041fbd1889410:
+    staleAfter: 60
+`)
+	t.Setenv("CONFIG_FILE", file)
+	t.Setenv("INTERVAL", "120")
+	c, err := readConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Interval != 120 {
+		t.Errorf("got INTERVAL %d, want the env var 120", c.Interval)
+	}
+	if c.Listen != "127.0.0.1:1" || c.DeviceStaleAfter != 600 {
+		t.Errorf("got LISTEN %q and DEVICE_STALE_AFTER %d, want the file values", c.Listen, c.DeviceStaleAfter)
+	}
+	if c.InfluxBucket != "lora" {
+		t.Errorf("got INFLUX_BUCKET %q, want the default", c.InfluxBucket)
+	}
+	if device := c.Devices["a84041fbd1889410"]; device == nil || device.StaleAfter == nil || *device.StaleAfter != 60 {
+		t.Errorf("got devices %v", c.Devices)
+	}
+
+	t.Setenv("INTERVAL", "often")
+	if _, err := readConfig(); err == nil {
+		t.Error("got no error for an INTERVAL that does not parse")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	negative := -1
+	tests := []struct {
+		name    string
+		change  func(c *EnvConfig)
+		wantErr []string
+	}{
+		{"defaults", func(c *EnvConfig) {}, nil},
+		{"zero interval", func(c *EnvConfig) { c.Interval = 0 }, []string{"INTERVAL must be more than 0, got 0"}},
+		{"negative retention", func(c *EnvConfig) { c.DumpRetentionDays = -1 }, []string{"DUMP_RETENTION_DAYS can't be negative, got -1"}},
+		{"retry initial over max", func(c *EnvConfig) { c.ForwardRetryInitial, c.ForwardRetryMax = 10, 5 }, []string{"FORWARD_RETRY_INITIAL (10) is more than FORWARD_RETRY_MAX (5)"}},
+		{"geohash precision", func(c *EnvConfig) { c.MetricsGeohashPrecision = 13 }, []string{"METRICS_GEOHASH_PRECISION must be 0 to 12, got 13"}},
+		{"otlp protocol", func(c *EnvConfig) { c.OtlpProtocol = "udp" }, []string{`OTEL_EXPORTER_OTLP_PROTOCOL must be grpc or http/protobuf, got "udp"`}},
+		{"tokens", func(c *EnvConfig) { c.TenantTokens = "t1" }, []string{"TENANT_TOKENS:"}},
+		{"device locations", func(c *EnvConfig) { c.DeviceLocations = "a84041093187f23c=91,0" }, []string{"DEVICE_LOCATIONS:"}},
+		{"duplicate forward url", func(c *EnvConfig) {
+			c.Forward = "http://a"
+			c.ForwardRules = []*ForwardRule{{URL: "http://a"}}
+		}, []string{"forward url http://a is defined more than once"}},
+		{"devices", func(c *EnvConfig) {
+			c.Devices = map[string]*DeviceSettings{
+				"a84041fbd1889410": {Location: []float64{1}},
+				"site-a":           {StaleAfter: &negative},
+			}
+		}, []string{"devices: a84041fbd1889410 location: expected lat,lon[,alt]", `devices: "site-a" is not a devEui`, "devices: site-a staleAfter can't be negative, got -1"}},
+		{"colliding device labels", func(c *EnvConfig) {
+			c.MetricsDeviceTags = "site-a,site_a,site-a,room"
+			c.MetricsDeviceVariables = "floor.1,floor_1"
+		}, []string{`METRICS_DEVICE_TAGS: "site-a" and "site_a" are both label tag_site_a`, `METRICS_DEVICE_VARIABLES: "floor.1" and "floor_1" are both label var_floor_1`}},
+		{"all errors at once", func(c *EnvConfig) { c.Interval, c.StreamBufferSize = 0, 0 }, []string{"INTERVAL must be more than 0", "STREAM_BUFFER_SIZE must be more than 0"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c := config
+			test.change(&c)
+			err := c.validate()
+			if len(test.wantErr) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %q", test.wantErr)
+			}
+			for _, want := range test.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("got error %q, want it to contain %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(c *EnvConfig)
+		want   []string
+	}{
+		{"nothing", func(c *EnvConfig) {}, nil},
+		{"reloadable only", func(c *EnvConfig) {
+			c.Forward = "http://a"
+			c.DeviceStaleAfter = 60
+			c.DumpCompress = !c.DumpCompress
+			c.MetricsDeviceTags = "site"
+			c.Debug = true
+		}, nil},
+		{"sections", func(c *EnvConfig) {
+			c.ForwardRules = []*ForwardRule{{URL: "http://a"}}
+			c.Devices = map[string]*DeviceSettings{"a84041fbd1889410": {}}
+		}, nil},
+		{"listen", func(c *EnvConfig) { c.Listen = "127.0.0.1:1" }, []string{"LISTEN"}},
+		{"sorted", func(c *EnvConfig) {
+			c.MqttBroker = "tcp://mosquitto:1883"
+			c.InfluxURL = "http://influx:8086"
+			c.DumpFolder = "/data"
+			c.Debug = true
+		}, []string{"DUMP_FOLDER", "INFLUX_URL", "MQTT_BROKER"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			next := config
+			test.change(&next)
+			if got := restartRequired(config, next); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithReloadable(t *testing.T) {
+	next := config
+	next.Forward = "http://a"
+	next.DeviceStaleAfter = 60
+	next.DeviceLocations = "a84041093187f23c=1.4437,103.8074"
+	next.Debug = true
+	next.ForwardRules = []*ForwardRule{{URL: "http://b"}}
+	next.Devices = map[string]*DeviceSettings{"a84041fbd1889410": {}}
+	next.Listen = "127.0.0.1:1"
+	next.InfluxURL = "http://influx:8086"
+
+	want := next
+	want.Listen = config.Listen
+	want.InfluxURL = config.InfluxURL
+	if got := config.withReloadable(next); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if config.Forward != "" {
+		t.Error("withReloadable changed its receiver")
+	}
+}
+
+// TestConfigWatcher checks a change to any file the config was read from
+// reloads it
+func TestConfigWatcher(t *testing.T) {
+	template := writeConfigFile(t, "forward.tmpl", `{"v":1}`)
+	rules := writeConfigFile(t, "rules.json", `[{"url":"http://127.0.0.1:1/hook","templateFile":"`+template+`"}]`)
+	geofences := writeConfigFile(t, "geofences.json", `[{"name":"yard","latitude":1.3,"longitude":103.8,"radius":100}]`)
+	file := writeConfigFile(t, "config.yaml", "forward_rules_file: "+rules+"\ngeofence_file: "+geofences+"\n")
+	t.Setenv("CONFIG_FILE", file)
+	c, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewExporter(c, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newConfigWatcher(e)
+	if got, want := e.watchedFiles(), []string{file, rules, geofences, template}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got watched files %v, want %v", got, want)
+	}
+	// Writes in the same second can keep the modification time
+	modified := time.Now()
+	write := func(filename string, content string) {
+		modified = modified.Add(time.Minute)
+		if err := os.WriteFile(filename, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ruleTemplate := func() string {
+		d := e.forwarder.destinations[0]
+		d.mutex.Lock()
+		defer d.mutex.Unlock()
+		return d.rule.Template
+	}
+	zones := func() []string {
+		e.geo.geofenceMutex.Lock()
+		defer e.geo.geofenceMutex.Unlock()
+		var names []string
+		for _, zone := range e.geo.geofences {
+			names = append(names, zone.Name)
+		}
+		return names
+	}
+
+	w.checkFiles()
+	if got := ruleTemplate(); got != `{"v":1}` {
+		t.Errorf("got template %s without changes", got)
+	}
+	write(template, `{"v":2}`)
+	w.checkFiles()
+	if got := ruleTemplate(); got != `{"v":2}` {
+		t.Errorf("got template %s after changing the template file", got)
+	}
+	write(geofences, `[{"name":"dock","latitude":1.3,"longitude":103.8,"radius":50}]`)
+	w.checkFiles()
+	if got := zones(); !reflect.DeepEqual(got, []string{"dock"}) {
+		t.Errorf("got zones %v after changing GEOFENCE_FILE", got)
+	}
+	write(file, "forward_rules_file: "+rules+"\ngeofence_file: "+geofences+"\ntenant_tokens: t1=s3cret\n")
+	w.checkFiles()
+	if token, _ := e.scopeToken(scopeTenant, "t1"); token != "s3cret" {
+		t.Errorf("got tenant token %q after changing CONFIG_FILE", token)
+	}
+	// An invalid change keeps the running config
+	write(geofences, `[{"name":"dock"}]`)
+	w.checkFiles()
+	if got := zones(); !reflect.DeepEqual(got, []string{"dock"}) {
+		t.Errorf("got zones %v after an invalid GEOFENCE_FILE", got)
+	}
+}
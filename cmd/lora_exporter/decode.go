@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+// DecodeExplain is what `lora_exporter decode` found in a webhook
+type DecodeExplain struct {
+	File                      string                `json:"file"`
+	DevEui                    string                `json:"devEui"`
+	DeviceName                string                `json:"deviceName"`
+	DeviceProfileName         string                `json:"deviceProfileName"`
+	OUI                       string                `json:"oui"`
+	Vendor                    string                `json:"vendor"`
+	Decoder                   string                `json:"decoder"`
+	Fields                    []decoder.Measurement `json:"fields"`
+	SkippedNulls              []string              `json:"skippedNulls"`
+	Ignored                   []string              `json:"ignored"`
+	Errors                    []string              `json:"errors"`
+	UnsupportedMeasurementIDs []string              `json:"unsupportedMeasurementIds"`
+	Series                    []ReplaySample        `json:"series"`
+}
+
+// decodeCommand is `lora_exporter decode [flags] <file>`, it explains how a
+// webhook (or dump) is decoded and which series it produces, without starting
+// the exporter or touching its metrics
+func decodeCommand(args []string) int {
+	flags := flag.NewFlagSet("decode", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s decode [flags] <payload.json|dump>\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "text", "Output format, text or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+	if !config.Debug {
+		zerolog.SetGlobalLevel(zerolog.Disabled) // Everything worth knowing is in the explain
+	}
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	file := flags.Arg(0)
+	envelope, err := readDump(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read %s: %s\n", file, err)
+		return 1
+	}
+	event := envelope.Event
+	if len(event) == 0 {
+		event = chirpstack.EventUp
+	}
+	explain, err := explainWebhook(e, event, envelope.Payload())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to parse %s: %s\n", file, err)
+		return 1
+	}
+	explain.File = file
+	if *format == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(explain)
+	} else {
+		printExplain(os.Stdout, explain)
+	}
+	return 0
+}
+
+// explainWebhook decodes body with an exporter of its own and compares the
+// fields of the decoded object with what the decoder used
+func explainWebhook(e *Exporter, event string, body []byte) (*DecodeExplain, error) {
+	uplink, _, err := e.parseChirpstackWebhook(event, body, nil)
+	if err != nil {
+		return nil, err
+	}
+	explain := &DecodeExplain{
+		DevEui:                    uplink.DevEui,
+		DeviceName:                uplink.DeviceInfo.DeviceName,
+		DeviceProfileName:         uplink.DeviceInfo.DeviceProfileName,
+		OUI:                       uplink.OUI,
+		Vendor:                    decoder.Vendor(uplink.DevEui),
+		Decoder:                   uplink.Decoder,
+		Fields:                    append([]decoder.Measurement{}, uplink.Measurements...),
+		SkippedNulls:              []string{},
+		Ignored:                   []string{},
+		Errors:                    append([]string{}, uplink.Errors...),
+		UnsupportedMeasurementIDs: append([]string{}, uplink.UnsupportedMeasurementIDs...),
+	}
+	var doc struct {
+		Object map[string]interface{} `json:"object"`
+	}
+	json.Unmarshal(body, &doc)
+	fields := map[string]interface{}{}
+	flattenObject("", doc.Object, fields)
+	for _, field := range sortedKeys(fields) {
+		switch {
+		case !contains(uplink.UsedFields, field):
+			explain.Ignored = append(explain.Ignored, "object."+field)
+		case fields[field] == nil:
+			explain.SkippedNulls = append(explain.SkippedNulls, "object."+field)
+		}
+	}
+	mfs, err := e.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	explain.Series = replaySamples(deviceFamilies(mfs))
+	return explain, nil
+}
+
+// flattenObject adds the leaves of a decoded object by their dotted path,
+// arrays are leaves
+func flattenObject(prefix string, object map[string]interface{}, fields map[string]interface{}) {
+	for key, value := range object {
+		if nested, ok := value.(map[string]interface{}); ok && len(nested) > 0 {
+			flattenObject(prefix+key+".", nested, fields)
+		} else {
+			fields[prefix+key] = value
+		}
+	}
+}
+
+func printExplain(w io.Writer, explain *DecodeExplain) {
+	vendor := explain.Vendor
+	if len(vendor) == 0 {
+		vendor = "unsupported"
+	}
+	decoder := explain.Decoder
+	if len(decoder) == 0 {
+		decoder = "none"
+	}
+	fmt.Fprintf(w, "File:    %s\n", explain.File)
+	fmt.Fprintf(w, "Device:  %s %q, profile %q\n", explain.DevEui, explain.DeviceName, explain.DeviceProfileName)
+	fmt.Fprintf(w, "OUI:     %s (%s)\n", explain.OUI, vendor)
+	fmt.Fprintf(w, "Decoder: %s\n", decoder)
+	fmt.Fprintf(w, "\nFields:\n")
+	for _, m := range explain.Fields {
+		fmt.Fprintf(w, "  %s -> %s = %v\n", m.Field, m.Type, m.Value)
+	}
+	printExplainList(w, "Skipped null fields", explain.SkippedNulls)
+	printExplainList(w, "Ignored fields", explain.Ignored)
+	printExplainList(w, "Errors", explain.Errors)
+	fmt.Fprintf(w, "\nSeries:\n")
+	for _, sample := range explain.Series {
+		labels := make([]string, 0, len(sample.Labels))
+		for _, name := range sortedKeys(sample.Labels) {
+			labels = append(labels, fmt.Sprintf("%s=%q", name, sample.Labels[name]))
+		}
+		fmt.Fprintf(w, "  %s{%s} %v\n", sample.Name, strings.Join(labels, ","), sample.Value)
+	}
+}
+
+func printExplainList(w io.Writer, title string, list []string) {
+	if len(list) == 0 {
+		return
+	}
+	sort.Strings(list)
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, item := range list {
+		fmt.Fprintf(w, "  %s\n", item)
+	}
+}
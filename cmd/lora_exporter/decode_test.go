@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestExplainWebhook checks a used field without a value is a skipped null
+// and a field the decoder did not look at is ignored, null or not
+func TestExplainWebhook(t *testing.T) {
+	sample, err := os.ReadFile(filepath.Join(sampleDir, "dragino-lht52.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := `"object":{"TempC_DS":327.67,"Ext":1.0,"TempC_SHT":null,"Hum_SHT":40.8,"Systimestamp":1692793368.0,"Unknown":null,"Nested":{"a":1,"b":null},"Empty":{},"List":[1,2]}`
+	body := strings.Replace(string(sample), `"object":{"TempC_DS":327.67,"Ext":1.0,"TempC_SHT":34.73,"Hum_SHT":40.8,"Systimestamp":1692793368.0}`, object, 1)
+	if body == string(sample) {
+		t.Fatal("object of the sample changed")
+	}
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	explain, err := explainWebhook(e, "up", []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if explain.DevEui != "a84041fbd1889410" || explain.Vendor != "Dragino" || explain.Decoder != "dragino" {
+		t.Errorf("got device %s of %s decoded by %s", explain.DevEui, explain.Vendor, explain.Decoder)
+	}
+	var fields []string
+	for _, m := range explain.Fields {
+		fields = append(fields, m.Field+" "+m.Type)
+	}
+	wantFields := []string{"object.TempC_DS externalTemperature", "object.Hum_SHT airHumidity"}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("got fields %v, want %v", fields, wantFields)
+	}
+	if want := []string{"object.TempC_SHT"}; !reflect.DeepEqual(explain.SkippedNulls, want) {
+		t.Errorf("got skipped nulls %v, want %v", explain.SkippedNulls, want)
+	}
+	wantIgnored := []string{"object.Empty", "object.Ext", "object.List", "object.Nested.a", "object.Nested.b", "object.Systimestamp", "object.Unknown"}
+	if !reflect.DeepEqual(explain.Ignored, wantIgnored) {
+		t.Errorf("got ignored %v, want %v", explain.Ignored, wantIgnored)
+	}
+	if len(explain.Errors) != 0 {
+		t.Errorf("got errors %v", explain.Errors)
+	}
+	var airTemperature bool
+	for _, sample := range explain.Series {
+		airTemperature = airTemperature || sample.Labels["type"] == "airTemperature"
+	}
+	if airTemperature {
+		t.Errorf("got an airTemperature series for a null field")
+	}
+
+	if _, err := explainWebhook(e, "up", []byte("not json")); err == nil {
+		t.Errorf("got no error for a body that is not json")
+	}
+}
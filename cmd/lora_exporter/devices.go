@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+// How many decode errors and dumps are kept per device
+const (
+	deviceErrorsKept = 10
+	deviceDumpsKept  = 10
+)
+
+// deviceRegistry is what an Exporter knows about its devices: the labels and
+// chirpstack metadata of their series, and their latest state for the api
+type deviceRegistry struct {
+	config  EnvConfig
+	metrics *deviceMetrics
+
+	labelsMutex      sync.RWMutex
+	labelsMap        map[string]prometheus.Labels
+	deviceInfos      map[string]chirpstack.DeviceInfo
+	deviceVariables  map[string]map[string]string
+	deviceInfoLabels map[string]prometheus.Labels
+
+	devicesMutex sync.RWMutex
+	devices      map[string]*DeviceDetail
+}
+
+func newDeviceRegistry(config EnvConfig, metrics *deviceMetrics) *deviceRegistry {
+	return &deviceRegistry{
+		config:           config,
+		metrics:          metrics,
+		labelsMap:        map[string]prometheus.Labels{},
+		deviceInfos:      map[string]chirpstack.DeviceInfo{},
+		deviceVariables:  map[string]map[string]string{},
+		deviceInfoLabels: map[string]prometheus.Labels{},
+		devices:          map[string]*DeviceDetail{},
+	}
+}
+
+// GatewayState is the last reception of a device by a gateway
+type GatewayState struct {
+	GatewayID string    `json:"gatewayId"`
+	Rssi      int       `json:"rssi"`
+	Snr       float64   `json:"snr"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// DeviceError is a decode error of an uplink
+type DeviceError struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	Error string    `json:"error"`
+}
+
+// DeviceDump is a dump file of a webhook of the device
+type DeviceDump struct {
+	Time time.Time `json:"time"`
+	Name string    `json:"name"`
+	path string
+}
+
+// DeviceSummary is what /api/v1/devices lists for every device
+type DeviceSummary struct {
+	DevEui            string         `json:"devEui"`
+	Name              string         `json:"name"`
+	OUI               string         `json:"oui"`
+	Vendor            string         `json:"vendor"`
+	Supported         bool           `json:"supported"`
+	DeviceProfileName string         `json:"deviceProfileName"`
+	ApplicationName   string         `json:"applicationName"`
+	TenantName        string         `json:"tenantName"`
+	FirstSeen         time.Time      `json:"firstSeen"`
+	LastSeen          time.Time      `json:"lastSeen"`
+	Stale             bool           `json:"stale"`
+	Uplinks           int            `json:"uplinks"`
+	Battery           *float64       `json:"battery"`
+	ExternalPower     *bool          `json:"externalPower"`
+	Gateways          []GatewayState `json:"gateways"`
+	// Latest decoded measurements by type
+	MeasurementsTime time.Time          `json:"measurementsTime"`
+	Measurements     map[string]float64 `json:"measurements"`
+	// Sensecap measurement ids the decoder does not know
+	UnsupportedMeasurementIDs []string `json:"unsupportedMeasurementIds"`
+}
+
+// DeviceDetail is a device with its last raw uplink, recent decode errors and
+// dumps
+type DeviceDetail struct {
+	DeviceSummary
+	LastUplink json.RawMessage `json:"lastUplink"`
+	Errors     []DeviceError   `json:"errors"`
+	Dumps      []DeviceDump    `json:"dumps"`
+}
+
+// recordDevice updates the device registry from a parsed webhook
+func (r *deviceRegistry) recordDevice(event string, uplink *Uplink, body []byte) {
+	devEui := strings.ToLower(uplink.DevEui)
+	if len(devEui) == 0 {
+		return
+	}
+	seen := uplink.Time
+	if seen.IsZero() {
+		seen = time.Now()
+	}
+	r.devicesMutex.Lock()
+	defer r.devicesMutex.Unlock()
+	device, found := r.devices[devEui]
+	if !found {
+		device = &DeviceDetail{
+			DeviceSummary: DeviceSummary{DevEui: devEui, FirstSeen: seen, Gateways: []GatewayState{}, Measurements: map[string]float64{}, UnsupportedMeasurementIDs: []string{}},
+			Errors:        []DeviceError{},
+			Dumps:         []DeviceDump{},
+		}
+		r.devices[devEui] = device
+	}
+	info := uplink.DeviceInfo
+	device.OUI = uplink.OUI
+	device.Vendor = decoder.Vendor(devEui)
+	device.Supported = len(device.Vendor) > 0
+	if len(info.DeviceName) > 0 {
+		device.Name = info.DeviceName
+	}
+	if len(info.DeviceProfileName) > 0 {
+		device.DeviceProfileName = info.DeviceProfileName
+	}
+	if len(info.ApplicationName) > 0 {
+		device.ApplicationName = info.ApplicationName
+	}
+	if len(info.TenantName) > 0 {
+		device.TenantName = info.TenantName
+	}
+	if seen.After(device.LastSeen) {
+		device.LastSeen = seen
+	}
+	for _, rxinfo := range uplink.RxInfo() {
+		device.setGateway(GatewayState{GatewayID: rxinfo.GatewayID, Rssi: rxinfo.Rssi, Snr: rxinfo.Snr, LastSeen: seen})
+	}
+	if status, ok := uplink.Doc.(*chirpstack.StatusEvent); ok {
+		if status.BatteryLevel > 0 {
+			battery := status.BatteryLevel
+			device.Battery = &battery
+		}
+		external := status.ExternalPowerSource
+		device.ExternalPower = &external
+	}
+	if event == "up" {
+		device.Uplinks++
+		device.LastUplink = append(json.RawMessage{}, body...)
+		if len(uplink.Measurements) > 0 {
+			device.Measurements = uplink.MeasurementMap()
+			device.MeasurementsTime = seen
+		}
+		if battery, found := device.Measurements["battery"]; found {
+			device.Battery = &battery
+		}
+	}
+	for _, id := range uplink.UnsupportedMeasurementIDs {
+		if !contains(device.UnsupportedMeasurementIDs, id) {
+			device.UnsupportedMeasurementIDs = append(device.UnsupportedMeasurementIDs, id)
+			sort.Strings(device.UnsupportedMeasurementIDs)
+		}
+	}
+	for _, err := range uplink.Errors {
+		device.Errors = append(device.Errors, DeviceError{Time: seen, Event: event, Error: err})
+	}
+	if len(device.Errors) > deviceErrorsKept {
+		device.Errors = device.Errors[len(device.Errors)-deviceErrorsKept:]
+	}
+}
+
+// recordDeviceDump remembers the last dumps of a device so they can be
+// downloaded from /api/v1/devices/{devEui}/dumps/{name}
+func (r *deviceRegistry) recordDeviceDump(devEui string, filename string) {
+	r.devicesMutex.Lock()
+	defer r.devicesMutex.Unlock()
+	device, found := r.devices[strings.ToLower(devEui)]
+	if !found || len(filename) == 0 {
+		return
+	}
+	device.Dumps = append(device.Dumps, DeviceDump{Time: time.Now().UTC(), Name: filepath.Base(filename), path: filename})
+	if len(device.Dumps) > deviceDumpsKept {
+		device.Dumps = device.Dumps[len(device.Dumps)-deviceDumpsKept:]
+	}
+}
+
+func (d *DeviceDetail) setGateway(gateway GatewayState) {
+	for i := range d.Gateways {
+		if d.Gateways[i].GatewayID == gateway.GatewayID {
+			d.Gateways[i] = gateway
+			return
+		}
+	}
+	d.Gateways = append(d.Gateways, gateway)
+	sort.Slice(d.Gateways, func(i, j int) bool { return d.Gateways[i].GatewayID < d.Gateways[j].GatewayID })
+}
+
+// recordDeviceStatus updates the battery and power source of a device from
+// the device status chirpstack returned
+func (r *deviceRegistry) recordDeviceStatus(devEui string, battery float64, externalPower bool) {
+	r.devicesMutex.Lock()
+	defer r.devicesMutex.Unlock()
+	device, found := r.devices[strings.ToLower(devEui)]
+	if !found {
+		return
+	}
+	if battery > 0 {
+		device.Battery = &battery
+	}
+	device.ExternalPower = &externalPower
+}
+
+// listDevices returns the summary of every known device sorted by devEui
+func (r *deviceRegistry) listDevices() []DeviceSummary {
+	r.devicesMutex.RLock()
+	defer r.devicesMutex.RUnlock()
+	list := make([]DeviceSummary, 0, len(r.devices))
+	for _, device := range r.devices {
+		list = append(list, device.summary(r.isStale(device.DevEui, device.LastSeen)))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].DevEui < list[j].DevEui })
+	return list
+}
+
+// summary returns a copy of the summary of d, callers hold devicesMutex
+func (d *DeviceDetail) summary(stale bool) DeviceSummary {
+	summary := d.DeviceSummary
+	summary.Stale = stale
+	summary.Gateways = append([]GatewayState{}, d.Gateways...)
+	summary.UnsupportedMeasurementIDs = append([]string{}, d.UnsupportedMeasurementIDs...)
+	summary.Measurements = make(map[string]float64, len(d.Measurements))
+	for k, v := range d.Measurements {
+		summary.Measurements[k] = v
+	}
+	return summary
+}
+
+// getDevice returns a copy of a device, false if it was never seen
+func (r *deviceRegistry) getDevice(devEui string) (DeviceDetail, bool) {
+	r.devicesMutex.RLock()
+	defer r.devicesMutex.RUnlock()
+	device, found := r.devices[strings.ToLower(devEui)]
+	if !found {
+		return DeviceDetail{}, false
+	}
+	detail := *device
+	detail.DeviceSummary = device.summary(r.isStale(device.DevEui, device.LastSeen))
+	detail.Errors = append([]DeviceError{}, device.Errors...)
+	detail.Dumps = append([]DeviceDump{}, device.Dumps...)
+	return detail, true
+}
+
+// isStale is true if a device has not been seen for DEVICE_STALE_AFTER
+// seconds, or the staleAfter of its devices entry in the config file
+func (r *deviceRegistry) isStale(devEui string, lastSeen time.Time) bool {
+	staleAfter := r.config.DeviceStaleAfter
+	if device := r.config.Devices[strings.ToLower(devEui)]; device != nil && device.StaleAfter != nil {
+		staleAfter = *device.StaleAfter
+	}
+	return staleAfter > 0 && time.Since(lastSeen) > time.Duration(staleAfter)*time.Second
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// devicesHandler serves /api/v1/devices
+func (e *Exporter) devicesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"devices": e.devices.listDevices(), "staleAfter": e.config.DeviceStaleAfter})
+}
+
+// deviceHandler serves /api/v1/devices/{devEui}
+func (e *Exporter) deviceHandler(w http.ResponseWriter, r *http.Request, devEui string) {
+	device, found := e.devices.getDevice(devEui)
+	if !found {
+		http.Error(w, "unknown device "+devEui, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
+
+// deviceDumpHandler serves /api/v1/devices/{devEui}/dumps/{name} as a json
+// envelope, or the file as is with raw=1. Only the dumps recorded for the
+// device can be read.
+func (e *Exporter) deviceDumpHandler(w http.ResponseWriter, r *http.Request, devEui string, name string) {
+	device, found := e.devices.getDevice(devEui)
+	if !found {
+		http.Error(w, "unknown device "+devEui, http.StatusNotFound)
+		return
+	}
+	if len(name) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(device.Dumps)
+		return
+	}
+	for _, dump := range device.Dumps {
+		if dump.Name != name {
+			continue
+		}
+		if len(r.URL.Query().Get("raw")) > 0 {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, dump.Name))
+			http.ServeFile(w, r, dump.path)
+			return
+		}
+		envelope, err := readDump(dump.path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(envelope)
+		return
+	}
+	http.Error(w, "unknown dump "+name, http.StatusNotFound)
+}
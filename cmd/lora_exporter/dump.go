@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Dumps are written to DUMP_FOLDER/{devEui}/{time}-{devEui}-{deduplicationId}.dump,
+// with .gz added when DUMP_COMPRESS is on
+const (
+	dumpSuffix        = ".dump"
+	dumpGzipSuffix    = ".dump.gz"
+	dumpTimeFormat    = "20060102-150405.000000000"
+	dumpUnknownDevice = "unknown"
+	dumpVersion       = 1
+	dumpRedacted      = "REDACTED"
+)
+
+// Why a webhook was dumped
+const (
+	dumpReasonFirstSeen      = "firstSeen"
+	dumpReasonUnsupportedOUI = "unsupportedOUI"
+	dumpReasonParseError     = "parseError"
+	dumpReasonDebug          = "debug"
+	dumpReasonManual         = "manual"
+)
+
+// dumper writes webhooks to DUMP_FOLDER and prunes them
+type dumper struct {
+	folder        string
+	compress      bool
+	retentionDays int
+	maxSizeMB     int
+	maxPerDevice  int
+	metrics       *dumpMetrics
+}
+
+func newDumper(config EnvConfig, reg prometheus.Registerer) *dumper {
+	return &dumper{
+		folder:        config.DumpFolder,
+		compress:      config.DumpCompress,
+		retentionDays: config.DumpRetentionDays,
+		maxSizeMB:     config.DumpMaxSizeMB,
+		maxPerDevice:  config.DumpMaxPerDevice,
+		metrics:       newDumpMetrics(reg),
+	}
+}
+
+// DumpEnvelope is a dumped webhook with where it came from and why it was
+// dumped. Body is the webhook if it is json, RawBody (base64) if it is not.
+type DumpEnvelope struct {
+	DumpVersion  int                 `json:"dumpVersion"`
+	ReceivedTime time.Time           `json:"receivedTime"`
+	IP           string              `json:"ip,omitempty"`
+	UserAgent    string              `json:"userAgent,omitempty"`
+	Headers      map[string][]string `json:"headers,omitempty"`
+	Event        string              `json:"event,omitempty"`
+	Reasons      []string            `json:"reasons"`
+	ParseError   string              `json:"parseError,omitempty"`
+	Body         json.RawMessage     `json:"body,omitempty"`
+	RawBody      []byte              `json:"rawBody,omitempty"`
+}
+
+// newDumpEnvelope wraps a webhook body with the request metadata, secrets in
+// the headers are redacted
+func newDumpEnvelope(r *http.Request, received time.Time, event string, body []byte, reasons []string, parseErr error) DumpEnvelope {
+	e := DumpEnvelope{
+		DumpVersion:  dumpVersion,
+		ReceivedTime: received.UTC(),
+		IP:           ReadUserIP(r),
+		UserAgent:    r.Header.Get("User-Agent"),
+		Headers:      map[string][]string{},
+		Event:        event,
+		Reasons:      reasons,
+	}
+	for name, values := range r.Header {
+		if isSecretHeader(name) {
+			e.Headers[name] = []string{dumpRedacted}
+		} else {
+			e.Headers[name] = values
+		}
+	}
+	if parseErr != nil {
+		e.ParseError = parseErr.Error()
+	}
+	e.setBody(body)
+	return e
+}
+
+func (e *DumpEnvelope) setBody(body []byte) {
+	if json.Valid(body) {
+		e.Body = append(json.RawMessage{}, body...)
+	} else {
+		e.RawBody = body
+	}
+}
+
+// Payload returns the webhook body as it was received
+func (e *DumpEnvelope) Payload() []byte {
+	if len(e.Body) > 0 {
+		return e.Body
+	}
+	return e.RawBody
+}
+
+func isSecretHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, secret := range []string{"auth", "cookie", "token", "secret", "password", "key"} {
+		if strings.Contains(name, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// readDump reads a dump file, gzipped or not. Dumps from before envelopes
+// are the raw body, they are returned in an envelope without metadata.
+func readDump(filename string) (*DumpEnvelope, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var reader io.Reader = bufio.NewReader(f)
+	if magic, err := reader.(*bufio.Reader).Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		reader = zr
+	}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	e := &DumpEnvelope{}
+	if err := json.Unmarshal(data, e); err != nil || e.DumpVersion == 0 {
+		e = &DumpEnvelope{Reasons: []string{}}
+		if info, err := f.Stat(); err == nil {
+			e.ReceivedTime = info.ModTime().UTC()
+		}
+		e.setBody(data)
+	}
+	return e, nil
+}
+
+// dumpFile writes a webhook to DUMP_FOLDER and returns the file name, an
+// empty string if there is no DUMP_FOLDER or the write failed
+func (d *dumper) dumpFile(envelope DumpEnvelope) string {
+	if len(d.folder) == 0 {
+		log.Debug().Msg("No DUMP_FOLDER defined, not dumping")
+		return ""
+	}
+	s, err := json.Marshal(envelope)
+	if err != nil {
+		d.metrics.errorTotal.Inc()
+		log.Error().Caller().Err(err).Msg("Failed to marshal dump")
+		return ""
+	}
+	devEui, deduplicationID := dumpIdentity(envelope.Body)
+	dir := filepath.Join(d.folder, devEui)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		d.metrics.errorTotal.Inc()
+		log.Error().Caller().Err(err).Str("folder", dir).Msg("Failed to create dump folder")
+		return ""
+	}
+	name := time.Now().UTC().Format(dumpTimeFormat) + "-" + devEui
+	if len(deduplicationID) > 0 {
+		name += "-" + deduplicationID
+	}
+	suffix := dumpSuffix
+	if d.compress {
+		suffix = dumpGzipSuffix
+	}
+	// The time has nanoseconds, the counter is only for clocks that don't
+	f, filename, err := createUnique(filepath.Join(dir, name), suffix)
+	if err != nil {
+		d.metrics.errorTotal.Inc()
+		log.Error().Caller().Err(err).Str("filename", filename).Msg("Failed to open file to write")
+		return ""
+	}
+	if d.compress {
+		zw := gzip.NewWriter(f)
+		_, err = zw.Write(s)
+		if err2 := zw.Close(); err == nil {
+			err = err2
+		}
+	} else {
+		_, err = f.Write(s)
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		d.metrics.errorTotal.Inc()
+		log.Error().Caller().Err(err).Str("filename", filename).Msg("Failed to write dump file")
+		os.Remove(filename)
+		return ""
+	}
+	d.metrics.writtenTotal.Inc()
+	if info, err := os.Stat(filename); err == nil {
+		d.metrics.bytes.Add(float64(info.Size()))
+		d.metrics.files.Inc()
+	}
+	log.Debug().Str("filename", filename).Msgf("Wrote %0d bytes to file", len(s))
+	return filename
+}
+
+// createUnique creates base+suffix, or base-1+suffix etc if it exists
+func createUnique(base string, suffix string) (*os.File, string, error) {
+	filename := base + suffix
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil || !errors.Is(err, fs.ErrExist) || i > 100 {
+			return f, filename, err
+		}
+		filename = fmt.Sprintf("%s-%d%s", base, i, suffix)
+	}
+}
+
+// dumpIdentity returns the devEui and deduplicationId of a webhook body, safe
+// to use in file names. Bodies that are not json are dumped as unknown.
+func dumpIdentity(body []byte) (string, string) {
+	var doc struct {
+		DeduplicationID string `json:"deduplicationId"`
+		DeviceInfo      struct {
+			DevEui string `json:"devEui"`
+		} `json:"deviceInfo"`
+	}
+	json.Unmarshal(body, &doc)
+	devEui := safeFileName(strings.ToLower(doc.DeviceInfo.DevEui))
+	if len(devEui) == 0 {
+		devEui = dumpUnknownDevice
+	}
+	return devEui, safeFileName(doc.DeduplicationID)
+}
+
+func safeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+type dumpEntry struct {
+	path    string
+	device  string
+	size    int64
+	modTime time.Time
+}
+
+// pruneDumps removes the dumps older than DUMP_RETENTION_DAYS, the oldest of
+// devices with more than DUMP_MAX_PER_DEVICE and then the oldest until the
+// folder is under DUMP_MAX_SIZE_MB. It also refreshes the dump gauges.
+func (d *dumper) pruneDumps() {
+	var entries []dumpEntry
+	err := filepath.WalkDir(d.folder, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if path == d.folder && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll // Nothing dumped yet
+			}
+			return err
+		}
+		if de.IsDir() || !(strings.HasSuffix(path, dumpSuffix) || strings.HasSuffix(path, dumpGzipSuffix)) {
+			return nil
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil // Removed while we walk
+		}
+		entries = append(entries, dumpEntry{path: path, device: filepath.Dir(path), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		d.metrics.errorTotal.Inc()
+		log.Error().Err(err).Str("folder", d.folder).Msg("Failed to list dumps")
+		return
+	}
+	// Newest first, so whatever is past a limit is the oldest
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.After(entries[j].modTime) })
+	cutoff := time.Now().AddDate(0, 0, -d.retentionDays)
+	perDevice := map[string]int{}
+	var total int64
+	kept, pruned := 0, 0
+	for _, entry := range entries {
+		perDevice[entry.device]++
+		remove := (d.retentionDays > 0 && entry.modTime.Before(cutoff)) ||
+			(d.maxPerDevice > 0 && perDevice[entry.device] > d.maxPerDevice) ||
+			(d.maxSizeMB > 0 && total+entry.size > int64(d.maxSizeMB)*1024*1024)
+		if remove {
+			if err := os.Remove(entry.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				d.metrics.errorTotal.Inc()
+				log.Error().Err(err).Str("filename", entry.path).Msg("Failed to remove dump")
+			} else {
+				pruned++
+				continue
+			}
+		}
+		total += entry.size
+		kept++
+	}
+	d.metrics.prunedTotal.Add(float64(pruned))
+	d.metrics.bytes.Set(float64(total))
+	d.metrics.files.Set(float64(kept))
+	log.Debug().Int("pruned", pruned).Int("files", kept).Int64("bytes", total).Msg("Pruned dumps")
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPruneDumps(t *testing.T) {
+	// The dumps of two devices, a day apart with the newest first
+	type dump struct {
+		device string
+		days   int
+		size   int
+	}
+	dumps := []dump{
+		{"a84041fbd1889410", 0, 1024 * 1024},
+		{"24e124126d392076", 1, 1024 * 1024},
+		{"a84041fbd1889410", 2, 1024 * 1024},
+		{"a84041fbd1889410", 3, 1024 * 1024},
+	}
+	tests := []struct {
+		name          string
+		retentionDays int
+		maxPerDevice  int
+		maxSizeMB     int
+		want          []int // indexes of the dumps kept
+	}{
+		{"no limits", 0, 0, 0, []int{0, 1, 2, 3}},
+		{"retention", 2, 0, 0, []int{0, 1}},
+		{"per device", 0, 2, 0, []int{0, 1, 2}},
+		{"size", 0, 0, 3, []int{0, 1, 2}},
+		{"all limits", 3, 1, 3, []int{0, 1}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			folder := t.TempDir()
+			var paths []string
+			for i, dump := range dumps {
+				path := filepath.Join(folder, dump.device, string(rune('a'+i))+dumpSuffix)
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, make([]byte, dump.size), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				modTime := time.Now().Add(-time.Duration(dump.days)*24*time.Hour - time.Hour)
+				if err := os.Chtimes(path, modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+				paths = append(paths, path)
+			}
+			c := config
+			c.DumpFolder = folder
+			c.DumpRetentionDays = test.retentionDays
+			c.DumpMaxPerDevice = test.maxPerDevice
+			c.DumpMaxSizeMB = test.maxSizeMB
+			d := newDumper(c, prometheus.NewRegistry())
+			d.pruneDumps()
+
+			var kept []int
+			for i, path := range paths {
+				if _, err := os.Stat(path); err == nil {
+					kept = append(kept, i)
+				}
+			}
+			if !reflect.DeepEqual(kept, test.want) {
+				t.Errorf("kept dumps %v, want %v", kept, test.want)
+			}
+			if got := testutil.ToFloat64(d.metrics.files); got != float64(len(test.want)) {
+				t.Errorf("got %v files, want %d", got, len(test.want))
+			}
+			if got := testutil.ToFloat64(d.metrics.prunedTotal); got != float64(len(dumps)-len(test.want)) {
+				t.Errorf("got %v pruned, want %d", got, len(dumps)-len(test.want))
+			}
+			if got := testutil.ToFloat64(d.metrics.errorTotal); got != 0 {
+				t.Errorf("got %v errors, want 0", got)
+			}
+		})
+	}
+}
+
+// TestPruneDumpsNoFolder checks a DUMP_FOLDER that nothing was dumped to yet
+// is not an error
+func TestPruneDumpsNoFolder(t *testing.T) {
+	c := config
+	c.DumpFolder = filepath.Join(t.TempDir(), "dumps")
+	c.DumpRetentionDays = 1
+	d := newDumper(c, prometheus.NewRegistry())
+	d.pruneDumps()
+	if got := testutil.ToFloat64(d.metrics.errorTotal); got != 0 {
+		t.Errorf("got %v errors, want 0", got)
+	}
+	if got := testutil.ToFloat64(d.metrics.files); got != 0 {
+		t.Errorf("got %v files, want 0", got)
+	}
+}
+
+func TestIsSecretHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"Authorization", true},
+		{"X-Api-Key", true},
+		{"Cookie", true},
+		{"Set-Cookie", true},
+		{"X-Auth-Token", true},
+		{"X-Webhook-Secret", true},
+		{"Proxy-Authorization", true},
+		{"Content-Type", false},
+		{"User-Agent", false},
+		{"X-Forwarded-For", false},
+	}
+	for _, test := range tests {
+		if got := isSecretHeader(test.name); got != test.want {
+			t.Errorf("isSecretHeader(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestNewDumpEnvelope(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/?event=up", nil)
+	r.RemoteAddr = "192.0.2.10:41234"
+	r.Header.Set("Authorization", "Bearer s3cret")
+	r.Header.Set("X-Api-Key", "k3y")
+	r.Header.Set("Cookie", "session=abc")
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("User-Agent", "chirpstack")
+	received := time.Date(2023, 8, 23, 12, 0, 0, 0, time.FixedZone("SGT", 8*3600))
+
+	e := newDumpEnvelope(r, received, "up", []byte(`{"fCnt":1}`), []string{dumpReasonFirstSeen}, nil)
+	want := map[string][]string{
+		"Authorization": {dumpRedacted},
+		"X-Api-Key":     {dumpRedacted},
+		"Cookie":        {dumpRedacted},
+		"Content-Type":  {"application/json"},
+		"User-Agent":    {"chirpstack"},
+	}
+	if !reflect.DeepEqual(e.Headers, want) {
+		t.Errorf("got headers %v, want %v", e.Headers, want)
+	}
+	if e.IP != "192.0.2.10" || e.UserAgent != "chirpstack" || e.Event != "up" || e.DumpVersion != dumpVersion {
+		t.Errorf("got envelope %+v", e)
+	}
+	if !e.ReceivedTime.Equal(received) || e.ReceivedTime.Location() != time.UTC {
+		t.Errorf("got received time %v, want %v in UTC", e.ReceivedTime, received)
+	}
+	if string(e.Body) != `{"fCnt":1}` || e.RawBody != nil {
+		t.Errorf("got body %s and raw body %q", e.Body, e.RawBody)
+	}
+
+	e = newDumpEnvelope(r, received, "up", []byte("not json"), []string{dumpReasonParseError}, errors.New("invalid character"))
+	if e.Body != nil || string(e.RawBody) != "not json" || e.ParseError != "invalid character" {
+		t.Errorf("got body %s, raw body %q and parse error %q", e.Body, e.RawBody, e.ParseError)
+	}
+}
+
+func TestReadDump(t *testing.T) {
+	folder := t.TempDir()
+	received := time.Date(2023, 8, 23, 12, 0, 0, 0, time.UTC)
+	envelope := DumpEnvelope{
+		DumpVersion:  dumpVersion,
+		ReceivedTime: received,
+		Event:        "up",
+		Reasons:      []string{dumpReasonFirstSeen},
+		Body:         json.RawMessage(`{"deviceInfo":{"devEui":"a84041fbd1889410"},"fCnt":1}`),
+	}
+	write := func(t *testing.T, compress bool, data []byte) string {
+		filename := filepath.Join(t.TempDir(), "dump")
+		var buf bytes.Buffer
+		if compress {
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data)
+			zw.Close()
+			data = buf.Bytes()
+		}
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, received, received); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	data, err := json.Marshal(envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A legacy dump has no metadata, the file time is used
+	legacy := DumpEnvelope{ReceivedTime: received, Reasons: []string{}, Body: envelope.Body}
+
+	tests := []struct {
+		name     string
+		compress bool
+		data     []byte
+		want     DumpEnvelope
+	}{
+		{"envelope", false, data, envelope},
+		{"gzipped envelope", true, data, envelope},
+		{"legacy raw json", false, envelope.Body, legacy},
+		{"gzipped legacy raw json", true, envelope.Body, legacy},
+		{"legacy raw bytes", false, []byte("not json"), DumpEnvelope{ReceivedTime: received, Reasons: []string{}, RawBody: []byte("not json")}},
+		{"json without dump version", false, []byte(`{"reasons":["debug"]}`), DumpEnvelope{ReceivedTime: received, Reasons: []string{}, Body: json.RawMessage(`{"reasons":["debug"]}`)}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			got, err := readDump(write(t, test.compress, test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*got, test.want) {
+				t.Errorf("got %+v, want %+v", *got, test.want)
+			}
+		})
+	}
+
+	// What dumpFile writes reads back the same
+	for _, compress := range []bool{false, true} {
+		c := config
+		c.DumpFolder = folder
+		c.DumpCompress = compress
+		filename := newDumper(c, prometheus.NewRegistry()).dumpFile(envelope)
+		if len(filename) == 0 {
+			t.Fatalf("got no dump file with compress %v", compress)
+		}
+		if strings.HasSuffix(filename, dumpGzipSuffix) != compress {
+			t.Errorf("got dump file %s with compress %v", filename, compress)
+		}
+		got, err := readDump(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(*got, envelope) {
+			t.Errorf("got %+v back with compress %v, want %+v", *got, compress, envelope)
+		}
+	}
+
+	if _, err := readDump(filepath.Join(folder, "missing.dump")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v for a missing dump", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+// Exporter turns chirpstack webhooks into metrics. It owns the registry the
+// webhook and device metrics are in, the known devices, the dumps and the
+// forwarders, so several can live in one process (or test) side by side.
+// reloadMutex is held for reading while a request uses any of it, and for
+// writing by Reload.
+type Exporter struct {
+	reloadMutex       sync.RWMutex
+	config            EnvConfig
+	registry          *prometheus.Registry
+	metrics           *exporterMetrics
+	deviceMetrics     *deviceMetrics
+	deviceCollector   *deviceCollector
+	devices           *deviceRegistry
+	geo               *geoTracker
+	dumper            *dumper
+	forwarder         *forwarder
+	tenantTokens      map[string]string
+	applicationTokens map[string]string
+
+	// The outputs, only started if they are configured
+	mqtt        *mqttPublisher
+	influx      *influxWriter
+	remoteWrite *remoteWriter
+	otlp        *otlpExporter
+	history     *historyStore
+	stream      *streamHub
+}
+
+// NewExporter registers the metrics of an exporter in registry, nothing is
+// started or written until Start
+func NewExporter(config EnvConfig, registry *prometheus.Registry) (*Exporter, error) {
+	e := &Exporter{
+		config:        config,
+		registry:      registry,
+		metrics:       newExporterMetrics(registry),
+		deviceMetrics: newDeviceMetrics(config),
+		dumper:        newDumper(config, registry),
+		mqtt:          newMqttPublisher(config, registry),
+		influx:        newInfluxWriter(config, registry),
+		remoteWrite:   newRemoteWriter(config, registry),
+		otlp:          newOtlpExporter(config, registry),
+		history:       newHistoryStore(config, registry),
+		stream:        newStreamHub(config, registry),
+	}
+	e.deviceCollector = &deviceCollector{metrics: e.deviceMetrics}
+	if err := registry.Register(e.deviceCollector); err != nil {
+		return nil, err
+	}
+	e.devices = newDeviceRegistry(config, e.deviceMetrics)
+	var err error
+	if e.geo, err = newGeoTracker(config, e.deviceMetrics); err != nil {
+		return nil, err
+	}
+	if e.forwarder, err = newForwarder(config, newForwardMetrics(registry)); err != nil {
+		return nil, err
+	}
+	if e.tenantTokens, err = parseScopeTokens(config.TenantTokens); err != nil {
+		return nil, fmt.Errorf("failed to parse TENANT_TOKENS: %w", err)
+	}
+	if e.applicationTokens, err = parseScopeTokens(config.ApplicationTokens); err != nil {
+		return nil, fmt.Errorf("failed to parse APPLICATION_TOKENS: %w", err)
+	}
+	return e, nil
+}
+
+// Start starts forwarding webhooks and the configured outputs
+func (e *Exporter) Start() error {
+	if len(e.config.DumpFolder) > 0 {
+		log.Info().Str("folder", e.config.DumpFolder).Bool("compress", e.config.DumpCompress).Int("retentionDays", e.config.DumpRetentionDays).Int("maxSizeMB", e.config.DumpMaxSizeMB).Int("maxPerDevice", e.config.DumpMaxPerDevice).Msg("Will dump webhooks")
+	}
+	// First, so the forwarders get the tracer
+	if len(e.config.OtlpEndpoint) > 0 {
+		if err := e.otlp.start(e.registry, e.devices); err != nil {
+			return fmt.Errorf("failed to start otlp export: %w", err)
+		}
+	}
+	e.forwarder.tracer = e.otlp.tracer
+	if err := e.forwarder.start(); err != nil {
+		return err
+	}
+	if len(e.config.MqttBroker) > 0 {
+		e.mqtt.start()
+	}
+	if len(e.config.InfluxURL) > 0 {
+		e.influx.start()
+	}
+	if len(e.config.RemoteWriteURL) > 0 {
+		e.remoteWrite.start()
+	}
+	if len(e.config.HistoryFile) > 0 {
+		if err := e.history.start(); err != nil {
+			return fmt.Errorf("failed to open history store: %w", err)
+		}
+	}
+	return nil
+}
+
+// publishUplink hands the decoded measurements to the started outputs
+func (e *Exporter) publishUplink(uplink *Uplink) {
+	if e.mqtt.queue != nil {
+		e.mqtt.enqueue(uplink)
+	}
+	if e.influx.queue != nil {
+		e.influx.enqueue(uplink)
+	}
+	if e.remoteWrite.queue != nil {
+		e.remoteWrite.enqueue(uplink)
+	}
+	if e.history.queue != nil {
+		e.history.enqueue(uplink)
+	}
+}
+
+// Registry is where the webhook and device metrics of the exporter are
+func (e *Exporter) Registry() *prometheus.Registry {
+	return e.registry
+}
+
+// Handler serves the webhooks, metrics, api and ui. /metrics has the process
+// wide metrics of the default registry too.
+func (e *Exporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.Gatherers{e.registry, prometheus.DefaultGatherer}, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/metrics/tenant/", e.scopedMetricsHandler(scopeTenant))
+	mux.HandleFunc("/metrics/application/", e.scopedMetricsHandler(scopeApplication))
+	mux.HandleFunc("/", e.webhookHandler)
+	mux.HandleFunc("/hook", e.webhookHandler)
+	mux.HandleFunc("/dump", e.dumpHandler)
+	mux.Handle("/ui/", e.requireAuthKey(uiHandler()))
+	mux.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	mux.Handle("/api/v1/stream", e.requireAuthKey(http.HandlerFunc(e.stream.handler)))
+	mux.Handle("/api/v1/devices", e.requireAuthKey(http.HandlerFunc(e.apiDevicesHandler)))
+	mux.Handle("/api/v1/devices/", e.requireAuthKey(http.HandlerFunc(e.apiDevicesHandler)))
+	return mux
+}
+
+// Reload applies the reloadable settings of config and returns the changed
+// settings that need a restart. Nothing changes if it fails.
+func (e *Exporter) Reload(config EnvConfig) ([]string, error) {
+	tenantTokens, err := parseScopeTokens(config.TenantTokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TENANT_TOKENS: %w", err)
+	}
+	applicationTokens, err := parseScopeTokens(config.ApplicationTokens)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse APPLICATION_TOKENS: %w", err)
+	}
+	rules, err := forwardRules(config)
+	if err != nil {
+		return nil, err
+	}
+	locations, err := fixedLocations(config)
+	if err != nil {
+		return nil, err
+	}
+	var geofences []Geofence
+	if len(config.GeofenceFile) > 0 {
+		if geofences, err = loadGeofences(config.GeofenceFile); err != nil {
+			return nil, fmt.Errorf("failed to load geofences: %w", err)
+		}
+	}
+
+	e.reloadMutex.Lock()
+	defer e.reloadMutex.Unlock()
+	if err := e.forwarder.update(rules); err != nil {
+		return nil, err
+	}
+	restart := restartRequired(e.config, config)
+	relabel := config.MetricsApplicationLabels != e.config.MetricsApplicationLabels ||
+		config.MetricsDeviceTags != e.config.MetricsDeviceTags ||
+		config.MetricsDeviceVariables != e.config.MetricsDeviceVariables
+	e.config = e.config.withReloadable(config)
+	e.tenantTokens, e.applicationTokens = tenantTokens, applicationTokens
+	e.geo.setFixedLocations(locations)
+	e.geo.setGeofences(geofences)
+	e.devices.config = e.config
+	e.dumper.compress = e.config.DumpCompress
+	e.dumper.retentionDays = e.config.DumpRetentionDays
+	e.dumper.maxSizeMB = e.config.DumpMaxSizeMB
+	e.dumper.maxPerDevice = e.config.DumpMaxPerDevice
+	if relabel {
+		// The label names of a vec can't change, so replace all of them
+		e.deviceMetrics = newDeviceMetrics(e.config)
+		e.deviceCollector.setMetrics(e.deviceMetrics)
+		e.devices.relabel(e.deviceMetrics)
+		e.geo.relabel(e.deviceMetrics)
+		log.Info().Msg("Changed the labels of the device metrics")
+	}
+	return restart, nil
+}
+
+// scopeToken returns the token of a tenant or application id
+func (e *Exporter) scopeToken(scope string, id string) (string, bool) {
+	e.reloadMutex.RLock()
+	defer e.reloadMutex.RUnlock()
+	tokens := e.tenantTokens
+	if scope == scopeApplication {
+		tokens = e.applicationTokens
+	}
+	token, found := tokens[id]
+	return token, found
+}
+
+// watchedFiles returns the files a reload reads besides the env vars
+func (e *Exporter) watchedFiles() []string {
+	e.reloadMutex.RLock()
+	defer e.reloadMutex.RUnlock()
+	var files []string
+	for _, file := range []string{e.config.ConfigFile, e.config.ForwardRulesFile, e.config.GeofenceFile} {
+		if len(file) > 0 {
+			files = append(files, file)
+		}
+	}
+	return append(files, e.forwarder.templateFiles()...)
+}
+
+// pruneDumps prunes DUMP_FOLDER with the current limits
+func (e *Exporter) pruneDumps() {
+	e.reloadMutex.RLock()
+	defer e.reloadMutex.RUnlock()
+	e.dumper.pruneDumps()
+}
+
+// forwardGeofenceEvents sends the geofence enter and exit events to the
+// forwarders when GEOFENCE_FORWARD is on
+func (e *Exporter) forwardGeofenceEvents(devEui string, events []GeofenceEvent) {
+	if !e.config.GeofenceForward || len(events) == 0 {
+		return
+	}
+	info, _ := e.devices.deviceInfo(devEui)
+	for _, event := range events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			log.Error().Caller().Err(err).Msg("Failed to marshal geofence event")
+			continue
+		}
+		e.forwarder.enqueueForward(ForwardEvent{Event: event.Event, Body: body, Device: info})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gatherDeviceSeries returns the label sets of the per device series in the
+// registry of e, by metric name
+func gatherDeviceSeries(t *testing.T, e *Exporter) map[string][]map[string]string {
+	t.Helper()
+	mfs, err := e.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	series := map[string][]map[string]string{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			labels := labelMap(m)
+			if _, found := labels["deviceEui"]; found {
+				series[mf.GetName()] = append(series[mf.GetName()], labels)
+			}
+		}
+	}
+	return series
+}
+
+func labelMap(m *dto.Metric) map[string]string {
+	labels := map[string]string{}
+	for _, label := range m.GetLabel() {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
+
+// TestReloadRelabel checks changing METRICS_DEVICE_TAGS removes the series
+// with the old labels and sets lora_device_info again
+func TestReloadRelabel(t *testing.T) {
+	c := config
+	c.MetricsDeviceTags = "site"
+	e, err := NewExporter(c, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func() {
+		body := `{"deviceInfo":{"tenantId":"t1","deviceName":"lht52","devEui":"a84041fbd1889410","tags":{"site":"lab","room":"12"}},"fCnt":1,"object":{"TempC_SHT":28.41}}`
+		w := httptest.NewRecorder()
+		e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?event=up", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("webhook got %d: %s", w.Code, w.Body)
+		}
+	}
+	post()
+	series := gatherDeviceSeries(t, e)
+	if got := series["lora_devices_metric"]; len(got) != 1 || got[0]["tag_site"] != "lab" {
+		t.Fatalf("got lora_devices_metric %v before the reload, want tag_site", got)
+	}
+
+	next := c
+	next.MetricsDeviceTags = "room"
+	restart, err := e.Reload(next)
+	if err != nil || len(restart) > 0 {
+		t.Fatalf("got restart %v and error %v", restart, err)
+	}
+	series = gatherDeviceSeries(t, e)
+	for name, sets := range series {
+		if name != "lora_device_info" {
+			t.Errorf("got %s %v after the reload, want it gone until the next uplink", name, sets)
+		}
+	}
+	if got := series["lora_device_info"]; len(got) != 1 || got[0]["deviceName"] != "lht52" || got[0]["tenantId"] != "t1" {
+		t.Errorf("got lora_device_info %v after the reload, want it set again", got)
+	}
+	e.devices.labelsMutex.RLock()
+	labels := e.devices.labelsMap["a84041fbd1889410"]
+	e.devices.labelsMutex.RUnlock()
+	if labels["tag_room"] != "12" {
+		t.Errorf("got device labels %v, want tag_room", labels)
+	}
+
+	post()
+	series = gatherDeviceSeries(t, e)
+	got := series["lora_devices_metric"]
+	if len(got) != 1 || got[0]["tag_room"] != "12" {
+		t.Errorf("got lora_devices_metric %v after the next uplink, want tag_room", got)
+	}
+	for _, labels := range got {
+		if _, found := labels["tag_site"]; found {
+			t.Errorf("got the old label in %v", labels)
+		}
+	}
+}
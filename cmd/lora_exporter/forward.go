@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// forwardItem is one webhook body waiting to be forwarded to a destination.
+// file is set when the item is also in the spool folder.
+type forwardItem struct {
+	body     []byte
+	enqueued time.Time
+	file     string
+	trace    traceContext // not kept in the spool
+}
+
+// forwarder sends webhooks to the FORWARD urls and the destinations of the
+// forward rules
+type forwarder struct {
+	destinations []*forwardDestination
+	draining     []*forwardDestination // removed, their worker may still run
+	client       *http.Client
+	spoolFolder  string
+	deadLetter   string
+	maxRetries   int
+	retryInitial time.Duration
+	retryMax     time.Duration
+	queueSize    int
+	metrics      *forwardMetrics
+	tracer       *tracer
+	seq          uint64
+}
+
+// forwardDestination has its own queue and worker, so a slow or failing url
+// does not hold up the others
+type forwardDestination struct {
+	f          *forwarder
+	url        string
+	rule       *ForwardRule
+	queue      chan forwardItem
+	spool      string
+	deadLetter string
+	label      prometheus.Labels
+
+	mutex    sync.Mutex
+	spooled  map[string]bool // spool files already queued or in flight
+	overflow bool            // spool files that did not fit in the queue
+	removed  bool            // no longer configured, stop once drained
+	stopped  bool            // the worker is gone
+	pending  int64
+}
+
+// errPermanent is returned for errors where a retry will not help
+type errPermanent struct {
+	err error
+}
+
+func (e errPermanent) Error() string {
+	return e.err.Error()
+}
+
+// newForwarder reads the destinations from FORWARD, FORWARD_RULES_FILE and the
+// config file, nothing is sent until start
+func newForwarder(config EnvConfig, metrics *forwardMetrics) (*forwarder, error) {
+	f := &forwarder{
+		client:       &http.Client{Timeout: time.Duration(config.ForwardTimeout) * time.Second},
+		spoolFolder:  config.ForwardSpoolFolder,
+		deadLetter:   config.ForwardDeadLetterFolder,
+		maxRetries:   config.ForwardMaxRetries,
+		retryInitial: time.Duration(config.ForwardRetryInitial) * time.Second,
+		retryMax:     time.Duration(config.ForwardRetryMax) * time.Second,
+		queueSize:    config.ForwardQueueSize,
+		metrics:      metrics,
+	}
+	rules, err := forwardRules(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		f.destinations = append(f.destinations, f.newDestination(rule))
+	}
+	return f, nil
+}
+
+// forwardRules returns the rules of FORWARD, FORWARD_RULES_FILE and the
+// config file, each url can only be in one
+func forwardRules(config EnvConfig) ([]*ForwardRule, error) {
+	rules := []*ForwardRule{}
+	for _, url := range splitList(config.Forward) {
+		rules = append(rules, &ForwardRule{URL: url})
+	}
+	if len(config.ForwardRulesFile) > 0 {
+		fileRules, err := loadForwardRules(config.ForwardRulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load forward rules: %w", err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	rules = append(rules, config.ForwardRules...)
+	urls := map[string]bool{}
+	for _, rule := range rules {
+		if urls[rule.URL] {
+			return nil, fmt.Errorf("forward url %s is defined more than once", rule.URL)
+		}
+		urls[rule.URL] = true
+	}
+	return rules, nil
+}
+
+func (f *forwarder) newDestination(rule *ForwardRule) *forwardDestination {
+	return &forwardDestination{
+		f:       f,
+		url:     rule.URL,
+		rule:    rule,
+		queue:   make(chan forwardItem, f.queueSize),
+		label:   prometheus.Labels{"url": rule.URL},
+		spooled: map[string]bool{},
+	}
+}
+
+// start creates the spool and dead letter folders and starts a worker for
+// every destination
+func (f *forwarder) start() error {
+	for _, d := range f.destinations {
+		if err := d.prepare(); err != nil {
+			return err
+		}
+	}
+	for _, d := range f.destinations {
+		go d.worker()
+		log.Info().Msgf("Will forward webhooks to %s", d.url)
+	}
+	return nil
+}
+
+// prepare creates the spool and dead letter folders of the destination and
+// picks up what a previous run left in the spool
+func (d *forwardDestination) prepare() error {
+	if len(d.f.spoolFolder) > 0 {
+		d.spool = filepath.Join(d.f.spoolFolder, destinationDirName(d.url))
+		if err := os.MkdirAll(d.spool, 0o755); err != nil {
+			return fmt.Errorf("failed to create forward spool folder: %w", err)
+		}
+		// Anything left from a previous run gets picked up by the worker
+		d.overflow = true
+		if files, _ := d.spoolFiles(); len(files) > 0 {
+			d.pending = int64(len(files))
+			log.Info().Str("url", d.url).Int("files", len(files)).Msg("Found spooled webhooks to forward")
+		}
+	}
+	if len(d.f.deadLetter) > 0 {
+		d.deadLetter = filepath.Join(d.f.deadLetter, destinationDirName(d.url))
+		if err := os.MkdirAll(d.deadLetter, 0o755); err != nil {
+			return fmt.Errorf("failed to create forward dead letter folder: %w", err)
+		}
+	}
+	d.f.metrics.queueDepth.With(d.label).Set(float64(d.pending))
+	return nil
+}
+
+// update switches to the destinations of rules. A url that stays keeps its
+// queue and gets the new rule, a removed one stops once its queue and spool
+// are forwarded. A url that is added back while it is still draining gets its
+// old destination back, so there is only ever one worker per spool folder.
+// The caller makes sure nothing is enqueued meanwhile.
+func (f *forwarder) update(rules []*ForwardRule) error {
+	current := map[string]*forwardDestination{}
+	for _, d := range f.destinations {
+		current[d.url] = d
+	}
+	draining := map[string]*forwardDestination{}
+	for _, d := range f.draining {
+		draining[d.url] = d
+	}
+	var destinations, added, revived []*forwardDestination
+	for _, rule := range rules {
+		if d, found := current[rule.URL]; found {
+			destinations = append(destinations, d)
+			continue
+		}
+		if d, found := draining[rule.URL]; found && d.revive() {
+			destinations = append(destinations, d)
+			revived = append(revived, d)
+			continue
+		}
+		d := f.newDestination(rule)
+		if err := d.prepare(); err != nil {
+			for _, d := range revived {
+				d.remove()
+			}
+			return err
+		}
+		destinations = append(destinations, d)
+		added = append(added, d)
+	}
+	// Nothing can fail from here on
+	for i, d := range destinations {
+		d.setRule(rules[i])
+		delete(current, d.url)
+		delete(draining, d.url)
+	}
+	for _, d := range revived {
+		log.Info().Msgf("Will forward webhooks to %s again", d.url)
+	}
+	f.draining = f.draining[:0]
+	for _, d := range draining {
+		if !d.isStopped() {
+			f.draining = append(f.draining, d)
+		}
+	}
+	for _, d := range current {
+		d.remove()
+		f.draining = append(f.draining, d)
+		log.Info().Msgf("Will stop forwarding webhooks to %s", d.url)
+	}
+	for _, d := range added {
+		go d.worker()
+		log.Info().Msgf("Will forward webhooks to %s", d.url)
+	}
+	f.destinations = destinations
+	return nil
+}
+
+// remove lets the worker stop once the queue and spool are forwarded
+func (d *forwardDestination) remove() {
+	d.mutex.Lock()
+	d.removed = true
+	d.mutex.Unlock()
+}
+
+// revive keeps a removed destination going, it returns false if the worker
+// already stopped
+func (d *forwardDestination) revive() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.removed = false
+	return true
+}
+
+func (d *forwardDestination) setRule(rule *ForwardRule) {
+	d.mutex.Lock()
+	d.rule = rule
+	d.mutex.Unlock()
+}
+
+// templateFiles returns the template files of the forward rules
+func (f *forwarder) templateFiles() []string {
+	var files []string
+	for _, d := range f.destinations {
+		d.mutex.Lock()
+		if len(d.rule.TemplateFile) > 0 {
+			files = append(files, d.rule.TemplateFile)
+		}
+		d.mutex.Unlock()
+	}
+	return files
+}
+
+// enqueueForward queues the event for every destination whose rule matches,
+// it never blocks
+func (f *forwarder) enqueueForward(ev ForwardEvent) {
+	for _, d := range f.destinations {
+		if !d.rule.matches(ev) {
+			f.metrics.filteredTotal.With(d.label).Inc()
+			continue
+		}
+		body, err := d.rule.render(ev)
+		if err != nil {
+			f.metrics.errorTotal.With(d.label).Inc()
+			log.Error().Err(err).Str("url", d.url).Str("devEui", ev.Device.DevEui).Msg("Failed to render forward template")
+			continue
+		}
+		d.enqueue(body, ev.Trace)
+	}
+}
+
+func (d *forwardDestination) enqueue(body []byte, trace traceContext) {
+	item := forwardItem{body: body, enqueued: time.Now(), trace: trace}
+	if len(d.spool) > 0 {
+		item.file = d.spoolItem(item)
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	select {
+	case d.queue <- item:
+	default:
+		if len(item.file) > 0 {
+			// Its on disk, the worker reads it back once the queue is drained
+			delete(d.spooled, item.file)
+			d.overflow = true
+		} else {
+			d.f.metrics.droppedTotal.With(d.label).Inc()
+			log.Error().Str("url", d.url).Int("size", len(body)).Msg("Forward queue full, dropping webhook")
+			d.writeDeadLetter(item)
+			return
+		}
+	}
+	d.f.metrics.queueDepth.With(d.label).Set(float64(atomic.AddInt64(&d.pending, 1)))
+}
+
+// spoolItem writes item to the spool folder and returns the file, or an empty
+// string if that failed. The file is written under a temporary name without
+// holding the lock, and marked as queued before it gets its .json name so the
+// worker does not also pick it up from the folder.
+func (d *forwardDestination) spoolItem(item forwardItem) string {
+	file := filepath.Join(d.spool, fmt.Sprintf("%s-%08d.json", item.enqueued.UTC().Format("20060102-150405.000"), atomic.AddUint64(&d.f.seq, 1)))
+	if err := os.WriteFile(file+".tmp", item.body, 0o644); err != nil {
+		log.Error().Caller().Err(err).Str("file", file).Msg("Failed to spool webhook, keeping it in memory only")
+		os.Remove(file + ".tmp")
+		return ""
+	}
+	d.mutex.Lock()
+	d.spooled[file] = true
+	d.mutex.Unlock()
+	if err := os.Rename(file+".tmp", file); err != nil {
+		log.Error().Caller().Err(err).Str("file", file).Msg("Failed to spool webhook, keeping it in memory only")
+		os.Remove(file + ".tmp")
+		d.mutex.Lock()
+		delete(d.spooled, file)
+		d.mutex.Unlock()
+		return ""
+	}
+	return file
+}
+
+func (d *forwardDestination) worker() {
+	for {
+		item, ok := d.next()
+		if !ok && d.stop() {
+			log.Info().Msgf("Stopped forwarding webhooks to %s", d.url)
+			return
+		}
+		if !ok {
+			d.f.metrics.queueAge.With(d.label).Set(0)
+			select {
+			case item = <-d.queue:
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		d.deliver(item)
+		d.mutex.Lock()
+		delete(d.spooled, item.file)
+		d.mutex.Unlock()
+		d.f.metrics.queueDepth.With(d.label).Set(float64(atomic.AddInt64(&d.pending, -1)))
+	}
+}
+
+// stop marks the worker as gone if the destination was removed, under the
+// lock so update can't revive it at the same time
+func (d *forwardDestination) stop() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.removed {
+		d.stopped = true
+		d.f.metrics.queueDepth.Delete(d.label)
+		d.f.metrics.queueAge.Delete(d.label)
+	}
+	return d.stopped
+}
+
+func (d *forwardDestination) isStopped() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.stopped
+}
+
+// next returns the next queued item, or one from the spool folder if some
+// did not fit in the queue
+func (d *forwardDestination) next() (forwardItem, bool) {
+	select {
+	case item := <-d.queue:
+		return item, true
+	default:
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.overflow {
+		return forwardItem{}, false
+	}
+	files, err := d.spoolFiles()
+	if err != nil {
+		log.Error().Caller().Err(err).Str("folder", d.spool).Msg("Failed to read forward spool folder")
+		return forwardItem{}, false
+	}
+	for _, file := range files {
+		if d.spooled[file] {
+			continue
+		}
+		body, err := os.ReadFile(file)
+		if err != nil {
+			log.Error().Caller().Err(err).Str("file", file).Msg("Failed to read spooled webhook")
+			continue
+		}
+		d.spooled[file] = true
+		enqueued := time.Now()
+		if info, err := os.Stat(file); err == nil {
+			enqueued = info.ModTime()
+		}
+		return forwardItem{body: body, enqueued: enqueued, file: file}, true
+	}
+	d.overflow = false
+	return forwardItem{}, false
+}
+
+func (d *forwardDestination) spoolFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(d.spool, "*.json"))
+	sort.Strings(files)
+	return files, err
+}
+
+// deliver tries to forward item with exponential backoff, after the last
+// retry it goes to the dead letter folder
+func (d *forwardDestination) deliver(item forwardItem) {
+	var s *span
+	if item.trace.valid() {
+		s = d.f.tracer.startSpan(item.trace, "forward deliver", tracepb.Span_SPAN_KIND_CLIENT)
+		s.setString("http.url", d.url)
+	}
+	backoff := d.f.retryInitial
+	for attempt := 0; ; attempt++ {
+		d.f.metrics.queueAge.With(d.label).Set(time.Since(item.enqueued).Seconds())
+		err := d.post(item.body, s.context())
+		if err == nil {
+			d.f.metrics.successTotal.With(d.label).Inc()
+			d.removeSpoolFile(item)
+			s.setInt("lora.forward.attempts", attempt+1)
+			s.finish(nil)
+			return
+		}
+		d.f.metrics.errorTotal.With(d.label).Inc()
+		_, permanent := err.(errPermanent)
+		if permanent || attempt >= d.f.maxRetries {
+			log.Error().Err(err).Str("url", d.url).Int("attempts", attempt+1).Msg("Giving up forwarding webhook")
+			d.writeDeadLetter(item)
+			d.removeSpoolFile(item)
+			s.setInt("lora.forward.attempts", attempt+1)
+			s.finish(err)
+			return
+		}
+		log.Warn().Err(err).Str("url", d.url).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("Failed to forward webhook, will retry")
+		d.f.metrics.retryTotal.With(d.label).Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > d.f.retryMax {
+			backoff = d.f.retryMax
+		}
+	}
+}
+
+// post sends body to the destination, with a traceparent header if trace is
+// set so the receiver can join the trace
+func (d *forwardDestination) post(body []byte, trace traceContext) error {
+	log.Debug().Str("url", d.url).Msg("forwarding")
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewBuffer(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	d.mutex.Lock()
+	rule := d.rule
+	d.mutex.Unlock()
+	rule.setHeaders(req)
+	if trace.valid() {
+		req.Header.Set("traceparent", trace.traceparent())
+	}
+	start := time.Now()
+	res, err := d.f.client.Do(req)
+	d.f.metrics.latency.With(d.label).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		log.Debug().Int("status", res.StatusCode).Str("url", d.url).Msg("Forwarded webhook")
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		return errPermanent{fmt.Errorf("got non-retryable reply %d", res.StatusCode)}
+	default:
+		return fmt.Errorf("got non-2xx reply %d", res.StatusCode)
+	}
+}
+
+func (d *forwardDestination) removeSpoolFile(item forwardItem) {
+	if len(item.file) == 0 {
+		return
+	}
+	if err := os.Remove(item.file); err != nil {
+		log.Error().Caller().Err(err).Str("file", item.file).Msg("Failed to remove spooled webhook")
+	}
+}
+
+func (d *forwardDestination) writeDeadLetter(item forwardItem) {
+	d.f.metrics.deadLetterTotal.With(d.label).Inc()
+	if len(d.deadLetter) == 0 {
+		return
+	}
+	filename := filepath.Join(d.deadLetter, fmt.Sprintf("%s-%08d.json", item.enqueued.UTC().Format("20060102-150405.000"), atomic.AddUint64(&d.f.seq, 1)))
+	if err := os.WriteFile(filename, item.body, 0o644); err != nil {
+		log.Error().Caller().Err(err).Str("file", filename).Msg("Failed to write dead letter")
+		return
+	}
+	log.Info().Str("url", d.url).Str("file", filename).Msg("Wrote webhook to dead letter folder")
+}
+
+// destinationDirName turns a url into a folder name that is safe and unique
+func destinationDirName(url string) string {
+	name := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://"))
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(url))
+	return fmt.Sprintf("%s-%08x", name, h.Sum32())
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// forwardServer replies with statuses in turn and 204 once they run out,
+// every body it gets is sent on bodies
+type forwardServer struct {
+	*httptest.Server
+	bodies chan string
+
+	mutex    sync.Mutex
+	statuses []int
+	attempts int
+}
+
+func newForwardServer(t *testing.T, statuses ...int) *forwardServer {
+	s := &forwardServer{bodies: make(chan string, 100), statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mutex.Lock()
+		status := http.StatusNoContent
+		if s.attempts < len(s.statuses) {
+			status = s.statuses[s.attempts]
+		}
+		s.attempts++
+		s.mutex.Unlock()
+		w.WriteHeader(status)
+		if status < 300 {
+			s.bodies <- string(body)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *forwardServer) attemptCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.attempts
+}
+
+// expect waits for the bodies to be forwarded, in order
+func (s *forwardServer) expect(t *testing.T, bodies ...string) {
+	t.Helper()
+	for _, want := range bodies {
+		select {
+		case got := <-s.bodies:
+			if got != want {
+				t.Errorf("got body %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("body %q was not forwarded", want)
+		}
+	}
+}
+
+// newTestForwarder returns a forwarder to url with short retries and its
+// destination, spool and deadLetter are folders or empty
+func newTestForwarder(t *testing.T, url string, spool string, deadLetter string) (*forwarder, *forwardDestination) {
+	t.Helper()
+	c := config
+	c.Forward = url
+	c.ForwardSpoolFolder = spool
+	c.ForwardDeadLetterFolder = deadLetter
+	f, err := newForwarder(c, newForwardMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.maxRetries = 3
+	f.retryInitial = 10 * time.Millisecond
+	f.retryMax = 20 * time.Millisecond
+	d := f.destinations[0]
+	if err := d.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	// Let the worker stop once the test is done with it
+	t.Cleanup(func() { f.update(nil) })
+	return f, d
+}
+
+func countFiles(t *testing.T, folder string, pattern string) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(folder, pattern))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestForwardDeliver(t *testing.T) {
+	tests := []struct {
+		name           string
+		statuses       []int
+		wantAttempts   int
+		wantSuccess    float64
+		wantRetries    float64
+		wantDeadLetter int
+	}{
+		{"success", nil, 1, 1, 0, 0},
+		{"fails then succeeds", []int{503, 502, 500}, 4, 1, 3, 0},
+		{"408 and 429 are retried", []int{408, 429}, 3, 1, 2, 0},
+		{"permanent error", []int{400}, 1, 0, 0, 1},
+		{"out of retries", []int{503, 503, 503, 503, 503}, 4, 0, 3, 1},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := newForwardServer(t, test.statuses...)
+			deadLetter := t.TempDir()
+			f, d := newTestForwarder(t, server.URL, "", deadLetter)
+
+			started := time.Now()
+			d.deliver(forwardItem{body: []byte(`{"fCnt":9}`), enqueued: started})
+			elapsed := time.Since(started)
+
+			if got := server.attemptCount(); got != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, test.wantAttempts)
+			}
+			// Backoff doubles from retryInitial and stops at retryMax
+			var wantBackoff time.Duration
+			backoff := f.retryInitial
+			for i := 1; i < test.wantAttempts; i++ {
+				wantBackoff += backoff
+				if backoff *= 2; backoff > f.retryMax {
+					backoff = f.retryMax
+				}
+			}
+			if elapsed < wantBackoff {
+				t.Errorf("took %s, want at least %s of backoff", elapsed, wantBackoff)
+			}
+			if got := testutil.ToFloat64(f.metrics.successTotal.With(d.label)); got != test.wantSuccess {
+				t.Errorf("got %v forwarded, want %v", got, test.wantSuccess)
+			}
+			if got := testutil.ToFloat64(f.metrics.errorTotal.With(d.label)); got != float64(test.wantAttempts)-test.wantSuccess {
+				t.Errorf("got %v errors, want %v", got, float64(test.wantAttempts)-test.wantSuccess)
+			}
+			if got := testutil.ToFloat64(f.metrics.retryTotal.With(d.label)); got != test.wantRetries {
+				t.Errorf("got %v retries, want %v", got, test.wantRetries)
+			}
+			if got := testutil.ToFloat64(f.metrics.deadLetterTotal.With(d.label)); got != float64(test.wantDeadLetter) {
+				t.Errorf("got %v dead letters, want %d", got, test.wantDeadLetter)
+			}
+			if got := countFiles(t, d.deadLetter, "*.json"); got != test.wantDeadLetter {
+				t.Errorf("got %d dead letter files, want %d", got, test.wantDeadLetter)
+			}
+		})
+	}
+}
+
+// TestForwardOverflow checks a full queue drops to the dead letter folder
+// without a spool, and spills to the spool folder with one
+func TestForwardOverflow(t *testing.T) {
+	t.Run("without spool", func(t *testing.T) {
+		f, d := newTestForwarder(t, "http://127.0.0.1:1/", "", t.TempDir())
+		d.queue = make(chan forwardItem, 1)
+		for i := 0; i < 3; i++ {
+			d.enqueue([]byte(fmt.Sprint(i)), traceContext{})
+		}
+		if got := testutil.ToFloat64(f.metrics.droppedTotal.With(d.label)); got != 2 {
+			t.Errorf("got %v dropped, want 2", got)
+		}
+		if got := countFiles(t, d.deadLetter, "*.json"); got != 2 {
+			t.Errorf("got %d dead letter files, want 2", got)
+		}
+		if got := testutil.ToFloat64(f.metrics.queueDepth.With(d.label)); got != 1 {
+			t.Errorf("got queue depth %v, want 1", got)
+		}
+	})
+
+	t.Run("with spool", func(t *testing.T) {
+		server := newForwardServer(t)
+		f, d := newTestForwarder(t, server.URL, t.TempDir(), t.TempDir())
+		d.queue = make(chan forwardItem, 1)
+		for i := 0; i < 3; i++ {
+			d.enqueue([]byte(fmt.Sprint(i)), traceContext{})
+		}
+		if got := testutil.ToFloat64(f.metrics.droppedTotal.With(d.label)); got != 0 {
+			t.Errorf("got %v dropped, want 0", got)
+		}
+		if got := countFiles(t, d.spool, "*.json"); got != 3 {
+			t.Errorf("got %d spool files, want 3", got)
+		}
+		if got := countFiles(t, d.spool, "*.tmp"); got != 0 {
+			t.Errorf("got %d temporary spool files, want 0", got)
+		}
+		if got := testutil.ToFloat64(f.metrics.queueDepth.With(d.label)); got != 3 {
+			t.Errorf("got queue depth %v, want 3", got)
+		}
+
+		go d.worker()
+		server.expect(t, "0", "1", "2")
+		waitFor(t, func() bool { return countFiles(t, d.spool, "*.json") == 0 })
+		if got := countFiles(t, d.deadLetter, "*.json"); got != 0 {
+			t.Errorf("got %d dead letter files, want 0", got)
+		}
+	})
+}
+
+// TestForwardSpoolRecovery checks what one run left in the spool is
+// forwarded by the next
+func TestForwardSpoolRecovery(t *testing.T) {
+	server := newForwardServer(t, 503)
+	spool := t.TempDir()
+	// The previous run never got to start its worker
+	_, previous := newTestForwarder(t, server.URL, spool, "")
+	for i := 0; i < 3; i++ {
+		previous.enqueue([]byte(fmt.Sprint(i)), traceContext{})
+	}
+	// A webhook that was still being written is left alone
+	if err := os.WriteFile(filepath.Join(previous.spool, "20240102-030405.000-99999999.json.tmp"), []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, d := newTestForwarder(t, server.URL, spool, "")
+	if got := testutil.ToFloat64(f.metrics.queueDepth.With(d.label)); got != 3 {
+		t.Errorf("got queue depth %v, want 3", got)
+	}
+	go d.worker()
+	server.expect(t, "0", "1", "2")
+	waitFor(t, func() bool { return countFiles(t, spool, "*/*.json") == 0 })
+	if got := countFiles(t, spool, "*/*.tmp"); got != 1 {
+		t.Errorf("got %d temporary spool files, want 1", got)
+	}
+	if got := testutil.ToFloat64(f.metrics.retryTotal.With(d.label)); got != 1 {
+		t.Errorf("got %v retries, want 1", got)
+	}
+}
+
+func waitFor(t *testing.T, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestForwardUpdate checks a url that is removed and added back while it is
+// still draining keeps its destination, so only one worker uses its spool
+func TestForwardUpdate(t *testing.T) {
+	server := newForwardServer(t)
+	f, d := newTestForwarder(t, server.URL, t.TempDir(), "")
+	rules := []*ForwardRule{{URL: server.URL}}
+
+	// No worker yet, so it is still draining when added back
+	d.enqueue([]byte("0"), traceContext{})
+	if err := f.update(nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.update(rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.destinations) != 1 || f.destinations[0] != d {
+		t.Fatalf("got destinations %v, want the draining one back", f.destinations)
+	}
+	if len(f.draining) != 0 {
+		t.Errorf("got %d draining destinations, want 0", len(f.draining))
+	}
+	go d.worker()
+	server.expect(t, "0")
+
+	// Once its worker stopped, adding it back starts a new one
+	if err := f.update(nil); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, d.isStopped)
+	if err := f.update(rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.destinations) != 1 || f.destinations[0] == d {
+		t.Fatalf("got destinations %v, want a new one", f.destinations)
+	}
+	f.destinations[0].enqueue([]byte("1"), traceContext{})
+	server.expect(t, "1")
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ForwardEvent is what gets handed to the forwarders, the raw body plus what
+// we know about it for filtering and templates
+type ForwardEvent struct {
+	Event  string
+	Body   []byte
+	Uplink *Uplink // nil for events that are not a chirpstack webhook
+	Device chirpstack.DeviceInfo
+	Trace  traceContext // span the forward deliveries are recorded under
+}
+
+// ForwardRule is a forward destination with optional filters, a template to
+// reshape the body and extra headers. An empty filter matches everything.
+type ForwardRule struct {
+	URL          string            `json:"url"`
+	Tenants      []string          `json:"tenants"`
+	Applications []string          `json:"applications"`
+	Devices      []string          `json:"devices"`
+	OUIs         []string          `json:"ouis"`
+	Events       []string          `json:"events"`
+	Template     string            `json:"template"`
+	TemplateFile string            `json:"templateFile"`
+	ContentType  string            `json:"contentType"`
+	Headers      map[string]string `json:"headers"`
+	BearerToken  string            `json:"bearerToken"`
+	BasicAuth    *struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"basicAuth"`
+
+	tmpl *template.Template
+}
+
+// forwardTemplateData is what templates get, eg
+// {"devEui":{{json .DevEui}},"time":{{json .Time}},"values":{{json .Measurements}}}
+type forwardTemplateData struct {
+	Event             string
+	DevEui            string
+	DeviceName        string
+	TenantID          string
+	TenantName        string
+	ApplicationID     string
+	ApplicationName   string
+	DeviceProfileName string
+	OUI               string
+	Time              time.Time
+	FCnt              int
+	Measurements      map[string]float64
+	Doc               chirpstack.Event
+	Body              string
+}
+
+var forwardTemplateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"unix":  func(t time.Time) int64 { return t.Unix() },
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+}
+
+// loadForwardRules reads the forward rules json file
+func loadForwardRules(filename string) ([]*ForwardRule, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := parseForwardRules(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	return rules, nil
+}
+
+// parseForwardRules parses and compiles a json list of forward rules
+func parseForwardRules(b []byte) ([]*ForwardRule, error) {
+	var rules []*ForwardRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err := rule.compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (rule *ForwardRule) compile() error {
+	if len(rule.URL) == 0 {
+		return fmt.Errorf("forward rule without url")
+	}
+	if len(rule.TemplateFile) > 0 {
+		b, err := os.ReadFile(rule.TemplateFile)
+		if err != nil {
+			return fmt.Errorf("forward rule %s: %w", rule.URL, err)
+		}
+		rule.Template = string(b)
+	}
+	if len(rule.Template) > 0 {
+		tmpl, err := template.New(rule.URL).Funcs(forwardTemplateFuncs).Option("missingkey=zero").Parse(rule.Template)
+		if err != nil {
+			return fmt.Errorf("forward rule %s: %w", rule.URL, err)
+		}
+		rule.tmpl = tmpl
+	}
+	return nil
+}
+
+// matches returns true if the event passes all the filters of the rule
+func (rule *ForwardRule) matches(ev ForwardEvent) bool {
+	return matchAny(rule.Events, ev.Event) &&
+		matchAny(rule.Tenants, ev.Device.TenantID, ev.Device.TenantName) &&
+		matchAny(rule.Applications, ev.Device.ApplicationID, ev.Device.ApplicationName) &&
+		matchAny(rule.Devices, ev.Device.DevEui, ev.Device.DeviceName) &&
+		matchAny(rule.OUIs, decoder.OUI(ev.Device.DevEui))
+}
+
+// render returns the body to forward, the original one without a template
+func (rule *ForwardRule) render(ev ForwardEvent) ([]byte, error) {
+	if rule.tmpl == nil {
+		return ev.Body, nil
+	}
+	data := forwardTemplateData{
+		Event:             ev.Event,
+		DevEui:            ev.Device.DevEui,
+		DeviceName:        ev.Device.DeviceName,
+		TenantID:          ev.Device.TenantID,
+		TenantName:        ev.Device.TenantName,
+		ApplicationID:     ev.Device.ApplicationID,
+		ApplicationName:   ev.Device.ApplicationName,
+		DeviceProfileName: ev.Device.DeviceProfileName,
+		OUI:               decoder.OUI(ev.Device.DevEui),
+		Measurements:      map[string]float64{},
+		Body:              string(ev.Body),
+	}
+	if ev.Uplink != nil {
+		data.Time = ev.Uplink.Time
+		data.FCnt = ev.Uplink.FCnt()
+		data.Measurements = ev.Uplink.MeasurementMap()
+		data.Doc = ev.Uplink.Doc
+	}
+	var buf bytes.Buffer
+	if err := rule.tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// setHeaders adds the content type, headers and auth of the rule to req
+func (rule *ForwardRule) setHeaders(req *http.Request) {
+	if len(rule.ContentType) > 0 {
+		req.Header.Set("Content-Type", rule.ContentType)
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range rule.Headers {
+		req.Header.Set(k, v)
+	}
+	if len(rule.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+rule.BearerToken)
+	}
+	if rule.BasicAuth != nil {
+		req.SetBasicAuth(rule.BasicAuth.Username, rule.BasicAuth.Password)
+	}
+}
+
+// matchAny returns true if list is empty or has any of the values, ignoring case
+func matchAny(list []string, values ...string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		for _, value := range values {
+			if len(value) > 0 && strings.EqualFold(item, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
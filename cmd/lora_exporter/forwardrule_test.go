@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+var testForwardDevice = chirpstack.DeviceInfo{
+	TenantID:          "52f14cd4-c6f1-4fbd-8f87-4025e1d49242",
+	TenantName:        "ChirpStack",
+	ApplicationID:     "2ac4b2a0-0a51-4dca-8f6c-05ac2f3e9b1c",
+	ApplicationName:   "Sensors",
+	DeviceProfileName: "LHT52",
+	DeviceName:        "lht52",
+	DevEui:            "a84041fbd1889410",
+}
+
+func TestForwardRuleMatches(t *testing.T) {
+	ev := ForwardEvent{Event: "up", Device: testForwardDevice}
+	tests := []struct {
+		name string
+		rule ForwardRule
+		want bool
+	}{
+		{"no filters", ForwardRule{}, true},
+		{"event", ForwardRule{Events: []string{"join", "up"}}, true},
+		{"other event", ForwardRule{Events: []string{"join"}}, false},
+		{"tenant id", ForwardRule{Tenants: []string{"52f14cd4-c6f1-4fbd-8f87-4025e1d49242"}}, true},
+		{"tenant name ignoring case", ForwardRule{Tenants: []string{"chirpstack"}}, true},
+		{"other tenant", ForwardRule{Tenants: []string{"other"}}, false},
+		{"application id", ForwardRule{Applications: []string{"2ac4b2a0-0a51-4dca-8f6c-05ac2f3e9b1c"}}, true},
+		{"application name", ForwardRule{Applications: []string{"Sensors"}}, true},
+		{"other application", ForwardRule{Applications: []string{"Trackers"}}, false},
+		{"device eui ignoring case", ForwardRule{Devices: []string{"A84041FBD1889410"}}, true},
+		{"device name", ForwardRule{Devices: []string{"lht52"}}, true},
+		{"other device", ForwardRule{Devices: []string{"24e124126d392076"}}, false},
+		{"oui", ForwardRule{OUIs: []string{"A8:40:41"}}, true},
+		{"other oui", ForwardRule{OUIs: []string{"24:e1:24"}}, false},
+		{"all filters", ForwardRule{Events: []string{"up"}, Tenants: []string{"ChirpStack"}, Applications: []string{"Sensors"}, Devices: []string{"lht52"}, OUIs: []string{"a8:40:41"}}, true},
+		{"one filter of all not matching", ForwardRule{Events: []string{"up"}, Tenants: []string{"ChirpStack"}, Applications: []string{"Sensors"}, Devices: []string{"lht52"}, OUIs: []string{"24:e1:24"}}, false},
+	}
+	for _, test := range tests {
+		if got := test.rule.matches(ev); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// An empty value never matches a filter, eg a device without a tenant name
+	rule := ForwardRule{Tenants: []string{""}}
+	if rule.matches(ForwardEvent{Event: "up", Device: chirpstack.DeviceInfo{DevEui: "a84041fbd1889410"}}) {
+		t.Errorf("empty tenant matched an empty filter")
+	}
+}
+
+func TestForwardRuleRender(t *testing.T) {
+	uplinkTime := time.Date(2023, 8, 23, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"fCnt":7}`)
+	uplink := &Uplink{
+		Header: chirpstack.Header{Time: uplinkTime, DeviceInfo: testForwardDevice},
+		Doc:    &chirpstack.UplinkEvent{FCnt: 7, FPort: 2},
+		DevEui: testForwardDevice.DevEui,
+		Measurements: []decoder.Measurement{
+			{Type: "temperature", Value: 28.41},
+			{Type: "humidity", Value: 60.2},
+		},
+	}
+	up := ForwardEvent{Event: "up", Body: body, Uplink: uplink, Device: testForwardDevice}
+	// Geofence events are forwarded without an uplink
+	geofence := ForwardEvent{Event: "geofence", Body: []byte(`{"event":"geofence"}`), Device: testForwardDevice}
+
+	tests := []struct {
+		name     string
+		template string
+		ev       ForwardEvent
+		want     string
+	}{
+		{"no template", "", up, `{"fCnt":7}`},
+		{"no template without uplink", "", geofence, `{"event":"geofence"}`},
+		{"device fields", `{{.Event}} {{.DevEui}} {{.DeviceName}} {{.TenantID}} {{.TenantName}} {{.ApplicationID}} {{.ApplicationName}} {{.DeviceProfileName}} {{.OUI}}`, up,
+			"up a84041fbd1889410 lht52 52f14cd4-c6f1-4fbd-8f87-4025e1d49242 ChirpStack 2ac4b2a0-0a51-4dca-8f6c-05ac2f3e9b1c Sensors LHT52 a8:40:41"},
+		{"uplink fields", `{{.FCnt}} {{.Measurements.temperature}} {{.Doc.FPort}}`, up, "7 28.41 2"},
+		{"body", `{{.Body}}`, up, `{"fCnt":7}`},
+		{"json", `{{json .Measurements}} {{json .DeviceName}}`, up, `{"humidity":60.2,"temperature":28.41} "lht52"`},
+		{"json time", `{{json .Time}}`, up, `"2023-08-23T12:00:00Z"`},
+		{"unix", `{{unix .Time}}`, up, "1692792000"},
+		{"lower", `{{lower .TenantName}}`, up, "chirpstack"},
+		{"upper", `{{upper .DevEui}}`, up, "A84041FBD1889410"},
+		{"missing measurement", `{{.Measurements.co2}}`, up, "0"},
+		{"without uplink", `{{.Event}} {{.DevEui}} {{.FCnt}} {{json .Measurements}} {{.Time.IsZero}} {{json .Doc}} {{.Body}}`, geofence,
+			`geofence a84041fbd1889410 0 {} true null {"event":"geofence"}`},
+	}
+	for _, test := range tests {
+		rule := ForwardRule{URL: "http://127.0.0.1/hook", Template: test.template}
+		if err := rule.compile(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		got, err := rule.render(test.ev)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if string(got) != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// A template that fails for an event returns the error, not a body
+	rule := ForwardRule{URL: "http://127.0.0.1/hook", Template: `{{.Doc.FPort}}`}
+	if err := rule.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := rule.render(geofence); err == nil {
+		t.Errorf("got %s without an uplink, want an error", got)
+	}
+}
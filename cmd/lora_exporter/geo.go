@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/guregu/null"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+)
+
+// DeviceLocation is a position fix reported by a device. Fields the decoder
+// did not provide are left null.
+type DeviceLocation struct {
+	Latitude  null.Float
+	Longitude null.Float
+	Altitude  null.Float
+	Accuracy  null.Float
+}
+
+// Valid returns true if we have a usable lat/lon pair. 0,0 is what most
+// trackers send when they have no fix, so we treat it as no location.
+func (l DeviceLocation) Valid() bool {
+	if !l.Latitude.Valid || !l.Longitude.Valid {
+		return false
+	}
+	return l.Latitude.Float64 != 0 || l.Longitude.Float64 != 0
+}
+
+// geoTracker keeps the locations of the devices of an Exporter and the
+// geofences they are in
+type geoTracker struct {
+	geohashPrecision int
+	metrics          *deviceMetrics
+
+	geoMutex           sync.Mutex
+	deviceGeohash      map[string]string
+	deviceLastLocation map[string]DeviceLocation
+	fixedLocations     map[string]DeviceLocation
+
+	geofences        []Geofence
+	geofenceMutex    sync.Mutex
+	geofenceStateMap map[string]*geofenceState
+}
+
+// newGeoTracker reads the fixed device locations and GEOFENCE_FILE
+func newGeoTracker(config EnvConfig, metrics *deviceMetrics) (*geoTracker, error) {
+	g := &geoTracker{
+		geohashPrecision:   config.MetricsGeohashPrecision,
+		metrics:            metrics,
+		deviceGeohash:      map[string]string{},
+		deviceLastLocation: map[string]DeviceLocation{},
+		geofenceStateMap:   map[string]*geofenceState{},
+	}
+	var err error
+	if g.fixedLocations, err = fixedLocations(config); err != nil {
+		return nil, err
+	}
+	if len(config.GeofenceFile) > 0 {
+		if g.geofences, err = loadGeofences(config.GeofenceFile); err != nil {
+			return nil, fmt.Errorf("failed to load geofences: %w", err)
+		}
+	}
+	return g, nil
+}
+
+// setFixedLocations switches to the fixed device locations of a reload
+func (g *geoTracker) setFixedLocations(locations map[string]DeviceLocation) {
+	g.geoMutex.Lock()
+	g.fixedLocations = locations
+	g.geoMutex.Unlock()
+}
+
+// relabel switches to new device metrics, the zones a device is in are
+// recorded again at its next fix without enter events
+func (g *geoTracker) relabel(metrics *deviceMetrics) {
+	g.geoMutex.Lock()
+	g.metrics = metrics
+	g.deviceGeohash = map[string]string{}
+	g.geoMutex.Unlock()
+	g.geofenceMutex.Lock()
+	g.geofenceStateMap = map[string]*geofenceState{}
+	g.geofenceMutex.Unlock()
+}
+
+// updateDeviceLocation sets the location gauges of a device. When geohash
+// labels are enabled, the series of the previous geohash are removed so each
+// device only ever has one set of location series.
+func (g *geoTracker) updateDeviceLocation(deviceLabel prometheus.Labels, devEui string, loc DeviceLocation) {
+	if !loc.Valid() {
+		return
+	}
+	label := mergeLabels(deviceLabel, nil)
+	g.geoMutex.Lock()
+	g.deviceLastLocation[devEui] = loc
+	if g.geohashPrecision > 0 {
+		hash := geohashEncode(loc.Latitude.Float64, loc.Longitude.Float64, g.geohashPrecision)
+		if last, ok := g.deviceGeohash[devEui]; ok && last != hash {
+			log.Debug().Str("devEui", devEui).Str("from", last).Str("to", hash).Msg("Device moved to new geohash")
+			g.deleteDeviceLocation(devEui)
+		}
+		g.deviceGeohash[devEui] = hash
+		label["geohash"] = hash
+	}
+	g.geoMutex.Unlock()
+	g.metrics.latitude.With(label).Set(loc.Latitude.Float64)
+	g.metrics.longitude.With(label).Set(loc.Longitude.Float64)
+	// A fix without altitude or accuracy removes the one of the last fix
+	if loc.Altitude.Valid {
+		g.metrics.altitude.With(label).Set(loc.Altitude.Float64)
+	} else {
+		g.metrics.altitude.Delete(label)
+	}
+	if loc.Accuracy.Valid {
+		g.metrics.accuracy.With(label).Set(loc.Accuracy.Float64)
+	} else {
+		g.metrics.accuracy.Delete(label)
+	}
+}
+
+func (g *geoTracker) deleteDeviceLocation(devEui string) {
+	label := prometheus.Labels{"deviceEui": devEui}
+	g.metrics.latitude.DeletePartialMatch(label)
+	g.metrics.longitude.DeletePartialMatch(label)
+	g.metrics.altitude.DeletePartialMatch(label)
+	g.metrics.accuracy.DeletePartialMatch(label)
+}
+
+// fixedLocations returns the locations of the devices section of the config
+// file and DEVICE_LOCATIONS, which wins for a device in both
+func fixedLocations(config EnvConfig) (map[string]DeviceLocation, error) {
+	locations := map[string]DeviceLocation{}
+	for _, devEui := range sortedKeys(config.Devices) {
+		if values := config.Devices[devEui].Location; len(values) > 0 {
+			loc, err := newFixedLocation(values)
+			if err != nil {
+				return nil, fmt.Errorf("devices: %s location: %w", devEui, err)
+			}
+			locations[devEui] = loc
+		}
+	}
+	envLocations, err := parseDeviceLocations(config.DeviceLocations)
+	if err != nil {
+		return nil, fmt.Errorf("DEVICE_LOCATIONS: %w", err)
+	}
+	for devEui, loc := range envLocations {
+		locations[devEui] = loc
+	}
+	return locations, nil
+}
+
+// parseDeviceLocations parses the fixed device locations, in the form of
+// devEui=lat,lon[,alt];devEui=lat,lon[,alt]
+func parseDeviceLocations(s string) (map[string]DeviceLocation, error) {
+	locations := map[string]DeviceLocation{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+		devEui, coords, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("device location %q is not devEui=lat,lon", entry)
+		}
+		loc, err := parseLatLon(strings.Split(coords, ","))
+		if err != nil {
+			return nil, fmt.Errorf("device location %q: %w", entry, err)
+		}
+		locations[strings.ToLower(strings.TrimSpace(devEui))] = loc
+	}
+	return locations, nil
+}
+
+// parseLatLon parses lat, lon and an optional altitude
+func parseLatLon(fields []string) (DeviceLocation, error) {
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return DeviceLocation{}, err
+		}
+		values[i] = v
+	}
+	return newFixedLocation(values)
+}
+
+// newFixedLocation checks lat, lon and an optional altitude
+func newFixedLocation(values []float64) (DeviceLocation, error) {
+	var loc DeviceLocation
+	if len(values) < 2 || len(values) > 3 {
+		return loc, fmt.Errorf("expected lat,lon[,alt]")
+	}
+	if values[0] < -90 || values[0] > 90 || values[1] < -180 || values[1] > 180 {
+		return loc, fmt.Errorf("lat,lon out of range")
+	}
+	loc.Latitude = null.FloatFrom(values[0])
+	loc.Longitude = null.FloatFrom(values[1])
+	if len(values) == 3 {
+		loc.Altitude = null.FloatFrom(values[2])
+	}
+	return loc, nil
+}
+
+// locationFromTags reads a fixed location from the latitude/longitude/altitude
+// device tags in chirpstack
+func locationFromTags(tags map[string]string) DeviceLocation {
+	lat, hasLat := tags["latitude"]
+	lon, hasLon := tags["longitude"]
+	if !hasLat || !hasLon {
+		return DeviceLocation{}
+	}
+	fields := []string{lat, lon}
+	if alt, ok := tags["altitude"]; ok {
+		fields = append(fields, alt)
+	}
+	loc, err := parseLatLon(fields)
+	if err != nil {
+		log.Warn().Err(err).Msg("Ignoring invalid location device tags")
+		return DeviceLocation{}
+	}
+	return loc
+}
+
+// distanceLocation picks the location used for gateway distances. A fix from
+// the current uplink wins, then the configured location, the device tags and
+// finally the last fix we got from the device.
+func (g *geoTracker) distanceLocation(devEui string, tags map[string]string, current DeviceLocation) (DeviceLocation, string) {
+	if current.Valid() {
+		return current, "uplink"
+	}
+	g.geoMutex.Lock()
+	defer g.geoMutex.Unlock()
+	if loc, ok := g.fixedLocations[strings.ToLower(devEui)]; ok {
+		return loc, "config"
+	}
+	if loc := locationFromTags(tags); loc.Valid() {
+		return loc, "tags"
+	}
+	if loc, ok := g.deviceLastLocation[devEui]; ok {
+		return loc, "lastFix"
+	}
+	return DeviceLocation{}, ""
+}
+
+// updateGatewayDistance sets the device to gateway distance for every gateway
+// that received the uplink and has a location configured
+func (g *geoTracker) updateGatewayDistance(deviceLabel prometheus.Labels, devEui string, tags map[string]string, current DeviceLocation, rxInfo []chirpstack.RxInfo) {
+	loc, source := g.distanceLocation(devEui, tags, current)
+	if !loc.Valid() {
+		return
+	}
+	for _, rxinfo := range rxInfo {
+		if rxinfo.Location.Latitude == 0 && rxinfo.Location.Longitude == 0 {
+			continue
+		}
+		distance := haversineMeters(loc.Latitude.Float64, loc.Longitude.Float64, rxinfo.Location.Latitude, rxinfo.Location.Longitude)
+		g.metrics.gatewayDistance.With(mergeLabels(deviceLabel, prometheus.Labels{"gatewayId": rxinfo.GatewayID})).Set(distance)
+		log.Debug().Str("devEui", devEui).Str("gatewayId", rxinfo.GatewayID).Str("source", source).Float64("distance", distance).Msg("Gateway distance")
+	}
+}
+
+const geohashBase32 = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// geohashEncode returns the geohash of lat/lon with precision characters (max 12)
+func geohashEncode(lat float64, lon float64, precision int) string {
+	if precision > 12 {
+		precision = 12
+	}
+	latRange := [2]float64{-90, 90}
+	lonRange := [2]float64{-180, 180}
+	hash := make([]byte, 0, precision)
+	bit, ch := 0, 0
+	even := true
+	for len(hash) < precision {
+		if even {
+			mid := (lonRange[0] + lonRange[1]) / 2
+			if lon >= mid {
+				ch |= 1 << (4 - bit)
+				lonRange[0] = mid
+			} else {
+				lonRange[1] = mid
+			}
+		} else {
+			mid := (latRange[0] + latRange[1]) / 2
+			if lat >= mid {
+				ch |= 1 << (4 - bit)
+				latRange[0] = mid
+			} else {
+				latRange[1] = mid
+			}
+		}
+		even = !even
+		if bit < 4 {
+			bit++
+		} else {
+			hash = append(hash, geohashBase32[ch])
+			bit, ch = 0, 0
+		}
+	}
+	return string(hash)
+}
+
+const earthRadiusMeters = 6371008.8
+
+// haversineMeters returns the great circle distance between two points
+func haversineMeters(lat1 float64, lon1 float64, lat2 float64, lon2 float64) float64 {
+	toRad := func(d float64) float64 { return d * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusMeters * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
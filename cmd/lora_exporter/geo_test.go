@@ -0,0 +1,214 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/guregu/null"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+)
+
+func TestGeohashEncode(t *testing.T) {
+	tests := []struct {
+		lat       float64
+		lon       float64
+		precision int
+		want      string
+	}{
+		{57.64911, 10.40744, 11, "u4pruydqqvj"},
+		{42.6, -5.6, 5, "ezs42"},
+		{0, 0, 5, "s0000"},
+		{-90, -180, 4, "0000"},
+		{57.64911, 10.40744, 1, "u"},
+		{57.64911, 10.40744, 0, ""},
+		{57.64911, 10.40744, 13, "u4pruydqqvj8"}, // capped at 12
+	}
+	for _, test := range tests {
+		if got := geohashEncode(test.lat, test.lon, test.precision); got != test.want {
+			t.Errorf("geohashEncode(%v, %v, %d) = %q, want %q", test.lat, test.lon, test.precision, got, test.want)
+		}
+	}
+}
+
+func TestHaversineMeters(t *testing.T) {
+	tests := []struct {
+		name                   string
+		lat1, lon1, lat2, lon2 float64
+		want                   float64
+	}{
+		{"same point", 1.4437, 103.8074, 1.4437, 103.8074, 0},
+		{"one degree of latitude", 0, 0, 1, 0, 111195.08},
+		{"one degree of longitude at the equator", 0, 0, 0, 1, 111195.08},
+		{"antipodes", 0, 0, 0, 180, 20015114.44},
+		{"pole to pole", 90, 0, -90, 0, 20015114.44},
+		{"london to paris", 51.5074, -0.1278, 48.8566, 2.3522, 343556.53},
+	}
+	for _, test := range tests {
+		got := haversineMeters(test.lat1, test.lon1, test.lat2, test.lon2)
+		if math.Abs(got-test.want) > 0.01 {
+			t.Errorf("%s: got %.2f meters, want %.2f", test.name, got, test.want)
+		}
+		if back := haversineMeters(test.lat2, test.lon2, test.lat1, test.lon1); math.Abs(back-got) > 1e-6 {
+			t.Errorf("%s: got %.2f meters back, want %.2f", test.name, back, got)
+		}
+	}
+}
+
+// TestUpdateDeviceLocation checks a fix without altitude or accuracy removes
+// those of the fix before
+func TestUpdateDeviceLocation(t *testing.T) {
+	c := config
+	c.MetricsGeohashPrecision = 0
+	g, err := newGeoTracker(c, newDeviceMetrics(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := prometheus.Labels{"deviceName": "tracker", "deviceEui": "2cf7f1c053300259"}
+	count := func(vec *prometheus.GaugeVec) int { return testutil.CollectAndCount(vec) }
+
+	g.updateDeviceLocation(label, "2cf7f1c053300259", DeviceLocation{null.FloatFrom(1.4437), null.FloatFrom(103.8074), null.FloatFrom(15), null.FloatFrom(5)})
+	if got := testutil.ToFloat64(g.metrics.altitude.With(label)); got != 15 {
+		t.Errorf("got altitude %v, want 15", got)
+	}
+	if got := testutil.ToFloat64(g.metrics.accuracy.With(label)); got != 5 {
+		t.Errorf("got accuracy %v, want 5", got)
+	}
+
+	g.updateDeviceLocation(label, "2cf7f1c053300259", DeviceLocation{Latitude: null.FloatFrom(1.4438), Longitude: null.FloatFrom(103.8075), Accuracy: null.FloatFrom(8)})
+	if got := testutil.ToFloat64(g.metrics.latitude.With(label)); got != 1.4438 {
+		t.Errorf("got latitude %v, want 1.4438", got)
+	}
+	if got := count(g.metrics.altitude); got != 0 {
+		t.Errorf("got %d altitude series, want 0", got)
+	}
+	if got := testutil.ToFloat64(g.metrics.accuracy.With(label)); got != 8 {
+		t.Errorf("got accuracy %v, want 8", got)
+	}
+
+	g.updateDeviceLocation(label, "2cf7f1c053300259", DeviceLocation{Latitude: null.FloatFrom(1.4439), Longitude: null.FloatFrom(103.8076)})
+	if got := count(g.metrics.accuracy); got != 0 {
+		t.Errorf("got %d accuracy series, want 0", got)
+	}
+	if got := count(g.metrics.latitude); got != 1 {
+		t.Errorf("got %d latitude series, want 1", got)
+	}
+}
+
+func TestParseDeviceLocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]DeviceLocation
+		wantErr string
+	}{
+		{"empty", "", map[string]DeviceLocation{}, ""},
+		{"lat lon and altitude", " A84041FBD1889410 = 1.4437, 103.8074 ;24e124126d392076=1.35,103.9,15;", map[string]DeviceLocation{
+			"a84041fbd1889410": {Latitude: null.FloatFrom(1.4437), Longitude: null.FloatFrom(103.8074)},
+			"24e124126d392076": {Latitude: null.FloatFrom(1.35), Longitude: null.FloatFrom(103.9), Altitude: null.FloatFrom(15)},
+		}, ""},
+		{"no equals", "a84041fbd1889410:1.4437,103.8074", nil, "is not devEui=lat,lon"},
+		{"not a number", "a84041fbd1889410=north,103.8074", nil, "invalid syntax"},
+		{"only latitude", "a84041fbd1889410=1.4437", nil, "expected lat,lon[,alt]"},
+		{"too many fields", "a84041fbd1889410=1.4437,103.8074,15,5", nil, "expected lat,lon[,alt]"},
+		{"latitude out of range", "a84041fbd1889410=91,103.8074", nil, "out of range"},
+		{"longitude out of range", "a84041fbd1889410=1.4437,-181", nil, "out of range"},
+		{"one bad entry", "a84041fbd1889410=1.4437,103.8074;24e124126d392076=1.35", nil, `"24e124126d392076=1.35"`},
+	}
+	for _, test := range tests {
+		got, err := parseDeviceLocations(test.s)
+		if len(test.wantErr) > 0 {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDistanceLocation(t *testing.T) {
+	uplink := DeviceLocation{Latitude: null.FloatFrom(1.30), Longitude: null.FloatFrom(103.80)}
+	fixed := DeviceLocation{Latitude: null.FloatFrom(1.31), Longitude: null.FloatFrom(103.81)}
+	tagged := map[string]string{"latitude": "1.32", "longitude": "103.82"}
+	last := DeviceLocation{Latitude: null.FloatFrom(1.33), Longitude: null.FloatFrom(103.83)}
+	noFix := DeviceLocation{Latitude: null.FloatFrom(0), Longitude: null.FloatFrom(0)}
+
+	tests := []struct {
+		name       string
+		fixed      bool
+		tags       map[string]string
+		last       bool
+		current    DeviceLocation
+		wantLat    float64
+		wantSource string
+	}{
+		{"uplink wins", true, tagged, true, uplink, 1.30, "uplink"},
+		{"config without a fix", true, tagged, true, noFix, 1.31, "config"},
+		{"config without a location", true, tagged, true, DeviceLocation{}, 1.31, "config"},
+		{"tags without config", false, tagged, true, DeviceLocation{}, 1.32, "tags"},
+		{"last fix without tags", false, nil, true, DeviceLocation{}, 1.33, "lastFix"},
+		{"last fix with invalid tags", false, map[string]string{"latitude": "north", "longitude": "103.82"}, true, DeviceLocation{}, 1.33, "lastFix"},
+		{"last fix with only a latitude tag", false, map[string]string{"latitude": "1.32"}, true, DeviceLocation{}, 1.33, "lastFix"},
+		{"nothing", false, nil, false, DeviceLocation{}, 0, ""},
+	}
+	for _, test := range tests {
+		c := config
+		g, err := newGeoTracker(c, newDeviceMetrics(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fixedLocations := map[string]DeviceLocation{}
+		if test.fixed {
+			fixedLocations["a84041fbd1889410"] = fixed
+		}
+		g.setFixedLocations(fixedLocations)
+		if test.last {
+			g.deviceLastLocation["a84041fbd1889410"] = last
+		}
+		loc, source := g.distanceLocation("a84041fbd1889410", test.tags, test.current)
+		if source != test.wantSource || loc.Latitude.Float64 != test.wantLat {
+			t.Errorf("%s: got %v from %q, want %v from %q", test.name, loc.Latitude.Float64, source, test.wantLat, test.wantSource)
+		}
+	}
+}
+
+func TestUpdateGatewayDistance(t *testing.T) {
+	c := config
+	g, err := newGeoTracker(c, newDeviceMetrics(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	label := prometheus.Labels{"deviceName": "lht52", "deviceEui": "a84041fbd1889410"}
+	var located, unlocated chirpstack.RxInfo
+	located.GatewayID = "2cf7f11353100025"
+	located.Location.Latitude = 0
+	located.Location.Longitude = 1
+	unlocated.GatewayID = "24e124fffef0b6a1"
+	rxInfo := []chirpstack.RxInfo{located, unlocated}
+
+	// Without any location of the device there is no distance
+	g.updateGatewayDistance(label, "a84041fbd1889410", nil, DeviceLocation{}, rxInfo)
+	if got := testutil.CollectAndCount(g.metrics.gatewayDistance); got != 0 {
+		t.Errorf("got %d distance series without a device location, want 0", got)
+	}
+
+	// The gateway at 0,0 has no location configured and is skipped
+	g.updateGatewayDistance(label, "a84041fbd1889410", nil, DeviceLocation{Latitude: null.FloatFrom(0.001), Longitude: null.FloatFrom(1)}, rxInfo)
+	if got := testutil.CollectAndCount(g.metrics.gatewayDistance); got != 1 {
+		t.Errorf("got %d distance series, want 1", got)
+	}
+	distance := testutil.ToFloat64(g.metrics.gatewayDistance.With(mergeLabels(label, prometheus.Labels{"gatewayId": "2cf7f11353100025"})))
+	if math.Abs(distance-111.2) > 0.1 {
+		t.Errorf("got distance %.2f meters, want 111.2", distance)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// Geofence is a named zone, either a polygon of [latitude, longitude] points
+// or a circle of radius meters around latitude/longitude.
+type Geofence struct {
+	Name      string       `json:"name"`
+	Polygon   [][2]float64 `json:"polygon"`
+	Latitude  float64      `json:"latitude"`
+	Longitude float64      `json:"longitude"`
+	Radius    float64      `json:"radius"`
+}
+
+// GeofenceEvent is forwarded when a device enters or exits a zone
+type GeofenceEvent struct {
+	Event      string    `json:"event"`
+	Transition string    `json:"transition"`
+	Zone       string    `json:"zone"`
+	DeviceName string    `json:"deviceName"`
+	DevEui     string    `json:"devEui"`
+	Time       time.Time `json:"time"`
+	Latitude   float64   `json:"latitude"`
+	Longitude  float64   `json:"longitude"`
+}
+
+type geofenceState struct {
+	zones   map[string]bool
+	lastFix time.Time
+}
+
+func (g Geofence) validate() error {
+	if len(g.Name) == 0 {
+		return fmt.Errorf("geofence without name")
+	}
+	if len(g.Polygon) == 0 && g.Radius <= 0 {
+		return fmt.Errorf("geofence %s needs a polygon or a radius", g.Name)
+	}
+	if len(g.Polygon) > 0 && len(g.Polygon) < 3 {
+		return fmt.Errorf("geofence %s polygon needs at least 3 points", g.Name)
+	}
+	return nil
+}
+
+// Contains returns true if lat/lon is inside the zone
+func (g Geofence) Contains(lat float64, lon float64) bool {
+	if len(g.Polygon) >= 3 {
+		// Ray casting, good enough for zones that don't cross the antimeridian
+		// A point on an edge shared by two zones is in only one of them
+		inside := false
+		j := len(g.Polygon) - 1
+		for i := range g.Polygon {
+			yi, xi := g.Polygon[i][0], g.Polygon[i][1]
+			yj, xj := g.Polygon[j][0], g.Polygon[j][1]
+			if (yi > lat) != (yj > lat) && lon < (xj-xi)*(lat-yi)/(yj-yi)+xi {
+				inside = !inside
+			}
+			j = i
+		}
+		return inside
+	}
+	return haversineMeters(g.Latitude, g.Longitude, lat, lon) <= g.Radius
+}
+
+// setGeofences switches to the zones of a reload. The state and series of
+// removed zones are deleted, devices in a changed zone get an enter or exit
+// at their next fix.
+func (g *geoTracker) setGeofences(zones []Geofence) {
+	g.geofenceMutex.Lock()
+	defer g.geofenceMutex.Unlock()
+	names := map[string]bool{}
+	for _, zone := range zones {
+		names[zone.Name] = true
+	}
+	for _, zone := range g.geofences {
+		if names[zone.Name] {
+			continue
+		}
+		for _, state := range g.geofenceStateMap {
+			delete(state.zones, zone.Name)
+		}
+		label := prometheus.Labels{"zone": zone.Name}
+		g.metrics.geofenceInfo.DeletePartialMatch(label)
+		g.metrics.geofenceEnterTotal.DeletePartialMatch(label)
+		g.metrics.geofenceExitTotal.DeletePartialMatch(label)
+		g.metrics.geofenceSeconds.DeletePartialMatch(label)
+	}
+	g.geofences = zones
+}
+
+func loadGeofences(filename string) ([]Geofence, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var zones []Geofence
+	if err := json.Unmarshal(b, &zones); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", filename, err)
+	}
+	names := map[string]bool{}
+	for _, zone := range zones {
+		if err := zone.validate(); err != nil {
+			return nil, err
+		}
+		if names[zone.Name] {
+			return nil, fmt.Errorf("geofence %s defined twice", zone.Name)
+		}
+		names[zone.Name] = true
+	}
+	log.Info().Int("zones", len(zones)).Str("file", filename).Msg("Loaded geofences")
+	return zones, nil
+}
+
+// checkGeofences compares a location fix against all zones, updates the zone
+// metrics and returns the enter/exit events. The first fix of a device after
+// startup only records which zones it is in, so a restart does not replay
+// enter events.
+func (g *geoTracker) checkGeofences(deviceLabel prometheus.Labels, devEui string, fixTime time.Time, loc DeviceLocation) []GeofenceEvent {
+	if len(g.geofences) == 0 || !loc.Valid() {
+		return nil
+	}
+	if fixTime.IsZero() {
+		fixTime = time.Now()
+	}
+	lat, lon := loc.Latitude.Float64, loc.Longitude.Float64
+	var events []GeofenceEvent
+
+	g.geofenceMutex.Lock()
+	defer g.geofenceMutex.Unlock()
+	state, seenBefore := g.geofenceStateMap[devEui]
+	if !seenBefore {
+		state = &geofenceState{zones: map[string]bool{}}
+		g.geofenceStateMap[devEui] = state
+	}
+	elapsed := fixTime.Sub(state.lastFix).Seconds()
+	for _, zone := range g.geofences {
+		label := mergeLabels(deviceLabel, prometheus.Labels{"zone": zone.Name})
+		inside := zone.Contains(lat, lon)
+		wasInside := state.zones[zone.Name]
+		if wasInside && seenBefore && elapsed > 0 {
+			// Count the time since the last fix, even when leaving now
+			g.metrics.geofenceSeconds.With(label).Add(elapsed)
+		}
+		if inside == wasInside {
+			continue
+		}
+		transition := "exit"
+		if inside {
+			transition = "enter"
+			state.zones[zone.Name] = true
+			g.metrics.geofenceInfo.With(label).Set(1)
+		} else {
+			delete(state.zones, zone.Name)
+			g.metrics.geofenceInfo.Delete(label)
+		}
+		if !seenBefore {
+			continue
+		}
+		if inside {
+			g.metrics.geofenceEnterTotal.With(label).Inc()
+		} else {
+			g.metrics.geofenceExitTotal.With(label).Inc()
+		}
+		log.Info().Str("devEui", devEui).Str("zone", zone.Name).Str("transition", transition).Msg("Geofence transition")
+		events = append(events, GeofenceEvent{Event: "geofence", Transition: transition, Zone: zone.Name, DeviceName: deviceLabel["deviceName"], DevEui: devEui, Time: fixTime, Latitude: lat, Longitude: lon})
+	}
+	if fixTime.After(state.lastFix) {
+		state.lastFix = fixTime
+	}
+	return events
+}
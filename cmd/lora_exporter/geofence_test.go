@@ -0,0 +1,124 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// Two squares of 10 degrees side by side, west shares its east edge with east
+var (
+	testGeofenceWest = Geofence{Name: "west", Polygon: [][2]float64{{0, 0}, {0, 10}, {10, 10}, {10, 0}}}
+	testGeofenceEast = Geofence{Name: "east", Polygon: [][2]float64{{0, 10}, {0, 20}, {10, 20}, {10, 10}}}
+	testGeofenceYard = Geofence{Name: "yard", Latitude: 5, Longitude: 5, Radius: 100}
+)
+
+func TestGeofenceContains(t *testing.T) {
+	tests := []struct {
+		name string
+		zone Geofence
+		lat  float64
+		lon  float64
+		want bool
+	}{
+		{"polygon inside", testGeofenceWest, 5, 5, true},
+		{"polygon outside", testGeofenceWest, 5, 15, false},
+		{"polygon north of it", testGeofenceWest, 11, 5, false},
+		{"polygon south edge", testGeofenceWest, 0, 5, true},
+		{"polygon west edge", testGeofenceWest, 5, 0, true},
+		{"polygon north edge", testGeofenceWest, 10, 5, false},
+		{"polygon east edge", testGeofenceWest, 5, 10, false},
+		{"polygon south west vertex", testGeofenceWest, 0, 0, true},
+		{"polygon north east vertex", testGeofenceWest, 10, 10, false},
+		{"shared edge is in the other zone", testGeofenceEast, 5, 10, true},
+		{"triangle", Geofence{Name: "t", Polygon: [][2]float64{{0, 0}, {10, 5}, {0, 10}}}, 8, 2, false},
+		{"triangle inside", Geofence{Name: "t", Polygon: [][2]float64{{0, 0}, {10, 5}, {0, 10}}}, 2, 5, true},
+		{"circle center", testGeofenceYard, 5, 5, true},
+		{"circle inside", testGeofenceYard, 5.0008, 5, true},      // 89m
+		{"circle outside", testGeofenceYard, 5.001, 5, false},     // 111m
+		{"circle on the edge", testGeofenceYard, 5, 5.0009, true}, // 99.6m
+	}
+	for _, test := range tests {
+		if got := test.zone.Contains(test.lat, test.lon); got != test.want {
+			t.Errorf("%s: %s contains %v,%v = %v, want %v", test.name, test.zone.Name, test.lat, test.lon, got, test.want)
+		}
+	}
+}
+
+func TestCheckGeofences(t *testing.T) {
+	c := config
+	g, err := newGeoTracker(c, newDeviceMetrics(c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.geofences = []Geofence{testGeofenceWest, testGeofenceEast, testGeofenceYard}
+	label := prometheus.Labels{"deviceName": "tracker", "deviceEui": "2cf7f1c053300259"}
+	start := time.Date(2023, 8, 23, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name        string
+		after       time.Duration
+		lat         float64
+		lon         float64
+		wantEvents  []string // transition zone
+		wantZones   []string
+		wantSeconds map[string]float64
+	}{
+		{"first fix only records the zones", 0, 5, 5, nil, []string{"west", "yard"}, nil},
+		{"staying in the zones", time.Minute, 5, 5.0001, nil, []string{"west", "yard"}, map[string]float64{"west": 60, "yard": 60}},
+		{"still staying", 3 * time.Minute, 5, 5, nil, []string{"west", "yard"}, map[string]float64{"west": 180, "yard": 180}},
+		{"leaving the yard", 4 * time.Minute, 5, 6, []string{"exit yard"}, []string{"west"}, map[string]float64{"west": 240, "yard": 240}},
+		{"crossing to east", 5 * time.Minute, 5, 15, []string{"exit west", "enter east"}, []string{"east"}, map[string]float64{"west": 300, "yard": 240}},
+		{"a fix out of order counts no time", 4*time.Minute + 30*time.Second, 5, 15, nil, []string{"east"}, map[string]float64{"west": 300, "yard": 240}},
+		{"staying in east", 7 * time.Minute, 5, 15, nil, []string{"east"}, map[string]float64{"west": 300, "east": 120, "yard": 240}},
+		{"no fix", 8 * time.Minute, 0, 0, nil, []string{"east"}, map[string]float64{"west": 300, "east": 120, "yard": 240}},
+		{"leaving everything", 9 * time.Minute, 20, 20, []string{"exit east"}, nil, map[string]float64{"west": 300, "east": 240, "yard": 240}},
+		{"back to the yard", 10 * time.Minute, 5, 5, []string{"enter west", "enter yard"}, []string{"west", "yard"}, map[string]float64{"west": 300, "east": 240, "yard": 240}},
+	}
+	for _, step := range steps {
+		fixTime := start.Add(step.after)
+		events := g.checkGeofences(label, "2cf7f1c053300259", fixTime, DeviceLocation{Latitude: null.FloatFrom(step.lat), Longitude: null.FloatFrom(step.lon)})
+		var got []string
+		for _, event := range events {
+			got = append(got, event.Transition+" "+event.Zone)
+			if event.DevEui != "2cf7f1c053300259" || event.DeviceName != "tracker" || !event.Time.Equal(fixTime) || event.Latitude != step.lat || event.Longitude != step.lon {
+				t.Errorf("%s: got event %+v", step.name, event)
+			}
+		}
+		if !reflect.DeepEqual(got, step.wantEvents) {
+			t.Errorf("%s: got events %v, want %v", step.name, got, step.wantEvents)
+		}
+		for _, zone := range g.geofences {
+			zoneLabel := mergeLabels(label, prometheus.Labels{"zone": zone.Name})
+			wantInside := false
+			for _, name := range step.wantZones {
+				wantInside = wantInside || name == zone.Name
+			}
+			if inside := g.geofenceStateMap["2cf7f1c053300259"].zones[zone.Name]; inside != wantInside {
+				t.Errorf("%s: in %s is %v, want %v", step.name, zone.Name, inside, wantInside)
+			}
+			if got := testutil.ToFloat64(g.metrics.geofenceSeconds.With(zoneLabel)); got != step.wantSeconds[zone.Name] {
+				t.Errorf("%s: got %v seconds in %s, want %v", step.name, got, zone.Name, step.wantSeconds[zone.Name])
+			}
+		}
+		if got := testutil.CollectAndCount(g.metrics.geofenceInfo); got != len(step.wantZones) {
+			t.Errorf("%s: got %d zone info series, want %d", step.name, got, len(step.wantZones))
+		}
+	}
+
+	// The first fix in a zone is not an enter, so each zone was entered and
+	// exited once
+	for _, zone := range g.geofences {
+		zoneLabel := mergeLabels(label, prometheus.Labels{"zone": zone.Name})
+		if got := testutil.ToFloat64(g.metrics.geofenceEnterTotal.With(zoneLabel)); got != 1 {
+			t.Errorf("got %v enters of %s, want 1", got, zone.Name)
+		}
+		if got := testutil.ToFloat64(g.metrics.geofenceExitTotal.With(zoneLabel)); got != 1 {
+			t.Errorf("got %v exits of %s, want 1", got, zone.Name)
+		}
+	}
+}
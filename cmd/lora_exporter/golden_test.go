@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caarlos0/env/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/rs/zerolog"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+)
+
+// go test -run TestGolden -update rewrites the golden files from the samples
+var update = flag.Bool("update", false, "update the .golden files")
+
+const (
+	sampleDir = "../../sample"
+	goldenDir = "testdata/golden"
+)
+
+func TestMain(m *testing.M) {
+	// Only the defaults, so the series don't depend on who runs the tests
+	if err := env.ParseWithOptions(&config, env.Options{Environment: map[string]string{}}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+// TestGolden runs every sample webhook through an exporter of its own and
+// compares the series with sample's .golden file
+func TestGolden(t *testing.T) {
+	samples, err := filepath.Glob(filepath.Join(sampleDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Fatalf("no samples in %s", sampleDir)
+	}
+	for _, sample := range samples {
+		sample := sample
+		name := strings.TrimSuffix(filepath.Base(sample), ".json")
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			body, err := os.ReadFile(sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := goldenSeries(t, body)
+			golden := filepath.Join(goldenDir, name+".golden")
+			if *update {
+				if err := os.MkdirAll(goldenDir, 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s, run go test -run TestGolden -update to create it", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("series differ from %s, run go test -run TestGolden -update if that is intended\n%s", golden, lineDiff(string(want), string(got)))
+			}
+		})
+	}
+}
+
+// goldenSeries is the exposition of the series a webhook produces, with its
+// parse and decode errors as comments
+func goldenSeries(t *testing.T, body []byte) []byte {
+	t.Helper()
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	uplink, reasons, err := e.parseChirpstackWebhook(chirpstack.EventUp, body, nil)
+	if err != nil {
+		fmt.Fprintf(&out, "# parse error: %s\n", err)
+	} else {
+		for _, e := range uplink.Errors {
+			fmt.Fprintf(&out, "# decode error: %s\n", e)
+		}
+	}
+	if len(reasons) > 0 {
+		fmt.Fprintf(&out, "# dump reasons: %s\n", strings.Join(reasons, ", "))
+	}
+	mfs, err := e.Registry().Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder := expfmt.NewEncoder(&out, expfmt.FmtText)
+	for _, mf := range deviceFamilies(mfs) {
+		if err := encoder.Encode(mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes()
+}
+
+// lineDiff is a line diff of want and got from their longest common
+// subsequence, each changed line with its line number in want (-) or got (+)
+func lineDiff(want string, got string) string {
+	a := strings.Split(want, "\n")
+	b := strings.Split(got, "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var diff strings.Builder
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&diff, "-%d: %s\n", i+1, a[i])
+			i++
+		default:
+			fmt.Fprintf(&diff, "+%d: %s\n", j+1, b[j])
+			j++
+		}
+	}
+	return diff.String()
+}
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		got  string
+		diff string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"changed", "a\nb\nc", "a\nx\nc", "-2: b\n+2: x\n"},
+		{"added", "a\nc", "a\nb\nc", "+2: b\n"},
+		{"removed", "a\nb\nc", "a\nc", "-2: b\n"},
+		{"reordered", "a\nb\nc", "b\na\nc", "-1: a\n+2: a\n"},
+		{"duplicated", "a\nb", "a\na\nb", "+2: a\n"},
+		{"empty got", "a\nb", "", "-1: a\n-2: b\n+1: \n"},
+	}
+	for _, test := range tests {
+		if got := lineDiff(test.want, test.got); got != test.diff {
+			t.Errorf("%s: got diff %q, want %q", test.name, got, test.diff)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The history is a bolt bucket per device with a bucket per measurement type,
+// keyed by the big endian uplink time in nanoseconds so keys sort by time
+var historyBucket = []byte("history")
+
+const (
+	historyQueueSize    = 1000
+	historyDefaultRange = 24 * time.Hour
+)
+
+// historyStore keeps the measurements of every uplink in a bolt file
+type historyStore struct {
+	file          string
+	retentionDays int
+	maxPoints     int
+	queryLimit    int
+	db            *bolt.DB
+	queue         chan *Uplink
+	metrics       *historyMetrics
+}
+
+func newHistoryStore(config EnvConfig, reg prometheus.Registerer) *historyStore {
+	return &historyStore{
+		file:          config.HistoryFile,
+		retentionDays: config.HistoryRetentionDays,
+		maxPoints:     config.HistoryMaxPoints,
+		queryLimit:    config.HistoryQueryLimit,
+		metrics:       newHistoryMetrics(reg),
+	}
+}
+
+// HistoryPoint is one stored measurement
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// HistorySeries is the stored measurements of one type of a device
+type HistorySeries struct {
+	Type   string         `json:"type"`
+	Points []HistoryPoint `json:"points"`
+}
+
+func (h *historyStore) start() error {
+	db, err := bolt.Open(h.file, 0o644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", h.file, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	}); err != nil {
+		return err
+	}
+	h.db = db
+	h.queue = make(chan *Uplink, historyQueueSize)
+	go h.worker()
+	log.Info().Str("file", h.file).Int("retentionDays", h.retentionDays).Int("maxPoints", h.maxPoints).Msg("Will keep measurement history")
+	return nil
+}
+
+// enqueue queues the measurements of an uplink to be stored, it never blocks
+func (h *historyStore) enqueue(uplink *Uplink) {
+	select {
+	case h.queue <- uplink:
+	default:
+		h.metrics.writeErrorTotal.Inc()
+		log.Error().Str("devEui", uplink.DevEui).Msg("History queue full, dropping uplink")
+	}
+}
+
+func (h *historyStore) worker() {
+	for uplink := range h.queue {
+		if err := h.store(uplink); err != nil {
+			h.metrics.writeErrorTotal.Inc()
+			log.Error().Err(err).Str("devEui", uplink.DevEui).Msg("Failed to store measurement history")
+		}
+	}
+}
+
+func (h *historyStore) store(uplink *Uplink) error {
+	if len(uplink.Measurements) == 0 {
+		return nil
+	}
+	timestamp := uplink.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	key := historyKey(timestamp)
+	return h.db.Update(func(tx *bolt.Tx) error {
+		device, err := tx.Bucket(historyBucket).CreateBucketIfNotExists([]byte(strings.ToLower(uplink.DevEui)))
+		if err != nil {
+			return err
+		}
+		for _, measurement := range uplink.Measurements {
+			series, err := device.CreateBucketIfNotExists([]byte(measurement.Type))
+			if err != nil {
+				return err
+			}
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, math.Float64bits(measurement.Value))
+			if err := series.Put(key, value); err != nil {
+				return err
+			}
+			h.metrics.pointsTotal.Inc()
+		}
+		return nil
+	})
+}
+
+func historyKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// prune removes points older than HISTORY_RETENTION_DAYS and the oldest
+// points of series with more than HISTORY_MAX_POINTS
+func (h *historyStore) prune() {
+	cutoff := historyKey(time.Now().AddDate(0, 0, -h.retentionDays))
+	pruned := 0
+	err := h.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(historyBucket).ForEachBucket(func(devEui []byte) error {
+			device := tx.Bucket(historyBucket).Bucket(devEui)
+			return device.ForEachBucket(func(metricType []byte) error {
+				series := device.Bucket(metricType)
+				excess := 0
+				if h.maxPoints > 0 {
+					excess = series.Stats().KeyN - h.maxPoints
+				}
+				c := series.Cursor()
+				for k, _ := c.First(); k != nil; k, _ = c.First() {
+					tooOld := h.retentionDays > 0 && bytes.Compare(k, cutoff) < 0
+					if !tooOld && excess <= 0 {
+						break
+					}
+					if err := c.Delete(); err != nil {
+						return err
+					}
+					excess--
+					pruned++
+				}
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to prune measurement history")
+		return
+	}
+	h.metrics.prunedTotal.Add(float64(pruned))
+	log.Debug().Int("pruned", pruned).Msg("Pruned measurement history")
+}
+
+// query returns the points of a device between from and to, of one type or
+// all types if metricType is empty
+func (h *historyStore) query(devEui string, metricType string, from time.Time, to time.Time, limit int) ([]HistorySeries, error) {
+	result := []HistorySeries{}
+	err := h.db.View(func(tx *bolt.Tx) error {
+		device := tx.Bucket(historyBucket).Bucket([]byte(strings.ToLower(devEui)))
+		if device == nil {
+			return nil
+		}
+		types := []string{metricType}
+		if len(metricType) == 0 {
+			types = nil
+			device.ForEachBucket(func(k []byte) error {
+				types = append(types, string(k))
+				return nil
+			})
+		}
+		sort.Strings(types)
+		min, max := historyKey(from), historyKey(to)
+		count := 0
+		for _, t := range types {
+			bucket := device.Bucket([]byte(t))
+			if bucket == nil {
+				continue
+			}
+			series := HistorySeries{Type: t, Points: []HistoryPoint{}}
+			c := bucket.Cursor()
+			for k, v := c.Seek(min); k != nil && bytes.Compare(k, max) <= 0 && count < limit; k, v = c.Next() {
+				series.Points = append(series.Points, HistoryPoint{
+					Time:  time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC(),
+					Value: math.Float64frombits(binary.BigEndian.Uint64(v)),
+				})
+				count++
+			}
+			result = append(result, series)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// handler serves /api/v1/devices/{devEui}/history?type=&from=&to= from and
+// to are RFC3339 or unix seconds, the last day by default. CSV is returned
+// with format=csv or an Accept: text/csv header.
+func (h *historyStore) handler(w http.ResponseWriter, r *http.Request, devEui string) {
+	if h.db == nil {
+		http.Error(w, "history is not enabled, set HISTORY_FILE", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	to, err := parseHistoryTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, "bad to: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseHistoryTime(query.Get("from"), to.Add(-historyDefaultRange))
+	if err != nil {
+		http.Error(w, "bad from: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := h.queryLimit
+	if l, err := strconv.Atoi(query.Get("limit")); err == nil && l > 0 && l < limit {
+		limit = l
+	}
+	series, err := h.query(devEui, query.Get("type"), from, to, limit)
+	if err != nil {
+		log.Error().Err(err).Str("devEui", devEui).Msg("Failed to query measurement history")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if query.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-history.csv"`, devEui))
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"time", "devEui", "type", "value"})
+		for _, s := range series {
+			for _, p := range s.Points {
+				cw.Write([]string{p.Time.Format(time.RFC3339Nano), devEui, s.Type, strconv.FormatFloat(p.Value, 'f', -1, 64)})
+			}
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"devEui": devEui,
+		"from":   from.UTC(),
+		"to":     to.UTC(),
+		"series": series,
+	})
+}
+
+// parseHistoryTime parses RFC3339 or unix seconds, def if s is empty
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if len(s) == 0 {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+// newTestHistory opens a history in a temp file, closed when the test is done
+func newTestHistory(t *testing.T, retentionDays int, maxPoints int, queryLimit int) *historyStore {
+	t.Helper()
+	c := config
+	c.HistoryFile = filepath.Join(t.TempDir(), "history.db")
+	c.HistoryRetentionDays = retentionDays
+	c.HistoryMaxPoints = maxPoints
+	c.HistoryQueryLimit = queryLimit
+	h := newHistoryStore(c, prometheus.NewRegistry())
+	if err := h.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		close(h.queue)
+		h.db.Close()
+	})
+	return h
+}
+
+// storeHistory stores an uplink of devEui at uplinkTime with the measurements
+func storeHistory(t *testing.T, h *historyStore, devEui string, uplinkTime time.Time, measurements ...decoder.Measurement) {
+	t.Helper()
+	uplink := &Uplink{Header: chirpstack.Header{Time: uplinkTime}, DevEui: devEui, Measurements: measurements}
+	if err := h.store(uplink); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// historyCounts returns the number of stored points of a device by type
+func historyCounts(t *testing.T, h *historyStore, devEui string) map[string]int {
+	t.Helper()
+	series, err := h.query(devEui, "", time.Unix(0, 0), time.Now().Add(time.Hour), math.MaxInt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, s := range series {
+		counts[s.Type] = len(s.Points)
+	}
+	return counts
+}
+
+func TestHistoryPrune(t *testing.T) {
+	tests := []struct {
+		name          string
+		retentionDays int
+		maxPoints     int
+		want          map[string]int
+	}{
+		{"no limits", 0, 0, map[string]int{"temperature": 5, "humidity": 2}},
+		{"retention", 2, 0, map[string]int{"temperature": 2, "humidity": 2}},
+		{"max points", 0, 3, map[string]int{"temperature": 3, "humidity": 2}},
+		{"both", 3, 1, map[string]int{"temperature": 1, "humidity": 1}},
+		{"everything too old", 1, 0, map[string]int{"temperature": 1, "humidity": 1}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestHistory(t, test.retentionDays, test.maxPoints, 1000)
+			// A point a day, an hour short of the day so retention days are
+			// not on the edge
+			now := time.Now().Add(-time.Hour)
+			for days := 4; days >= 0; days-- {
+				measurements := []decoder.Measurement{{Type: "temperature", Value: float64(20 + days)}}
+				if days < 2 {
+					measurements = append(measurements, decoder.Measurement{Type: "humidity", Value: float64(60 + days)})
+				}
+				storeHistory(t, h, "A84041FBD1889410", now.AddDate(0, 0, -days), measurements...)
+			}
+			h.prune()
+
+			got := historyCounts(t, h, "a84041fbd1889410")
+			for metricType, want := range test.want {
+				if got[metricType] != want {
+					t.Errorf("got %d %s points, want %d", got[metricType], metricType, want)
+				}
+			}
+			pruned := 7
+			for _, count := range test.want {
+				pruned -= count
+			}
+			if got := testutil.ToFloat64(h.metrics.prunedTotal); got != float64(pruned) {
+				t.Errorf("got %v pruned, want %d", got, pruned)
+			}
+			// The newest points are the ones kept
+			series, err := h.query("a84041fbd1889410", "temperature", time.Unix(0, 0), time.Now(), 1000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if points := series[0].Points; points[len(points)-1].Value != 20 {
+				t.Errorf("got newest point %v, want 20", points[len(points)-1])
+			}
+		})
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	h := newTestHistory(t, 0, 0, 5)
+	start := time.Date(2023, 8, 23, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		measurements := []decoder.Measurement{{Type: "temperature", Value: float64(20 + i)}}
+		if i < 2 {
+			measurements = append(measurements, decoder.Measurement{Type: "humidity", Value: float64(60 + i)})
+		}
+		storeHistory(t, h, "a84041fbd1889410", start.Add(time.Duration(i)*time.Minute), measurements...)
+	}
+	// Within a day of the last point, for the default from
+	storeHistory(t, h, "a84041fbd1889410", start.Add(-25*time.Hour), decoder.Measurement{Type: "temperature", Value: 10})
+
+	tests := []struct {
+		name     string
+		query    string
+		accept   string
+		wantCode int
+		want     string // type:values of the series, or the csv lines
+	}{
+		{"from to", "from=2023-08-23T12:01:00Z&to=2023-08-23T12:02:00Z", "", http.StatusOK, "humidity:61 temperature:21,22"},
+		{"unix seconds", fmt.Sprintf("from=%d&to=%d", start.Unix(), start.Add(time.Minute).Unix()), "", http.StatusOK, "humidity:60,61 temperature:20,21"},
+		{"a day before to by default", "to=2023-08-23T13:00:00Z&type=temperature", "", http.StatusOK, "temperature:20,21,22,23"},
+		{"from with a longer range", "from=2023-08-22T00:00:00Z&to=2023-08-23T13:00:00Z&type=temperature", "", http.StatusOK, "temperature:10,20,21,22,23"},
+		{"type", "from=2023-08-23T12:00:00Z&to=2023-08-23T13:00:00Z&type=temperature", "", http.StatusOK, "temperature:20,21,22,23"},
+		{"unknown type", "from=2023-08-23T12:00:00Z&to=2023-08-23T13:00:00Z&type=co2", "", http.StatusOK, ""},
+		{"limit over all series", "from=2023-08-23T12:00:00Z&to=2023-08-23T13:00:00Z&limit=3", "", http.StatusOK, "humidity:60,61 temperature:20"},
+		{"limit over HISTORY_QUERY_LIMIT", "from=2023-08-23T12:00:00Z&to=2023-08-23T13:00:00Z&limit=100", "", http.StatusOK, "humidity:60,61 temperature:20,21,22"},
+		{"invalid limit", "from=2023-08-23T12:00:00Z&to=2023-08-23T13:00:00Z&limit=x&type=temperature", "", http.StatusOK, "temperature:20,21,22,23"},
+		{"nothing in range", "from=2023-08-24T00:00:00Z&to=2023-08-24T01:00:00Z", "", http.StatusOK, "humidity: temperature:"},
+		{"bad from", "from=yesterday", "", http.StatusBadRequest, ""},
+		{"bad to", "to=2023-08-23", "", http.StatusBadRequest, ""},
+		{"csv", "from=2023-08-23T12:02:00Z&to=2023-08-23T13:00:00Z&format=csv", "", http.StatusOK,
+			"time,devEui,type,value\n2023-08-23T12:02:00Z,a84041fbd1889410,temperature,22\n2023-08-23T12:03:00Z,a84041fbd1889410,temperature,23\n"},
+		{"csv accept header", "from=2023-08-23T12:01:00Z&to=2023-08-23T12:01:00Z", "text/csv", http.StatusOK,
+			"time,devEui,type,value\n2023-08-23T12:01:00Z,a84041fbd1889410,humidity,61\n2023-08-23T12:01:00Z,a84041fbd1889410,temperature,21\n"},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/devices/a84041fbd1889410/history?"+test.query, nil)
+			if len(test.accept) > 0 {
+				r.Header.Set("Accept", test.accept)
+			}
+			w := httptest.NewRecorder()
+			h.handler(w, r, "a84041fbd1889410")
+			if w.Code != test.wantCode {
+				t.Fatalf("got %d, want %d: %s", w.Code, test.wantCode, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "text/csv") {
+				if got := w.Body.String(); got != test.want {
+					t.Errorf("got csv\n%s\nwant\n%s", got, test.want)
+				}
+				return
+			}
+			var response struct {
+				DevEui string          `json:"devEui"`
+				Series []HistorySeries `json:"series"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, s := range response.Series {
+				var values []string
+				for _, p := range s.Points {
+					values = append(values, fmt.Sprint(p.Value))
+				}
+				got = append(got, s.Type+":"+strings.Join(values, ","))
+			}
+			if strings.Join(got, " ") != test.want || response.DevEui != "a84041fbd1889410" {
+				t.Errorf("got %s %v, want %s", response.DevEui, got, test.want)
+			}
+		})
+	}
+
+	w := httptest.NewRecorder()
+	h.handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/devices/24e124126d392076/history", nil), "24e124126d392076")
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) == "" || !strings.Contains(w.Body.String(), `"series":[]`) {
+		t.Errorf("got %d %s for a device without history, want no series", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	newHistoryStore(config, prometheus.NewRegistry()).handler(w, httptest.NewRequest(http.MethodGet, "/api/v1/devices/a84041fbd1889410/history", nil), "a84041fbd1889410")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got %d without HISTORY_FILE, want 404", w.Code)
+	}
+}
@@ -1,70 +1,31 @@
 package main
 
 import (
-	"bytes"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 	"time"
 	"unicode"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
 )
 
-func startForwardServer() {
-	go func() {
-		for {
-			body := <-backgroundChannel
-			log.Debug().Int("size", len(body)).Msg("Got background webhook forward request")
-			if len(config.Forward) > 0 {
-				for _, url := range strings.Split(config.Forward, ",") {
-					log.Debug().Str("url", url).Msg("forwarding")
-					req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
-					if err != nil {
-						forwardConnectionErrorTotal.With(prometheus.Labels{"url": url}).Inc()
-						log.Error().Caller().Err(err).Str("url", url).Msg("Failed to create outgoing forward request")
-						break
-					}
-					req.Header.Set("Content-Type", "application/json")
-					res, err2 := http.DefaultClient.Do(req)
-					if err2 != nil {
-						log.Error().Caller().Err(err2).Str("url", url).Msg("Failed to do outgoing forward request")
-						break
-					}
-					if res.StatusCode == 200 {
-						log.Debug().Int("status", res.StatusCode).Str("url", url).Msg("Forwarded webhook")
-						forwardConnectionSuccessTotal.With(prometheus.Labels{"url": url}).Inc()
-					} else {
-						log.Error().Caller().Int("status", res.StatusCode).Str("url", url).Msg("Forwarded webhook but got non-200 reply")
-						forwardConnectionErrorTotal.With(prometheus.Labels{"url": url}).Inc()
-
-					}
-				}
-			}
-		}
-	}()
-}
-
-func startHttpServer() {
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/", webhookHandler)
-	mux.HandleFunc("/hook", webhookHandler)
-	mux.HandleFunc("/dump", dumpHandler)
+func startHttpServer(e *Exporter) {
 	httpServer := &http.Server{
-		Addr:         config.Listen,
-		Handler:      mux,
+		Addr:         e.config.Listen,
+		Handler:      e.Handler(),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  30 * time.Second,
 	}
-	log.Info().Msgf("Listening on port %s for http requests", config.Listen)
+	log.Info().Msgf("Listening on port %s for http requests", e.config.Listen)
 	go func() {
 		if err := httpServer.ListenAndServe(); err != nil {
 			if err != http.ErrServerClosed {
@@ -74,49 +35,110 @@ func startHttpServer() {
 	}()
 }
 
-func webhookHandler(w http.ResponseWriter, r *http.Request) {
+// requireAuthKey only lets requests with AUTHKEY through when it is set, as
+// a bearer token or the password of basic auth so a browser can log in to the
+// dashboard and the stream
+func (e *Exporter) requireAuthKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e.reloadMutex.RLock()
+		key := e.config.AuthKey
+		e.reloadMutex.RUnlock()
+		if len(key) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		given, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if _, password, ok := r.BasicAuth(); ok {
+			given = password
+		} else if !bearer {
+			given = ""
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(key)) != 1 {
+			log.Warn().Str("path", r.URL.Path).Str("IP", ReadUserIP(r)).Msg("Unauthorized request")
+			w.Header().Set("WWW-Authenticate", `Basic realm="lora_exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (e *Exporter) webhookHandler(w http.ResponseWriter, r *http.Request) {
 	ua := filterAscii(r.Header.Get("User-Agent"))
 	auth := filterAscii(r.Header.Get("Authorization"))
 	ip := ReadUserIP(r)
 	switch r.Method {
 	case "POST":
-		webhookConnectionTotal.With(prometheus.Labels{"ip": ip}).Inc()
+		e.metrics.webhookConnectionTotal.With(prometheus.Labels{"ip": ip}).Inc()
+		root := e.otlp.tracer.startWebhookSpan(r)
+		received := time.Now()
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
 			log.Error().Caller().Err(err).Str("IP", ip).Str("User-Agent", ua).Str("Authorization", auth).Msg("Failed to read request body")
-			webhookConnectionErrorTotal.With(prometheus.Labels{"ip": ip}).Inc()
+			e.metrics.webhookConnectionErrorTotal.With(prometheus.Labels{"ip": ip}).Inc()
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			root.finish(err)
 			return
 		}
+		e.reloadMutex.RLock()
+		defer e.reloadMutex.RUnlock()
+		event := r.URL.Query().Get("event")
+		if len(event) == 0 {
+			event = "up" // chirpstack always sets it, assume uplink if it doesn't
+		}
+		root.setString("chirpstack.event", event)
 		filename := ""
-		devEui, needDump, err2 := parseChirpstackWebhook(body)
-		if (config.Debug || needDump) && (len(config.DumpFolder) > 0) {
-			filename = dumpFile(body)
+		uplink, dumpReasons, err2 := e.parseChirpstackWebhook(event, body, root)
+		if errors.Is(err2, chirpstack.ErrUnknownEvent) {
+			// Accepted so chirpstack does not log it as failed or retry it
+			log.Debug().Str("event", event).Str("IP", ip).Msg("Ignoring unknown event")
+			fmt.Fprintf(w, `ok`)
+			root.finish(nil)
+			return
+		}
+		if e.config.Debug {
+			dumpReasons = append(dumpReasons, dumpReasonDebug)
+		}
+		if len(dumpReasons) > 0 {
+			s := root.child("dump")
+			filename = e.dumper.dumpFile(newDumpEnvelope(r, received, event, body, dumpReasons, err2))
+			s.setString("lora.dump.file", filename)
+			s.finish(nil)
 		}
 		if err2 != nil {
-			webhookConnectionErrorTotal.With(prometheus.Labels{"ip": ip}).Inc()
-			if filename == "" { // We already dumped it since its in debug mode
-				filename = dumpFile(body)
-			}
+			e.metrics.webhookConnectionErrorTotal.With(prometheus.Labels{"ip": ip}).Inc()
 			log.Error().Caller().Err(err2).Str("dump", filename).Str("IP", ip).Str("User-Agent", ua).Str("Authorization", auth).Msg("Failed to parse request body")
 			http.Error(w, err2.Error(), http.StatusBadRequest)
+			e.stream.publish(newStreamEvent(event, nil, err2))
+			root.finish(err2)
 			return
 		}
-		if len(config.Forward) > 0 {
+		root.setString("chirpstack.deduplication_id", uplink.DeduplicationID)
+		root.setDevice(uplink.DeviceInfo)
+		e.devices.recordDevice(event, uplink, body)
+		e.devices.recordDeviceDump(uplink.DevEui, filename)
+		e.stream.publish(newStreamEvent(event, uplink, nil))
+		if event == "up" {
+			e.publishUplink(uplink)
+		}
+		if len(e.forwarder.destinations) > 0 {
 			log.Debug().Int("size", len(body)).Msg("Forward webhook body to background task")
-			backgroundChannel <- body
+			s := root.child("forward")
+			e.forwarder.enqueueForward(ForwardEvent{Event: event, Body: body, Uplink: uplink, Device: uplink.DeviceInfo, Trace: s.context()})
+			s.finish(nil)
 		}
 		fmt.Fprintf(w, `ok`)
-		log.Info().Str("devEui", devEui).Str("dump", filename).Str("method", r.Method).Str("IP", ip).Str("User-Agent", ua).Str("Authorization", auth).Int("size", len(body)).Msg("Got webhook request")
+		root.finish(nil)
+		log.Info().Str("devEui", uplink.DevEui).Str("dump", filename).Str("method", r.Method).Str("IP", ip).Str("User-Agent", ua).Str("Authorization", auth).Int("size", len(body)).Msg("Got webhook request")
 	default:
 		log.Info().Str("method", r.Method).Str("IP", ip).Str("User-Agent", ua).Str("Authorization", auth).Msg("Got lost soul")
 		http.Redirect(w, r, "/metrics", http.StatusMovedPermanently)
 	}
 }
 
-func dumpHandler(w http.ResponseWriter, r *http.Request) {
+func (e *Exporter) dumpHandler(w http.ResponseWriter, r *http.Request) {
 	ip := ReadUserIP(r)
-	webhookConnectionTotal.With(prometheus.Labels{"ip": ip}).Inc()
+	e.metrics.webhookConnectionTotal.With(prometheus.Labels{"ip": ip}).Inc()
 	ua := filterAscii(r.Header.Get("User-Agent"))
 	auth := filterAscii(r.Header.Get("Authorization"))
 	log.Debug().Str("User-Agent", ua).Str("Authorization", auth).Msg("Got request")
@@ -124,31 +146,21 @@ func dumpHandler(w http.ResponseWriter, r *http.Request) {
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Error().Caller().Err(err).Msg("Failed to ready request body")
-		webhookConnectionErrorTotal.With(prometheus.Labels{"ip": ip}).Inc()
+		e.metrics.webhookConnectionErrorTotal.With(prometheus.Labels{"ip": ip}).Inc()
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	filename := dumpFile(body)
+	e.reloadMutex.RLock()
+	filename := e.dumper.dumpFile(newDumpEnvelope(r, time.Now(), r.URL.Query().Get("event"), body, []string{dumpReasonManual}, nil))
+	e.reloadMutex.RUnlock()
+	if len(filename) == 0 {
+		http.Error(w, "not dumped, is DUMP_FOLDER set?", http.StatusInternalServerError)
+		return
+	}
 	fmt.Fprintf(w, "dumped to %s\n", filename)
 
 }
 
-func dumpFile(s []byte) string {
-	filename := config.DumpFolder + time.Now().Format("/20060102-150405.000.dump")
-	f, err := os.Create(filename)
-	if err != nil {
-		log.Error().Caller().Err(err).Str("filename", filename).Msg("Failed to open file to write")
-	}
-	defer f.Close()
-	nb, err2 := f.Write(s)
-	if err2 != nil {
-		log.Error().Caller().Err(err).Str("filename", filename).Msg("Failed to write stringo to file")
-	} else {
-		log.Debug().Str("filename", filename).Msgf("Wrote %0d bytes to file", nb)
-	}
-	return filename
-}
-
 func filterAscii(s string) string {
 	return strings.Map(func(r rune) rune {
 		if r > unicode.MaxASCII {
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRequireAuthKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		authKey  string
+		path     string
+		setAuth  func(r *http.Request)
+		wantCode int
+	}{
+		{"no AUTHKEY", "", "/api/v1/devices", func(r *http.Request) {}, http.StatusOK},
+		{"no auth", "s3cret", "/api/v1/devices", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"bearer", "s3cret", "/api/v1/devices", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cret") }, http.StatusOK},
+		{"wrong bearer", "s3cret", "/api/v1/devices", func(r *http.Request) { r.Header.Set("Authorization", "Bearer s3cre") }, http.StatusUnauthorized},
+		{"key without bearer", "s3cret", "/api/v1/devices", func(r *http.Request) { r.Header.Set("Authorization", "s3cret") }, http.StatusUnauthorized},
+		{"basic auth", "s3cret", "/api/v1/devices", func(r *http.Request) { r.SetBasicAuth("tech", "s3cret") }, http.StatusOK},
+		{"wrong basic auth", "s3cret", "/api/v1/devices", func(r *http.Request) { r.SetBasicAuth("s3cret", "") }, http.StatusUnauthorized},
+		{"device", "s3cret", "/api/v1/devices/a84041fbd1889410", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"dumps", "s3cret", "/api/v1/devices/a84041fbd1889410/dumps", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"stream", "s3cret", "/api/v1/stream", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"dashboard", "s3cret", "/ui/", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"dashboard with basic auth", "s3cret", "/ui/", func(r *http.Request) { r.SetBasicAuth("", "s3cret") }, http.StatusOK},
+		{"metrics stay open", "s3cret", "/metrics", func(r *http.Request) {}, http.StatusOK},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c := config
+			c.AuthKey = test.authKey
+			e, err := NewExporter(c, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			test.setAuth(r)
+			w := httptest.NewRecorder()
+			e.Handler().ServeHTTP(w, r)
+			if w.Code != test.wantCode {
+				t.Errorf("got %d, want %d", w.Code, test.wantCode)
+			}
+			if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+				t.Error("got no WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+// TestStreamOrigin checks a page of another site can't open the websocket
+func TestStreamOrigin(t *testing.T) {
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(e.Handler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/v1/stream"
+	tests := []struct {
+		name     string
+		origin   string
+		wantCode int
+	}{
+		{"no origin", "", http.StatusSwitchingProtocols},
+		{"same origin", server.URL, http.StatusSwitchingProtocols},
+		{"other origin", "https://evil.example", http.StatusForbidden},
+		{"other port", "http://127.0.0.1:1", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		if len(test.origin) > 0 {
+			header.Set("Origin", test.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if resp.StatusCode != test.wantCode {
+			t.Errorf("%s: got %d, want %d", test.name, resp.StatusCode, test.wantCode)
+		}
+	}
+}
+
+// TestWebhookEvents checks every event counts as a message and unknown events
+// are accepted without touching the metrics
+func TestWebhookEvents(t *testing.T) {
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const deviceInfo = `"deviceInfo":{"deviceName":"door","devEui":"a84041fbd1889410"}`
+	post := func(event string, body string) int {
+		r := httptest.NewRequest(http.MethodPost, "/?event="+event, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		e.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+	label := prometheus.Labels{"deviceName": "door", "deviceEui": "a84041fbd1889410"}
+
+	if code := post("downlink", `{`+deviceInfo+`}`); code != http.StatusOK {
+		t.Errorf("unknown event got %d, want 200", code)
+	}
+	if got := testutil.CollectAndCount(e.deviceMetrics.unconfirmed); got != 0 {
+		t.Errorf("unknown event added %d unconfirmed series, want 0", got)
+	}
+
+	steps := []struct {
+		event           string
+		body            string
+		wantFcnt        float64
+		wantConfirmed   float64
+		wantUnconfirmed float64
+	}{
+		{"up", `{` + deviceInfo + `,"fCnt":9,"confirmed":true,"object":{}}`, 9, 1, 0},
+		{"status", `{` + deviceInfo + `,"margin":7,"batteryLevel":80}`, 0, 1, 1},
+		{"log", `{` + deviceInfo + `,"level":"ERROR","code":"UPLINK_CODEC"}`, 0, 1, 2},
+		{"up", `{` + deviceInfo + `,"fCnt":10,"object":{}}`, 10, 1, 3},
+	}
+	for _, step := range steps {
+		if code := post(step.event, step.body); code != http.StatusOK {
+			t.Fatalf("%s got %d, want 200", step.event, code)
+		}
+		if got := testutil.ToFloat64(e.deviceMetrics.fcnt.With(label)); got != step.wantFcnt {
+			t.Errorf("after %s got fcnt %v, want %v", step.event, got, step.wantFcnt)
+		}
+		if got := testutil.ToFloat64(e.deviceMetrics.confirmed.With(label)); got != step.wantConfirmed {
+			t.Errorf("after %s got %v confirmed, want %v", step.event, got, step.wantConfirmed)
+		}
+		if got := testutil.ToFloat64(e.deviceMetrics.unconfirmed.With(label)); got != step.wantUnconfirmed {
+			t.Errorf("after %s got %v unconfirmed, want %v", step.event, got, step.wantUnconfirmed)
+		}
+	}
+}
+
+// TestWebhookUnsupportedOUI checks a device without a decoder is dumped but
+// not recorded as an error
+func TestWebhookUnsupportedOUI(t *testing.T) {
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	uplink, reasons, err := e.parseChirpstackWebhook("up", []byte(`{"deviceInfo":{"deviceName":"x","devEui":"0016c001f0000001"},"object":{"temperature":20}}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uplink.Errors) != 0 {
+		t.Errorf("got errors %v, want none", uplink.Errors)
+	}
+	if !contains(reasons, dumpReasonUnsupportedOUI) {
+		t.Errorf("got dump reasons %v, want %s", reasons, dumpReasonUnsupportedOUI)
+	}
+}
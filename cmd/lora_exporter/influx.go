@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxTagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+)
+
+// influxWriter writes the measurements of every uplink to influxdb v2 in
+// line protocol, in batches
+type influxWriter struct {
+	url           string
+	token         string
+	measurement   string
+	client        *http.Client
+	queue         chan string
+	queueSize     int
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryInitial  time.Duration
+	retryMax      time.Duration
+	metrics       *influxMetrics
+}
+
+func newInfluxWriter(config EnvConfig, reg prometheus.Registerer) *influxWriter {
+	query := url.Values{}
+	query.Set("org", config.InfluxOrg)
+	query.Set("bucket", config.InfluxBucket)
+	query.Set("precision", "ns")
+	return &influxWriter{
+		url:           strings.TrimSuffix(config.InfluxURL, "/") + "/api/v2/write?" + query.Encode(),
+		token:         config.InfluxToken,
+		measurement:   config.InfluxMeasurement,
+		client:        &http.Client{Timeout: time.Duration(config.InfluxTimeout) * time.Second},
+		queueSize:     config.InfluxQueueSize,
+		batchSize:     config.InfluxBatchSize,
+		flushInterval: time.Duration(config.InfluxFlushInterval) * time.Second,
+		maxRetries:    config.InfluxMaxRetries,
+		retryInitial:  time.Duration(config.InfluxRetryInitial) * time.Second,
+		retryMax:      time.Duration(config.InfluxRetryMax) * time.Second,
+		metrics:       newInfluxMetrics(reg),
+	}
+}
+
+func (w *influxWriter) start() {
+	w.queue = make(chan string, w.queueSize)
+	go w.worker()
+	log.Info().Str("url", w.url).Msg("Will write measurements to influxdb")
+}
+
+// enqueue queues a point for every measurement of the uplink, it never
+// blocks
+func (w *influxWriter) enqueue(uplink *Uplink) {
+	timestamp := uplink.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	for _, measurement := range uplink.Measurements {
+		line := influxLine(w.measurement, map[string]string{
+			"deviceName": uplink.DeviceInfo.DeviceName,
+			"deviceEui":  uplink.DevEui,
+			"type":       measurement.Type,
+		}, measurement.Value, timestamp)
+		select {
+		case w.queue <- line:
+		default:
+			w.metrics.droppedTotal.Inc()
+			log.Error().Str("devEui", uplink.DevEui).Str("type", measurement.Type).Msg("Influx queue full, dropping point")
+		}
+	}
+}
+
+// influxLine returns a point in line protocol, tags with an empty value are
+// left out as influx does not allow them
+func influxLine(measurement string, tags map[string]string, value float64, timestamp time.Time) string {
+	var b strings.Builder
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys) // influx prefers sorted tags
+	for _, key := range keys {
+		if len(tags[key]) > 0 {
+			b.WriteString("," + influxTagEscaper.Replace(key) + "=" + influxTagEscaper.Replace(tags[key]))
+		}
+	}
+	b.WriteString(" value=" + strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteString(" " + strconv.FormatInt(timestamp.UnixNano(), 10))
+	return b.String()
+}
+
+// worker sends the queued points in batches, when the batch is full or every
+// INFLUX_FLUSH_INTERVAL seconds
+func (w *influxWriter) worker() {
+	ticker := time.NewTicker(w.flushInterval)
+	batch := make([]string, 0, w.batchSize)
+	for {
+		select {
+		case line := <-w.queue:
+			batch = append(batch, line)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.deliver(batch)
+		batch = batch[:0]
+	}
+}
+
+// deliver writes a batch with exponential backoff, it is dropped after the
+// last retry
+func (w *influxWriter) deliver(batch []string) {
+	body := []byte(strings.Join(batch, "\n"))
+	backoff := w.retryInitial
+	for attempt := 0; ; attempt++ {
+		err := w.write(body)
+		if err == nil {
+			w.metrics.pointsTotal.Add(float64(len(batch)))
+			return
+		}
+		w.metrics.writeErrorTotal.Inc()
+		_, permanent := err.(errPermanent)
+		if permanent || attempt >= w.maxRetries {
+			w.metrics.droppedTotal.Add(float64(len(batch)))
+			log.Error().Err(err).Int("points", len(batch)).Int("attempts", attempt+1).Msg("Giving up writing to influxdb")
+			return
+		}
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("Failed to write to influxdb, will retry")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > w.retryMax {
+			backoff = w.retryMax
+		}
+	}
+}
+
+func (w *influxWriter) write(body []byte) error {
+	w.metrics.writeTotal.Inc()
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewBuffer(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(w.token) > 0 {
+		req.Header.Set("Authorization", "Token "+w.token)
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		log.Debug().Int("status", res.StatusCode).Int("size", len(body)).Msg("Wrote batch to influxdb")
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		return errPermanent{fmt.Errorf("got non-retryable reply %d", res.StatusCode)}
+	default:
+		return fmt.Errorf("got non-2xx reply %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+// newTestInfluxWriter returns a writer for url with short retries
+func newTestInfluxWriter(url string) *influxWriter {
+	c := config
+	c.InfluxURL = url
+	c.InfluxMeasurement = "lora"
+	w := newInfluxWriter(c, prometheus.NewRegistry())
+	w.maxRetries = 3
+	w.retryInitial = 10 * time.Millisecond
+	w.retryMax = 20 * time.Millisecond
+	return w
+}
+
+func TestInfluxLine(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	tests := []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		value       float64
+		want        string
+	}{
+		{"plain", "lora", map[string]string{"type": "temperature"}, 21.5, "lora,type=temperature value=21.5 1704164645000000006"},
+		{"sorted tags", "lora", map[string]string{"type": "humidity", "deviceEui": "a84041fbd1889410"}, 60, "lora,deviceEui=a84041fbd1889410,type=humidity value=60 1704164645000000006"},
+		{"empty tag", "lora", map[string]string{"deviceName": "", "type": "battery"}, 3.1, "lora,type=battery value=3.1 1704164645000000006"},
+		{"tag escaping", "lora", map[string]string{"deviceName": "hall way,1=a"}, 1, `lora,deviceName=hall\ way\,1\=a value=1 1704164645000000006`},
+		{"measurement escaping", "lora data,x=1", map[string]string{}, -2, `lora\ data\,x=1 value=-2 1704164645000000006`},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if got := influxLine(test.measurement, test.tags, test.value, timestamp); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestInfluxWriterBatches(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	w := newTestInfluxWriter(server.URL)
+	w.batchSize = 2
+	w.flushInterval = 200 * time.Millisecond
+	w.start()
+	w.enqueue(&Uplink{
+		Header: chirpstack.Header{
+			Time:       time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			DeviceInfo: chirpstack.DeviceInfo{DeviceName: "lht52 hall"},
+		},
+		DevEui: "a84041fbd1889410",
+		Measurements: []decoder.Measurement{
+			{Type: "temperature", Value: 21.5},
+			{Type: "humidity", Value: 60},
+			{Type: "battery", Value: 3.1},
+		},
+	})
+
+	want := []string{
+		"lora,deviceEui=a84041fbd1889410,deviceName=lht52\\ hall,type=temperature value=21.5 1704164645000000000\n" +
+			"lora,deviceEui=a84041fbd1889410,deviceName=lht52\\ hall,type=humidity value=60 1704164645000000000",
+		"lora,deviceEui=a84041fbd1889410,deviceName=lht52\\ hall,type=battery value=3.1 1704164645000000000",
+	}
+	for i, want := range want {
+		select {
+		case got := <-bodies:
+			if got != want {
+				t.Errorf("batch %d: got\n%s\nwant\n%s", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("batch %d was not written", i)
+		}
+	}
+	// The points are counted once the reply is read, after the server saw them
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(w.metrics.pointsTotal) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v points, want 3", testutil.ToFloat64(w.metrics.pointsTotal))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestInfluxWriterRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantAttempts int32
+		wantPoints   float64
+		wantErrors   float64
+		wantDropped  float64
+	}{
+		{"success", []int{204}, 1, 2, 0, 0},
+		{"5xx retried", []int{503, 500, 204}, 3, 2, 2, 0},
+		{"429 retried", []int{429, 204}, 2, 2, 1, 0},
+		{"5xx until the last retry", []int{503, 503, 503, 503, 503}, 4, 0, 4, 2},
+		{"4xx permanent", []int{400, 204}, 1, 0, 1, 2},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				attempt := attempts.Add(1)
+				w.WriteHeader(test.statuses[attempt-1])
+			}))
+			defer server.Close()
+
+			w := newTestInfluxWriter(server.URL)
+			started := time.Now()
+			w.deliver([]string{"lora value=1 1", "lora value=2 2"})
+			elapsed := time.Since(started)
+
+			if got := attempts.Load(); got != test.wantAttempts {
+				t.Errorf("got %d attempts, want %d", got, test.wantAttempts)
+			}
+			// Backoff doubles from retryInitial and stops at retryMax
+			var wantBackoff time.Duration
+			for i := int32(1); i < test.wantAttempts; i++ {
+				backoff := w.retryInitial << (i - 1)
+				if backoff > w.retryMax {
+					backoff = w.retryMax
+				}
+				wantBackoff += backoff
+			}
+			if elapsed < wantBackoff {
+				t.Errorf("took %s, want at least %s of backoff", elapsed, wantBackoff)
+			}
+			if got := testutil.ToFloat64(w.metrics.pointsTotal); got != test.wantPoints {
+				t.Errorf("got %v points, want %v", got, test.wantPoints)
+			}
+			if got := testutil.ToFloat64(w.metrics.writeErrorTotal); got != test.wantErrors {
+				t.Errorf("got %v write errors, want %v", got, test.wantErrors)
+			}
+			if got := testutil.ToFloat64(w.metrics.droppedTotal); got != test.wantDropped {
+				t.Errorf("got %v dropped, want %v", got, test.wantDropped)
+			}
+		})
+	}
+}
+
+// TestInfluxWriterQuery checks the org, bucket and token reach influx
+func TestInfluxWriterQuery(t *testing.T) {
+	var query, auth string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, auth = r.URL.RawQuery, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := config
+	c.InfluxURL = server.URL + "/"
+	c.InfluxOrg = "home"
+	c.InfluxBucket = "lora"
+	c.InfluxToken = "secret"
+	w := newInfluxWriter(c, prometheus.NewRegistry())
+	w.deliver([]string{"lora value=1 1"})
+	for _, want := range []string{"org=home", "bucket=lora", "precision=ns"} {
+		if !strings.Contains(query, want) {
+			t.Errorf("query %q is missing %s", query, want)
+		}
+	}
+	if auth != "Token secret" {
+		t.Errorf("got Authorization %q", auth)
+	}
+}
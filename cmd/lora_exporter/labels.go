@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chirpstack/chirpstack/api/go/v4/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+)
+
+const (
+	labelPrefixTag      = "tag_"
+	labelPrefixVariable = "var_"
+)
+
+// updateDevice stores the chirpstack metadata of a device, updates its info
+// series and returns the labels for its metrics. firstTime is true if we did
+// not know the device before.
+func (r *deviceRegistry) updateDevice(info chirpstack.DeviceInfo) (labels prometheus.Labels, firstTime bool) {
+	devEui := info.DevEui
+	r.labelsMutex.Lock()
+	r.deviceInfos[devEui] = info
+	variables := r.deviceVariables[devEui]
+	r.labelsMutex.Unlock()
+
+	labels = newDeviceLabels(r.config, info, variables)
+	firstTime = r.setDeviceLabels(devEui, labels)
+	r.updateDeviceInfoMetric(info)
+	return labels, firstTime
+}
+
+// updateDeviceFromApi refreshes the device labels with the name, tags and
+// variables from chirpstack, and returns the labels to use for the device
+func (r *deviceRegistry) updateDeviceFromApi(devEui string, device *api.Device) prometheus.Labels {
+	r.labelsMutex.Lock()
+	info := r.deviceInfos[devEui]
+	r.deviceVariables[devEui] = device.GetVariables()
+	r.labelsMutex.Unlock()
+	info.DevEui = devEui
+	info.DeviceName = device.GetName()
+	info.Tags = device.GetTags()
+	labels, _ := r.updateDevice(info)
+	return labels
+}
+
+// updateDeviceInfoMetric sets lora_device_info, replacing the previous series
+// of the device if any of the metadata changed
+func (r *deviceRegistry) updateDeviceInfoMetric(info chirpstack.DeviceInfo) {
+	labels := prometheus.Labels{
+		"deviceName":        info.DeviceName,
+		"deviceEui":         info.DevEui,
+		"deviceClass":       info.DeviceClassEnabled,
+		"tenantId":          info.TenantID,
+		"tenantName":        info.TenantName,
+		"applicationId":     info.ApplicationID,
+		"applicationName":   info.ApplicationName,
+		"deviceProfileId":   info.DeviceProfileID,
+		"deviceProfileName": info.DeviceProfileName,
+	}
+	r.labelsMutex.Lock()
+	defer r.labelsMutex.Unlock()
+	if old, found := r.deviceInfoLabels[info.DevEui]; found && !equalLabels(old, labels) {
+		r.metrics.info.Delete(old)
+	}
+	r.deviceInfoLabels[info.DevEui] = labels
+	r.metrics.info.With(labels).Set(1)
+}
+
+// relabel switches to new device metrics after the label config changed. The
+// labels of every device are recomputed and lora_device_info is set again,
+// the other series come back with the next uplink.
+func (r *deviceRegistry) relabel(metrics *deviceMetrics) {
+	r.labelsMutex.Lock()
+	defer r.labelsMutex.Unlock()
+	r.metrics = metrics
+	for devEui := range r.labelsMap {
+		r.labelsMap[devEui] = newDeviceLabels(r.config, r.deviceInfos[devEui], r.deviceVariables[devEui])
+	}
+	for _, labels := range r.deviceInfoLabels {
+		metrics.info.With(labels).Set(1)
+	}
+}
+
+// deviceExtraLabelNames returns the label names of the tenant/application and
+// the allowed device tags and variables, these are added to every per device
+// metric
+func deviceExtraLabelNames(config EnvConfig) []string {
+	names := []string{}
+	seen := map[string]bool{}
+	add := func(prefix string, keys string) {
+		for _, key := range splitList(keys) {
+			name := prefix + sanitizeLabelName(key)
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	if config.MetricsApplicationLabels {
+		names = append(names, "tenantName", "applicationName")
+	}
+	add(labelPrefixTag, config.MetricsDeviceTags)
+	add(labelPrefixVariable, config.MetricsDeviceVariables)
+	return names
+}
+
+// checkDeviceLabelKeys returns an error for device tags or variables whose
+// keys sanitize to the same label name, eg site-a and site_a, as their values
+// would overwrite each other
+func checkDeviceLabelKeys(config EnvConfig) error {
+	var errs []error
+	check := func(setting string, prefix string, keys string) {
+		seen := map[string]string{}
+		for _, key := range splitList(keys) {
+			name := prefix + sanitizeLabelName(key)
+			if other, ok := seen[name]; ok && other != key {
+				errs = append(errs, fmt.Errorf("%s: %q and %q are both label %s", setting, other, key, name))
+				continue
+			}
+			seen[name] = key
+		}
+	}
+	check("METRICS_DEVICE_TAGS", labelPrefixTag, config.MetricsDeviceTags)
+	check("METRICS_DEVICE_VARIABLES", labelPrefixVariable, config.MetricsDeviceVariables)
+	return errors.Join(errs...)
+}
+
+// sanitizeLabelName replaces anything that is not valid in a prometheus label
+// name with an underscore
+func sanitizeLabelName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// newDeviceLabels builds the labels shared by every metric of a device. Allowed
+// tags/variables the device does not have are set to an empty string.
+func newDeviceLabels(config EnvConfig, info chirpstack.DeviceInfo, variables map[string]string) prometheus.Labels {
+	labels := prometheus.Labels{"deviceName": info.DeviceName, "deviceEui": info.DevEui}
+	if config.MetricsApplicationLabels {
+		labels["tenantName"] = info.TenantName
+		labels["applicationName"] = info.ApplicationName
+	}
+	for _, key := range splitList(config.MetricsDeviceTags) {
+		labels[labelPrefixTag+sanitizeLabelName(key)] = info.Tags[key]
+	}
+	for _, key := range splitList(config.MetricsDeviceVariables) {
+		labels[labelPrefixVariable+sanitizeLabelName(key)] = variables[key]
+	}
+	return labels
+}
+
+// setDeviceLabels stores the labels of a device and returns true if this is
+// the first time we see the device. If the labels changed (renamed device,
+// new tag value), the series with the old labels are removed.
+func (r *deviceRegistry) setDeviceLabels(devEui string, labels prometheus.Labels) bool {
+	r.labelsMutex.Lock()
+	defer r.labelsMutex.Unlock()
+	old, found := r.labelsMap[devEui]
+	if found && !equalLabels(old, labels) {
+		log.Info().Str("devEui", devEui).Msg("Device labels changed, removing old series")
+		r.metrics.deleteDevice(devEui)
+	}
+	r.labelsMap[devEui] = labels
+	return !found
+}
+
+// knownDevices returns the devEui of every device we got a webhook from
+func (r *deviceRegistry) knownDevices() []string {
+	r.labelsMutex.RLock()
+	defer r.labelsMutex.RUnlock()
+	devices := make([]string, 0, len(r.labelsMap))
+	for devEui := range r.labelsMap {
+		devices = append(devices, devEui)
+	}
+	return devices
+}
+
+// forgetDevice stops the gRPC lookups of a device until its next webhook. Its
+// metadata is kept, so its series stay in the scoped metrics after a failed
+// lookup.
+func (r *deviceRegistry) forgetDevice(devEui string) {
+	r.labelsMutex.Lock()
+	defer r.labelsMutex.Unlock()
+	delete(r.labelsMap, devEui)
+}
+
+// deviceInfo returns the chirpstack metadata of a device, false if we never
+// got it
+func (r *deviceRegistry) deviceInfo(devEui string) (chirpstack.DeviceInfo, bool) {
+	r.labelsMutex.RLock()
+	defer r.labelsMutex.RUnlock()
+	info, found := r.deviceInfos[devEui]
+	return info, found
+}
+
+// scopeDevices returns the devEui of every device in the tenant/application
+func (r *deviceRegistry) scopeDevices(scope string, id string) map[string]bool {
+	r.labelsMutex.RLock()
+	defer r.labelsMutex.RUnlock()
+	devices := map[string]bool{}
+	for devEui, info := range r.deviceInfos {
+		if (scope == scopeTenant && info.TenantID == id) || (scope == scopeApplication && info.ApplicationID == id) {
+			devices[devEui] = true
+		}
+	}
+	return devices
+}
+
+// mergeLabels returns a new set of labels with base and extra
+func mergeLabels(base prometheus.Labels, extra prometheus.Labels) prometheus.Labels {
+	labels := make(prometheus.Labels, len(base)+len(extra))
+	for k, v := range base {
+		labels[k] = v
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
+
+func equalLabels(a prometheus.Labels, b prometheus.Labels) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if bv, ok := b[k]; !ok || bv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits a comma separated config value, ignoring empty entries
+func splitList(s string) []string {
+	list := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
+	"os"
 	"runtime"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/caarlos0/env/v9"
 	"github.com/go-co-op/gocron"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -20,24 +20,116 @@ var (
 )
 
 type EnvConfig struct {
-	Interval   int    `env:"INTERVAL,required" envDefault:"300"`
-	DumpFolder string `env:"DUMP_FOLDER" envDefault:""`
-	Listen     string `env:"LISTEN,required" envDefault:"0.0.0.0:5672"`
-	Forward    string `env:"FORWARD" envDefault:""`
-	Debug      bool   `env:"DEBUG" envDefault:false`
-	ApiFile    string `env:"APIFILE" envDefault:"apikey.txt"`
-	ApiKey     string `env:"APIKEY"`
-	ApiServer  string `env:"APISERVER"`
-	AuthKey    string `env:"AUTHKEY"`
-	MetricsGeo bool   `env:"METRICS_GEO" envDefault:false`
+	Interval                 int    `env:"INTERVAL,required" envDefault:"300"`
+	DumpFolder               string `env:"DUMP_FOLDER" envDefault:""`
+	DumpCompress             bool   `env:"DUMP_COMPRESS" envDefault:"false"`
+	DumpRetentionDays        int    `env:"DUMP_RETENTION_DAYS" envDefault:"0"`
+	DumpMaxSizeMB            int    `env:"DUMP_MAX_SIZE_MB" envDefault:"0"`
+	DumpMaxPerDevice         int    `env:"DUMP_MAX_PER_DEVICE" envDefault:"0"`
+	Listen                   string `env:"LISTEN,required" envDefault:"0.0.0.0:5672"`
+	Forward                  string `env:"FORWARD" envDefault:""`
+	ForwardQueueSize         int    `env:"FORWARD_QUEUE_SIZE" envDefault:"1000"`
+	ForwardSpoolFolder       string `env:"FORWARD_SPOOL_FOLDER"`
+	ForwardDeadLetterFolder  string `env:"FORWARD_DEADLETTER_FOLDER"`
+	ForwardMaxRetries        int    `env:"FORWARD_MAX_RETRIES" envDefault:"8"`
+	ForwardRetryInitial      int    `env:"FORWARD_RETRY_INITIAL" envDefault:"1"`
+	ForwardRetryMax          int    `env:"FORWARD_RETRY_MAX" envDefault:"300"`
+	ForwardTimeout           int    `env:"FORWARD_TIMEOUT" envDefault:"10"`
+	ForwardRulesFile         string `env:"FORWARD_RULES_FILE"`
+	Debug                    bool   `env:"DEBUG" envDefault:"false"`
+	ApiFile                  string `env:"APIFILE" envDefault:"apikey.txt"`
+	ApiKey                   string `env:"APIKEY"`
+	ApiServer                string `env:"APISERVER"`
+	AuthKey                  string `env:"AUTHKEY"`
+	MetricsGeohashPrecision  int    `env:"METRICS_GEOHASH_PRECISION" envDefault:"0"`
+	GeofenceFile             string `env:"GEOFENCE_FILE"`
+	GeofenceForward          bool   `env:"GEOFENCE_FORWARD" envDefault:"false"`
+	DeviceLocations          string `env:"DEVICE_LOCATIONS"`
+	MetricsDeviceTags        string `env:"METRICS_DEVICE_TAGS"`
+	MetricsDeviceVariables   string `env:"METRICS_DEVICE_VARIABLES"`
+	MetricsApplicationLabels bool   `env:"METRICS_APPLICATION_LABELS" envDefault:"false"`
+	TenantTokens             string `env:"TENANT_TOKENS"`
+	ApplicationTokens        string `env:"APPLICATION_TOKENS"`
+	MqttBroker               string `env:"MQTT_BROKER"`
+	MqttUsername             string `env:"MQTT_USERNAME"`
+	MqttPassword             string `env:"MQTT_PASSWORD"`
+	MqttClientID             string `env:"MQTT_CLIENT_ID" envDefault:"lora_exporter"`
+	MqttTopicPrefix          string `env:"MQTT_TOPIC_PREFIX" envDefault:"lora_exporter"`
+	MqttDiscovery            bool   `env:"MQTT_DISCOVERY" envDefault:"true"`
+	MqttDiscoveryPrefix      string `env:"MQTT_DISCOVERY_PREFIX" envDefault:"homeassistant"`
+	InfluxURL                string `env:"INFLUX_URL"`
+	InfluxToken              string `env:"INFLUX_TOKEN"`
+	InfluxOrg                string `env:"INFLUX_ORG"`
+	InfluxBucket             string `env:"INFLUX_BUCKET" envDefault:"lora"`
+	InfluxMeasurement        string `env:"INFLUX_MEASUREMENT" envDefault:"lora_device_metric"`
+	InfluxQueueSize          int    `env:"INFLUX_QUEUE_SIZE" envDefault:"10000"`
+	InfluxBatchSize          int    `env:"INFLUX_BATCH_SIZE" envDefault:"1000"`
+	InfluxFlushInterval      int    `env:"INFLUX_FLUSH_INTERVAL" envDefault:"10"`
+	InfluxMaxRetries         int    `env:"INFLUX_MAX_RETRIES" envDefault:"8"`
+	InfluxRetryInitial       int    `env:"INFLUX_RETRY_INITIAL" envDefault:"1"`
+	InfluxRetryMax           int    `env:"INFLUX_RETRY_MAX" envDefault:"300"`
+	InfluxTimeout            int    `env:"INFLUX_TIMEOUT" envDefault:"10"`
+	RemoteWriteURL           string `env:"REMOTE_WRITE_URL"`
+	RemoteWriteUsername      string `env:"REMOTE_WRITE_USERNAME"`
+	RemoteWritePassword      string `env:"REMOTE_WRITE_PASSWORD"`
+	RemoteWriteBearerToken   string `env:"REMOTE_WRITE_BEARER_TOKEN"`
+	RemoteWriteQueueSize     int    `env:"REMOTE_WRITE_QUEUE_SIZE" envDefault:"10000"`
+	RemoteWriteBatchSize     int    `env:"REMOTE_WRITE_BATCH_SIZE" envDefault:"500"`
+	RemoteWriteFlushInterval int    `env:"REMOTE_WRITE_FLUSH_INTERVAL" envDefault:"5"`
+	RemoteWriteMaxRetries    int    `env:"REMOTE_WRITE_MAX_RETRIES" envDefault:"8"`
+	RemoteWriteRetryInitial  int    `env:"REMOTE_WRITE_RETRY_INITIAL" envDefault:"1"`
+	RemoteWriteRetryMax      int    `env:"REMOTE_WRITE_RETRY_MAX" envDefault:"300"`
+	RemoteWriteTimeout       int    `env:"REMOTE_WRITE_TIMEOUT" envDefault:"30"`
+	OtlpEndpoint             string `env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OtlpProtocol             string `env:"OTEL_EXPORTER_OTLP_PROTOCOL" envDefault:"grpc"`
+	OtlpHeaders              string `env:"OTEL_EXPORTER_OTLP_HEADERS"`
+	OtlpTimeout              int    `env:"OTEL_EXPORTER_OTLP_TIMEOUT" envDefault:"10000"`
+	OtlpServiceName          string `env:"OTEL_SERVICE_NAME" envDefault:"lora_exporter"`
+	OtlpMetricsExporter      string `env:"OTEL_METRICS_EXPORTER" envDefault:"otlp"`
+	OtlpTracesExporter       string `env:"OTEL_TRACES_EXPORTER" envDefault:"otlp"`
+	OtlpMetricInterval       int    `env:"OTEL_METRIC_EXPORT_INTERVAL" envDefault:"60000"`
+	HistoryFile              string `env:"HISTORY_FILE"`
+	HistoryRetentionDays     int    `env:"HISTORY_RETENTION_DAYS" envDefault:"30"`
+	HistoryMaxPoints         int    `env:"HISTORY_MAX_POINTS" envDefault:"0"`
+	HistoryQueryLimit        int    `env:"HISTORY_QUERY_LIMIT" envDefault:"100000"`
+	DeviceStaleAfter         int    `env:"DEVICE_STALE_AFTER" envDefault:"7200"`
+	StreamBufferSize         int    `env:"STREAM_BUFFER_SIZE" envDefault:"100"`
+	StreamMaxClients         int    `env:"STREAM_MAX_CLIENTS" envDefault:"50"`
+	ConfigFile               string `env:"CONFIG_FILE"`
+	ConfigReloadInterval     int    `env:"CONFIG_RELOAD_INTERVAL" envDefault:"10"`
+	// ForwardRules and Devices are sections of the config file, there is no env var
+	ForwardRules []*ForwardRule
+	Devices      map[string]*DeviceSettings
 }
 
 var config EnvConfig
-var backgroundChannel chan []byte
 
 func main() {
-	if err := env.Parse(&config); err != nil {
-		log.Error().Err(err).Msg("Failed to parse env configuration")
+	var err error
+	config, err = readConfig()
+	if len(os.Args) > 1 {
+		var command func([]string) int
+		switch os.Args[1] {
+		case "replay":
+			command = replayCommand
+		case "decode":
+			command = decodeCommand
+		case "simulate":
+			command = simulateCommand
+		}
+		// The subcommands don't run the server, so its settings are not validated
+		if command != nil {
+			if err != nil {
+				log.Error().Err(err).Msg("Failed to read configuration")
+			}
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	if err == nil {
+		err = config.validate()
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
 	}
 	cron := gocron.NewScheduler(time.UTC)
 
@@ -63,21 +155,39 @@ func main() {
 	// log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
 	log.Info().Int("interval", config.Interval).Str("buildVersion", BuildVersion).Str("buildTime", BuildTime).Str("buildBranch", BuildBranch).Str("buildRevision", BuildRevision).Msg("loraExporter started")
 
-	initMetrics()
-	if len(config.Forward) > 0 {
-		backgroundChannel = make(chan []byte)
-		startForwardServer()
-		for _, url := range strings.Split(config.Forward, ",") {
-			log.Info().Msgf("Will forward webhooks to %s", url)
-		}
+	// METRICS_GEO and lora_devices_metric_geo are gone, the location is
+	// always exported as gauges of its own
+	if _, found := os.LookupEnv("METRICS_GEO"); found {
+		log.Warn().Msg("METRICS_GEO is no longer used, lora_devices_metric_geo is replaced by lora_devices_latitude_degrees, lora_devices_longitude_degrees, lora_devices_altitude_meters and lora_devices_location_accuracy_meters")
+	}
+
+	buildInfo.Set(1)
+	exporter, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create exporter")
+	}
+	if err := exporter.Start(); err != nil {
+		log.Fatal().Err(err).Msg("Failed to start exporter")
+	}
+	if len(config.DumpFolder) > 0 {
+		cron.Every(5).Minutes().SingletonMode().Do(exporter.pruneDumps)
+	}
+	if len(config.HistoryFile) > 0 {
+		cron.Every(1).Hour().SingletonMode().Do(exporter.history.prune)
 	}
 	if len(config.ApiServer) > 0 {
 		log.Info().Msgf("Will query %0s every %0ds", config.ApiServer, config.Interval)
-		cron.Every(config.Interval).Seconds().SingletonMode().Do(getDeviceStatus)
+		cron.Every(config.Interval).Seconds().SingletonMode().Do(exporter.getDeviceStatus)
 	} else {
 		log.Info().Msg("No APISERVER defined. Will not query Chirpstack for device status")
 	}
-	startHttpServer()
+	watcher := newConfigWatcher(exporter)
+	go watcher.watchSignals()
+	if files := exporter.watchedFiles(); len(files) > 0 && config.ConfigReloadInterval > 0 {
+		log.Info().Strs("files", files).Msgf("Will check the config files every %ds", config.ConfigReloadInterval)
+		cron.Every(config.ConfigReloadInterval).Seconds().SingletonMode().Do(watcher.checkFiles)
+	}
+	startHttpServer(exporter)
 	cron.StartBlocking()
 }
 
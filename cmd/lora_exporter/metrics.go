@@ -2,9 +2,11 @@ package main
 
 import (
 	"runtime"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	dto "github.com/prometheus/client_model/go"
 )
 
 const (
@@ -12,129 +14,555 @@ const (
 )
 
 var (
-	labelsMap = map[string]prometheus.Labels{}
-
-	labelsDeviceGateway   = []string{"gatewayId", "deviceName", "deviceEui"}
-	labelsDevice          = []string{"deviceName", "deviceEui"}
-	labelsDeviceMsgLevel  = []string{"deviceName", "deviceEui", "level", "code"}
-	labelsDeviceMetric    = []string{"deviceName", "deviceEui", "type"}
-	labelsDeviceMetricGeo = []string{"deviceName", "deviceEui", "type", "lat", "lon"}
-	labelsForward         = []string{"url"}
-	labelsWebhook         = []string{"ip"}
-
-	webhookConnectionTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: metricsPrefix + "_webhook_total",
-		Help: "The total number of connections (Includes errors)",
-	}, labelsWebhook)
-	webhookConnectionErrorTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: metricsPrefix + "_webhook_error_total",
-		Help: "The total number of errors",
-	}, labelsWebhook)
-
-	forwardConnectionSuccessTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: metricsPrefix + "_forward_total",
-		Help: "The total number of successful forwarded webhooks",
-	}, labelsForward)
-	forwardConnectionErrorTotal = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: metricsPrefix + "_forward_error_total",
-		Help: "The total number of forwarded webhooks errors",
-	}, labelsForward)
-
-	grpcConnectionTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: metricsPrefix + "_grpc_connection_total",
-		Help: "The total number of connections",
-	})
-	grpcConnectionErrorTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: metricsPrefix + "_grpc_connection_error_total",
-		Help: "The total number of errors",
-	})
-	grpcApiTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: metricsPrefix + "_grpc_api_total",
-		Help: "The total number of grpc api calls",
-	})
-	grpcApiErrorTotal = promauto.NewCounter(prometheus.CounterOpts{
-		Name: metricsPrefix + "_grpc_api_error_total",
-		Help: "The total number of errors for grpc api calls",
-	})
-
-	deviceFcnt = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	labelsDeviceGateway  = []string{"gatewayId", "deviceName", "deviceEui"}
+	labelsDevice         = []string{"deviceName", "deviceEui"}
+	labelsDeviceInfo     = []string{"deviceName", "deviceEui", "deviceClass", "tenantId", "tenantName", "applicationId", "applicationName", "deviceProfileId", "deviceProfileName"}
+	labelsDeviceMsgLevel = []string{"deviceName", "deviceEui", "level", "code"}
+	labelsDeviceMetric   = []string{"deviceName", "deviceEui", "type"}
+	labelsDeviceZone     = []string{"deviceName", "deviceEui", "zone"}
+	labelsForward        = []string{"url"}
+	labelsWebhook        = []string{"ip"}
+	labelsOtlp           = []string{"signal"}
+
+	// The webhook pipeline and output metrics belong to an Exporter
+	// (newExporterMetrics and friends), only the build info is process wide
+	buildInfo = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "build_info",
+			Help: "A metric with a constant '1' value labeled by goversion used to build the binary.",
+			ConstLabels: map[string]string{
+				"appname":       "loraExporter",
+				"buildVersion":  BuildVersion,
+				"buildTime":     BuildTime,
+				"buildBranch":   BuildBranch,
+				"buildRevision": BuildRevision,
+
+				"goversion": runtime.Version(),
+			},
+		},
+	)
+)
+
+// exporterMetrics are the webhook and chirpstack api metrics of an Exporter
+type exporterMetrics struct {
+	webhookConnectionTotal      *prometheus.CounterVec
+	webhookConnectionErrorTotal *prometheus.CounterVec
+	grpcConnectionTotal         prometheus.Counter
+	grpcConnectionErrorTotal    prometheus.Counter
+	grpcApiTotal                prometheus.Counter
+	grpcApiErrorTotal           prometheus.Counter
+}
+
+func newExporterMetrics(reg prometheus.Registerer) *exporterMetrics {
+	factory := promauto.With(reg)
+	return &exporterMetrics{
+		webhookConnectionTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_webhook_total",
+			Help: "The total number of connections (Includes errors)",
+		}, labelsWebhook),
+		webhookConnectionErrorTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_webhook_error_total",
+			Help: "The total number of errors",
+		}, labelsWebhook),
+		grpcConnectionTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_grpc_connection_total",
+			Help: "The total number of connections",
+		}),
+		grpcConnectionErrorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_grpc_connection_error_total",
+			Help: "The total number of errors",
+		}),
+		grpcApiTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_grpc_api_total",
+			Help: "The total number of grpc api calls",
+		}),
+		grpcApiErrorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_grpc_api_error_total",
+			Help: "The total number of errors for grpc api calls",
+		}),
+	}
+}
+
+// forwardMetrics are the metrics of the forward destinations, by url
+type forwardMetrics struct {
+	successTotal    *prometheus.CounterVec
+	errorTotal      *prometheus.CounterVec
+	filteredTotal   *prometheus.CounterVec
+	retryTotal      *prometheus.CounterVec
+	droppedTotal    *prometheus.CounterVec
+	deadLetterTotal *prometheus.CounterVec
+	queueDepth      *prometheus.GaugeVec
+	queueAge        *prometheus.GaugeVec
+	latency         *prometheus.HistogramVec
+}
+
+func newForwardMetrics(reg prometheus.Registerer) *forwardMetrics {
+	factory := promauto.With(reg)
+	return &forwardMetrics{
+		successTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_forward_total",
+			Help: "The total number of successful forwarded webhooks",
+		}, labelsForward),
+		errorTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_forward_error_total",
+			Help: "The total number of forwarded webhooks errors",
+		}, labelsForward),
+		filteredTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_forward_filtered_total",
+			Help: "The total number of webhooks not forwarded because of the forward rule filters",
+		}, labelsForward),
+		retryTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_forward_retry_total",
+			Help: "The total number of forward retries",
+		}, labelsForward),
+		droppedTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_forward_dropped_total",
+			Help: "The total number of webhooks dropped because the forward queue was full",
+		}, labelsForward),
+		deadLetterTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_forward_deadletter_total",
+			Help: "The total number of webhooks given up on (dropped or out of retries)",
+		}, labelsForward),
+		queueDepth: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_forward_queue_depth",
+			Help: "Number of webhooks waiting to be forwarded",
+		}, labelsForward),
+		queueAge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_forward_queue_age_seconds",
+			Help: "Age of the webhook currently being forwarded, 0 when the queue is empty",
+		}, labelsForward),
+		latency: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    metricsPrefix + "_forward_request_duration_seconds",
+			Help:    "Time taken by forward requests",
+			Buckets: prometheus.DefBuckets,
+		}, labelsForward),
+	}
+}
+
+// mqttMetrics are the metrics of the mqtt publisher
+type mqttMetrics struct {
+	publishTotal      prometheus.Counter
+	publishErrorTotal prometheus.Counter
+	connected         prometheus.Gauge
+}
+
+func newMqttMetrics(reg prometheus.Registerer) *mqttMetrics {
+	factory := promauto.With(reg)
+	return &mqttMetrics{
+		publishTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_mqtt_publish_total",
+			Help: "The total number of mqtt messages published (Includes errors)",
+		}),
+		publishErrorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_mqtt_publish_error_total",
+			Help: "The total number of mqtt messages that failed to publish",
+		}),
+		connected: factory.NewGauge(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_mqtt_connected",
+			Help: "1 if connected to the mqtt broker",
+		}),
+	}
+}
+
+// influxMetrics are the metrics of the influxdb writer
+type influxMetrics struct {
+	writeTotal      prometheus.Counter
+	writeErrorTotal prometheus.Counter
+	pointsTotal     prometheus.Counter
+	droppedTotal    prometheus.Counter
+}
+
+func newInfluxMetrics(reg prometheus.Registerer) *influxMetrics {
+	factory := promauto.With(reg)
+	return &influxMetrics{
+		writeTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_influx_write_total",
+			Help: "The total number of influxdb write requests (Includes errors)",
+		}),
+		writeErrorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_influx_write_error_total",
+			Help: "The total number of failed influxdb write requests",
+		}),
+		pointsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_influx_points_total",
+			Help: "The total number of points written to influxdb",
+		}),
+		droppedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_influx_dropped_total",
+			Help: "The total number of points dropped (queue full or out of retries)",
+		}),
+	}
+}
+
+// remoteWriteMetrics are the metrics of the remote write client
+type remoteWriteMetrics struct {
+	total        prometheus.Counter
+	errorTotal   prometheus.Counter
+	retryTotal   prometheus.Counter
+	samplesTotal prometheus.Counter
+	droppedTotal prometheus.Counter
+	queueDepth   prometheus.Gauge
+	latency      prometheus.Histogram
+}
+
+func newRemoteWriteMetrics(reg prometheus.Registerer) *remoteWriteMetrics {
+	factory := promauto.With(reg)
+	return &remoteWriteMetrics{
+		total: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_remote_write_total",
+			Help: "The total number of remote write requests (Includes errors)",
+		}),
+		errorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_remote_write_error_total",
+			Help: "The total number of failed remote write requests",
+		}),
+		retryTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_remote_write_retry_total",
+			Help: "The total number of remote write retries",
+		}),
+		samplesTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_remote_write_samples_total",
+			Help: "The total number of samples pushed with remote write",
+		}),
+		droppedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_remote_write_dropped_total",
+			Help: "The total number of samples dropped (queue full, rejected or out of retries)",
+		}),
+		queueDepth: factory.NewGauge(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_remote_write_queue_depth",
+			Help: "Number of samples waiting to be pushed",
+		}),
+		latency: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    metricsPrefix + "_remote_write_request_duration_seconds",
+			Help:    "Time taken by remote write requests",
+			Buckets: prometheus.DefBuckets,
+		}),
+	}
+}
+
+// otlpMetrics are the metrics of the otlp metrics and traces exporter
+type otlpMetrics struct {
+	exportTotal       *prometheus.CounterVec
+	exportErrorTotal  *prometheus.CounterVec
+	spansDroppedTotal prometheus.Counter
+}
+
+func newOtlpMetrics(reg prometheus.Registerer) *otlpMetrics {
+	factory := promauto.With(reg)
+	return &otlpMetrics{
+		exportTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_otlp_export_total",
+			Help: "The total number of otlp export requests (Includes errors)",
+		}, labelsOtlp),
+		exportErrorTotal: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: metricsPrefix + "_otlp_export_error_total",
+			Help: "The total number of failed otlp export requests",
+		}, labelsOtlp),
+		spansDroppedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_otlp_spans_dropped_total",
+			Help: "The total number of spans dropped (queue full or failed export)",
+		}),
+	}
+}
+
+// historyMetrics are the metrics of the measurement history
+type historyMetrics struct {
+	pointsTotal     prometheus.Counter
+	writeErrorTotal prometheus.Counter
+	prunedTotal     prometheus.Counter
+}
+
+func newHistoryMetrics(reg prometheus.Registerer) *historyMetrics {
+	factory := promauto.With(reg)
+	return &historyMetrics{
+		pointsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_history_points_total",
+			Help: "The total number of measurements stored in the history",
+		}),
+		writeErrorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_history_write_error_total",
+			Help: "The total number of uplinks that failed to be stored in the history",
+		}),
+		prunedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_history_pruned_total",
+			Help: "The total number of measurements removed from the history by retention",
+		}),
+	}
+}
+
+// streamMetrics are the metrics of the live stream
+type streamMetrics struct {
+	clients      prometheus.Gauge
+	eventsTotal  prometheus.Counter
+	droppedTotal prometheus.Counter
+}
+
+func newStreamMetrics(reg prometheus.Registerer) *streamMetrics {
+	factory := promauto.With(reg)
+	return &streamMetrics{
+		clients: factory.NewGauge(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_stream_clients",
+			Help: "The number of connected /api/v1/stream clients",
+		}),
+		eventsTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_stream_events_total",
+			Help: "The total number of events sent to stream clients",
+		}),
+		droppedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_stream_dropped_total",
+			Help: "The total number of events dropped because a stream client was too slow",
+		}),
+	}
+}
+
+// dumpMetrics are the metrics of the webhook dumps
+type dumpMetrics struct {
+	writtenTotal prometheus.Counter
+	errorTotal   prometheus.Counter
+	prunedTotal  prometheus.Counter
+	bytes        prometheus.Gauge
+	files        prometheus.Gauge
+}
+
+func newDumpMetrics(reg prometheus.Registerer) *dumpMetrics {
+	factory := promauto.With(reg)
+	return &dumpMetrics{
+		writtenTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_dump_written_total",
+			Help: "The total number of webhook dumps written",
+		}),
+		errorTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_dump_error_total",
+			Help: "The total number of errors writing, listing or removing dumps",
+		}),
+		prunedTotal: factory.NewCounter(prometheus.CounterOpts{
+			Name: metricsPrefix + "_dump_pruned_total",
+			Help: "The total number of dumps removed by retention",
+		}),
+		bytes: factory.NewGauge(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_dump_bytes",
+			Help: "The size of the dumps on disk",
+		}),
+		files: factory.NewGauge(prometheus.GaugeOpts{
+			Name: metricsPrefix + "_dump_files",
+			Help: "The number of dumps on disk",
+		}),
+	}
+}
+
+// deviceMetrics are the per device metrics, their labels depend on config
+type deviceMetrics struct {
+	info               *prometheus.GaugeVec
+	fcnt               *prometheus.GaugeVec
+	unconfirmed        *prometheus.CounterVec
+	confirmed          *prometheus.CounterVec
+	msgLevelCount      *prometheus.CounterVec
+	battery            *prometheus.GaugeVec
+	externalPower      *prometheus.GaugeVec
+	metric             *prometheus.GaugeVec
+	latitude           *prometheus.GaugeVec
+	longitude          *prometheus.GaugeVec
+	altitude           *prometheus.GaugeVec
+	accuracy           *prometheus.GaugeVec
+	geofenceInfo       *prometheus.GaugeVec
+	geofenceEnterTotal *prometheus.CounterVec
+	geofenceExitTotal  *prometheus.CounterVec
+	geofenceSeconds    *prometheus.CounterVec
+	lastseen           *prometheus.GaugeVec
+	rxInfoRssi         *prometheus.GaugeVec
+	rxInfoSnr          *prometheus.GaugeVec
+	gatewayDistance    *prometheus.GaugeVec
+	vecs               []*prometheus.MetricVec
+}
+
+// newDeviceMetrics creates the per device metrics, every one of them gets the
+// extra device labels (allowed tags/variables) on top of its own labels. They
+// are registered through a deviceCollector.
+func newDeviceMetrics(config EnvConfig) *deviceMetrics {
+	extra := deviceExtraLabelNames(config)
+	withExtra := func(labels []string) []string {
+		return append(append([]string{}, labels...), extra...)
+	}
+	m := &deviceMetrics{}
+	m.info = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_device_info",
+		Help: "Chirpstack tenant, application and device profile of device",
+	}, labelsDeviceInfo,
+	)
+	m.fcnt = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_fcnt",
 		Help: "Frame Count of device",
-	}, labelsDevice,
+	}, withExtra(labelsDevice),
 	)
-
-	deviceUnconfirmed = promauto.NewCounterVec(prometheus.CounterOpts{
+	m.unconfirmed = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: metricsPrefix + "_devices_unconfirmed_count",
 		Help: "unconfirmed count",
-	}, labelsDevice,
+	}, withExtra(labelsDevice),
 	)
-	deviceConfirmed = promauto.NewCounterVec(prometheus.CounterOpts{
+	m.confirmed = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: metricsPrefix + "_devices_confirmed_count",
 		Help: "confirmed count",
-	}, labelsDevice,
+	}, withExtra(labelsDevice),
 	)
-	deviceMsgLevelCount = promauto.NewCounterVec(prometheus.CounterOpts{
+	m.msgLevelCount = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: metricsPrefix + "_devices_msg_level_count",
 		Help: "device msg level/type count",
-	}, labelsDeviceMsgLevel,
+	}, withExtra(labelsDeviceMsgLevel),
 	)
-	deviceBattery = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m.battery = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_battery_percent",
 		Help: "Battery level of device",
-	}, labelsDevice,
+	}, withExtra(labelsDevice),
 	)
-	deviceExternalPower = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m.externalPower = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_externalpower",
 		Help: "External powersource of device",
-	}, labelsDevice,
+	}, withExtra(labelsDevice),
 	)
-
-	deviceMetric = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m.metric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_metric",
 		Help: "metric value of device",
-	}, labelsDeviceMetric,
+	}, withExtra(labelsDeviceMetric),
 	)
-
-	deviceMetricGeo = promauto.NewGaugeVec(prometheus.GaugeOpts{
-		Name: metricsPrefix + "_devices_metric_geo",
-		Help: "metric value of device",
-	}, labelsDeviceMetricGeo,
+	labelsDeviceGeo := labelsDevice
+	if config.MetricsGeohashPrecision > 0 {
+		labelsDeviceGeo = append(append([]string{}, labelsDevice...), "geohash")
+	}
+	m.latitude = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_devices_latitude_degrees",
+		Help: "Last reported latitude of device",
+	}, withExtra(labelsDeviceGeo),
 	)
-
-	deviceLastseen = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m.longitude = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_devices_longitude_degrees",
+		Help: "Last reported longitude of device",
+	}, withExtra(labelsDeviceGeo),
+	)
+	m.altitude = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_devices_altitude_meters",
+		Help: "Last reported altitude of device",
+	}, withExtra(labelsDeviceGeo),
+	)
+	m.accuracy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_devices_location_accuracy_meters",
+		Help: "Accuracy of the last reported location of device",
+	}, withExtra(labelsDeviceGeo),
+	)
+	m.geofenceInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_devices_geofence_zone_info",
+		Help: "Geofence zone the device is currently in",
+	}, withExtra(labelsDeviceZone),
+	)
+	m.geofenceEnterTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_devices_geofence_enter_total",
+		Help: "The total number of times the device entered the zone",
+	}, withExtra(labelsDeviceZone),
+	)
+	m.geofenceExitTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_devices_geofence_exit_total",
+		Help: "The total number of times the device exited the zone",
+	}, withExtra(labelsDeviceZone),
+	)
+	m.geofenceSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: metricsPrefix + "_devices_geofence_seconds_total",
+		Help: "Time the device spent in the zone, counted between location fixes",
+	}, withExtra(labelsDeviceZone),
+	)
+	m.lastseen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_lastseen",
 		Help: "last seen value of device",
-	}, labelsDeviceGateway,
+	}, withExtra(labelsDeviceGateway),
 	)
-	deviceRxInfoRssi = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m.rxInfoRssi = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_rxinfo_rssi_db",
 		Help: "RSSI of RX from device",
-	}, labelsDeviceGateway,
+	}, withExtra(labelsDeviceGateway),
 	)
-	deviceRxInfoSnr = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	m.rxInfoSnr = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: metricsPrefix + "_devices_rxinfo_snr_db",
 		Help: "SNR of RX from device",
-	}, labelsDeviceGateway,
+	}, withExtra(labelsDeviceGateway),
+	)
+	m.gatewayDistance = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: metricsPrefix + "_devices_gateway_distance_meters",
+		Help: "Estimated distance between device and gateway",
+	}, withExtra(labelsDeviceGateway),
 	)
 
-	buildInfo = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "build_info",
-			Help: "A metric with a constant '1' value labeled by goversion used to build the binary.",
-			ConstLabels: map[string]string{
-				"appname":       "loraExporter",
-				"buildVersion":  BuildVersion,
-				"buildTime":     BuildTime,
-				"buildBranch":   BuildBranch,
-				"buildRevision": BuildRevision,
+	m.vecs = []*prometheus.MetricVec{
+		m.info.MetricVec,
+		m.fcnt.MetricVec,
+		m.unconfirmed.MetricVec,
+		m.confirmed.MetricVec,
+		m.msgLevelCount.MetricVec,
+		m.battery.MetricVec,
+		m.externalPower.MetricVec,
+		m.metric.MetricVec,
+		m.geofenceInfo.MetricVec,
+		m.geofenceEnterTotal.MetricVec,
+		m.geofenceExitTotal.MetricVec,
+		m.geofenceSeconds.MetricVec,
+		m.lastseen.MetricVec,
+		m.rxInfoRssi.MetricVec,
+		m.rxInfoSnr.MetricVec,
+		m.gatewayDistance.MetricVec,
+		m.latitude.MetricVec,
+		m.longitude.MetricVec,
+		m.altitude.MetricVec,
+		m.accuracy.MetricVec,
+	}
+	return m
+}
 
-				"goversion": runtime.Version(),
-			},
-		},
-	)
-)
+// deleteDevice removes every per device series of devEui
+func (m *deviceMetrics) deleteDevice(devEui string) {
+	for _, vec := range m.vecs {
+		vec.DeletePartialMatch(prometheus.Labels{"deviceEui": devEui})
+	}
+}
+
+// deviceCollector collects the current per device metrics. It describes
+// nothing, so the registry does not hold on to the label names and Reload can
+// swap in metrics with other ones.
+type deviceCollector struct {
+	mutex   sync.RWMutex
+	metrics *deviceMetrics
+}
+
+func (c *deviceCollector) Describe(ch chan<- *prometheus.Desc) {}
+
+func (c *deviceCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	metrics := c.metrics
+	c.mutex.RUnlock()
+	for _, vec := range metrics.vecs {
+		vec.Collect(ch)
+	}
+}
+
+func (c *deviceCollector) setMetrics(metrics *deviceMetrics) {
+	c.mutex.Lock()
+	c.metrics = metrics
+	c.mutex.Unlock()
+}
 
-func initMetrics() {
-	buildInfo.Set(1)
-	labelsMap = make(map[string]prometheus.Labels)
+// deviceFamilies returns the series with a deviceEui label, leaving out the
+// exporter internals
+func deviceFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	filtered := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		var metrics []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "deviceEui" {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if len(metrics) > 0 {
+			filtered = append(filtered, &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: metrics})
+		}
+	}
+	return filtered
 }
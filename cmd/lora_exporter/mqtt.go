@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+const (
+	mqttQueueSize = 1000
+	mqttTimeout   = 10 * time.Second
+)
+
+// mqttPublisher publishes the measurements of every uplink to an mqtt
+// broker, with home assistant discovery configs
+type mqttPublisher struct {
+	config  EnvConfig
+	metrics *mqttMetrics
+	client  mqtt.Client
+	queue   chan *Uplink
+
+	mutex      sync.Mutex
+	discovered map[string]bool // devEui/type with a discovery config published since connecting
+	devices    map[string]*Uplink
+}
+
+func newMqttPublisher(config EnvConfig, reg prometheus.Registerer) *mqttPublisher {
+	return &mqttPublisher{
+		config:     config,
+		metrics:    newMqttMetrics(reg),
+		discovered: map[string]bool{},
+		devices:    map[string]*Uplink{},
+	}
+}
+
+// mqttDiscoveryConfig is a home assistant mqtt discovery config, see
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+type mqttDiscoveryConfig struct {
+	Name              string              `json:"name"`
+	UniqueID          string              `json:"unique_id"`
+	StateTopic        string              `json:"state_topic"`
+	AvailabilityTopic string              `json:"availability_topic"`
+	ValueTemplate     string              `json:"value_template"`
+	DeviceClass       string              `json:"device_class,omitempty"`
+	Unit              string              `json:"unit_of_measurement,omitempty"`
+	StateClass        string              `json:"state_class,omitempty"`
+	EntityCategory    string              `json:"entity_category,omitempty"`
+	PayloadOn         string              `json:"payload_on,omitempty"`
+	PayloadOff        string              `json:"payload_off,omitempty"`
+	Device            mqttDiscoveryDevice `json:"device"`
+}
+
+type mqttDiscoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer,omitempty"`
+	Model        string   `json:"model,omitempty"`
+}
+
+func (p *mqttPublisher) start() {
+	opts := mqtt.NewClientOptions().
+		AddBroker(p.config.MqttBroker).
+		SetClientID(p.config.MqttClientID).
+		SetUsername(p.config.MqttUsername).
+		SetPassword(p.config.MqttPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.availabilityTopic(), "offline", 1, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(c mqtt.Client, err error) {
+			p.metrics.connected.Set(0)
+			log.Warn().Err(err).Str("broker", p.config.MqttBroker).Msg("Lost connection to mqtt broker")
+		})
+	p.client = mqtt.NewClient(opts)
+	p.queue = make(chan *Uplink, mqttQueueSize)
+	// With connect retry this only returns once connected, don't hold up startup
+	p.client.Connect()
+	go p.worker()
+	log.Info().Str("broker", p.config.MqttBroker).Bool("discovery", p.config.MqttDiscovery).Msg("Will publish measurements to mqtt")
+}
+
+// onConnect runs on every (re)connect. The broker may have lost the retained
+// discovery configs, so they get published again.
+func (p *mqttPublisher) onConnect(c mqtt.Client) {
+	p.metrics.connected.Set(1)
+	log.Info().Str("broker", p.config.MqttBroker).Msg("Connected to mqtt broker")
+	p.publish(p.availabilityTopic(), true, []byte("online"))
+	if !p.config.MqttDiscovery {
+		return
+	}
+	// Home assistant sends online to its status topic when it restarts
+	c.Subscribe(p.config.MqttDiscoveryPrefix+"/status", 0, func(c mqtt.Client, m mqtt.Message) {
+		if string(m.Payload()) == "online" {
+			log.Info().Msg("Home assistant came online, republishing discovery configs")
+			p.rediscover()
+		}
+	})
+	p.rediscover()
+}
+
+// rediscover forgets what was announced and queues the last uplink of every
+// device, so its discovery configs are published again
+func (p *mqttPublisher) rediscover() {
+	p.mutex.Lock()
+	p.discovered = map[string]bool{}
+	uplinks := make([]*Uplink, 0, len(p.devices))
+	for _, uplink := range p.devices {
+		uplinks = append(uplinks, uplink)
+	}
+	p.mutex.Unlock()
+	for _, uplink := range uplinks {
+		p.enqueue(uplink)
+	}
+}
+
+// enqueue queues the measurements of an uplink for publishing, it never
+// blocks
+func (p *mqttPublisher) enqueue(uplink *Uplink) {
+	select {
+	case p.queue <- uplink:
+	default:
+		p.metrics.publishErrorTotal.Inc()
+		log.Error().Str("devEui", uplink.DevEui).Msg("Mqtt queue full, dropping uplink")
+	}
+}
+
+func (p *mqttPublisher) worker() {
+	for uplink := range p.queue {
+		p.mutex.Lock()
+		p.devices[uplink.DevEui] = uplink
+		p.mutex.Unlock()
+		if p.config.MqttDiscovery {
+			p.publishDiscovery(uplink)
+		}
+		state, err := json.Marshal(mqttState(uplink))
+		if err != nil {
+			log.Error().Caller().Err(err).Str("devEui", uplink.DevEui).Msg("Failed to marshal mqtt state")
+			continue
+		}
+		p.publish(p.stateTopic(uplink.DevEui), false, state)
+	}
+}
+
+// mqttState is the state topic payload, the measurements by type plus the
+// radio details of the best gateway
+func mqttState(uplink *Uplink) map[string]interface{} {
+	state := map[string]interface{}{}
+	for metricType, value := range uplink.MeasurementMap() {
+		state[metricType] = value
+	}
+	if rssi, snr, found := bestRxInfo(uplink); found {
+		state["rssi"] = rssi
+		state["snr"] = snr
+	}
+	if !uplink.Time.IsZero() {
+		state["time"] = uplink.Time.UTC().Format(time.RFC3339)
+	}
+	return state
+}
+
+// bestRxInfo returns the rssi/snr of the gateway with the best signal
+func bestRxInfo(uplink *Uplink) (rssi int, snr float64, found bool) {
+	for _, rxinfo := range uplink.RxInfo() {
+		if !found || rxinfo.Rssi > rssi {
+			rssi, snr, found = rxinfo.Rssi, rxinfo.Snr, true
+		}
+	}
+	return rssi, snr, found
+}
+
+// publishDiscovery publishes a retained discovery config for every value of
+// the device we did not announce yet
+func (p *mqttPublisher) publishDiscovery(uplink *Uplink) {
+	for key := range mqttState(uplink) {
+		if key == "time" {
+			continue
+		}
+		id := uplink.DevEui + "/" + key
+		p.mutex.Lock()
+		discovered := p.discovered[id]
+		p.discovered[id] = true
+		p.mutex.Unlock()
+		if discovered {
+			continue
+		}
+		component, cfg := p.discovery(uplink, key)
+		b, err := json.Marshal(cfg)
+		if err != nil {
+			log.Error().Caller().Err(err).Str("devEui", uplink.DevEui).Msg("Failed to marshal mqtt discovery config")
+			continue
+		}
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", p.config.MqttDiscoveryPrefix, component, uplink.DevEui, key)
+		log.Debug().Str("topic", topic).Msg("Publishing mqtt discovery config")
+		p.publish(topic, true, b)
+	}
+}
+
+// discovery returns the home assistant component and discovery config for
+// one value of a device
+func (p *mqttPublisher) discovery(uplink *Uplink, key string) (string, mqttDiscoveryConfig) {
+	info := uplink.DeviceInfo
+	name := info.DeviceName
+	if len(name) == 0 {
+		name = uplink.DevEui
+	}
+	cfg := mqttDiscoveryConfig{
+		Name:              measurementTypeName(key),
+		UniqueID:          "lora_" + uplink.DevEui + "_" + key,
+		StateTopic:        p.stateTopic(uplink.DevEui),
+		AvailabilityTopic: p.availabilityTopic(),
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", key),
+		StateClass:        "measurement",
+		Device: mqttDiscoveryDevice{
+			Identifiers:  []string{"lora_" + uplink.DevEui},
+			Name:         name,
+			Manufacturer: decoder.Vendor(uplink.DevEui),
+			Model:        info.DeviceProfileName,
+		},
+	}
+	switch key {
+	case "rssi":
+		cfg.Name, cfg.DeviceClass, cfg.Unit, cfg.EntityCategory = "RSSI", "signal_strength", "dBm", "diagnostic"
+		return "sensor", cfg
+	case "snr":
+		cfg.Name, cfg.Unit, cfg.EntityCategory = "SNR", "dB", "diagnostic"
+		return "sensor", cfg
+	}
+	mt := decoder.Types[key]
+	cfg.DeviceClass = mt.DeviceClass
+	if mt.Binary {
+		cfg.StateClass = ""
+		cfg.ValueTemplate = fmt.Sprintf("{{ 'ON' if value_json.%s | float(0) > 0 else 'OFF' }}", key)
+		cfg.PayloadOn, cfg.PayloadOff = "ON", "OFF"
+		return "binary_sensor", cfg
+	}
+	cfg.Unit = mt.Unit
+	return "sensor", cfg
+}
+
+func (p *mqttPublisher) publish(topic string, retained bool, payload []byte) {
+	p.metrics.publishTotal.Inc()
+	token := p.client.Publish(topic, 1, retained, payload)
+	if !token.WaitTimeout(mqttTimeout) {
+		p.metrics.publishErrorTotal.Inc()
+		log.Error().Str("topic", topic).Msg("Timeout publishing to mqtt")
+		return
+	}
+	if err := token.Error(); err != nil {
+		p.metrics.publishErrorTotal.Inc()
+		log.Error().Err(err).Str("topic", topic).Msg("Failed to publish to mqtt")
+	}
+}
+
+func (p *mqttPublisher) stateTopic(devEui string) string {
+	return p.config.MqttTopicPrefix + "/" + devEui + "/state"
+}
+
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.config.MqttTopicPrefix + "/status"
+}
+
+// measurementTypeName turns a type like airTemperature into "Air Temperature"
+func measurementTypeName(metricType string) string {
+	var b strings.Builder
+	for i, r := range metricType {
+		if i == 0 {
+			r = unicode.ToUpper(r)
+		} else if unicode.IsUpper(r) {
+			b.WriteRune(' ')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	otlpProtocolGrpc  = "grpc"
+	otlpProtocolHttp  = "http/protobuf"
+	otlpSpanBatch     = 512
+	otlpSpanQueueSize = 2048
+)
+
+// otlpExporter sends the device metrics and the webhook traces to an otlp
+// collector
+type otlpExporter struct {
+	config    EnvConfig
+	metrics   *otlpMetrics
+	conn      *grpc.ClientConn
+	client    *http.Client
+	endpoint  string
+	headers   map[string]string
+	startTime time.Time
+	// tracer is nil unless traces are exported
+	tracer *tracer
+}
+
+func newOtlpExporter(config EnvConfig, reg prometheus.Registerer) *otlpExporter {
+	return &otlpExporter{
+		config:    config,
+		metrics:   newOtlpMetrics(reg),
+		headers:   map[string]string{},
+		startTime: time.Now(),
+	}
+}
+
+// start sets up the connection to the collector and starts the metrics and
+// traces exporters that are enabled, the metrics are the device series of
+// gatherer
+func (o *otlpExporter) start(gatherer prometheus.Gatherer, devices *deviceRegistry) error {
+	for _, entry := range splitList(o.config.OtlpHeaders) {
+		key, value, found := strings.Cut(entry, "=")
+		if !found || len(strings.TrimSpace(key)) == 0 {
+			return fmt.Errorf("otlp header %q is not key=value", entry)
+		}
+		value, _ = url.QueryUnescape(value)
+		o.headers[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	timeout := time.Duration(o.config.OtlpTimeout) * time.Millisecond
+	switch o.config.OtlpProtocol {
+	case otlpProtocolGrpc:
+		// Like the otel sdk, an https:// endpoint means tls, anything else is plain text
+		target, creds := o.config.OtlpEndpoint, insecure.NewCredentials()
+		if u, err := url.Parse(o.config.OtlpEndpoint); err == nil && len(u.Host) > 0 {
+			target = u.Host
+			if u.Scheme == "https" {
+				creds = credentials.NewTLS(&tls.Config{})
+			}
+		}
+		conn, err := grpc.Dial(target, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return err
+		}
+		o.conn = conn
+	case otlpProtocolHttp:
+		o.endpoint = strings.TrimSuffix(o.config.OtlpEndpoint, "/")
+		if !strings.Contains(o.endpoint, "://") {
+			o.endpoint = "http://" + o.endpoint
+		}
+		o.client = &http.Client{Timeout: timeout}
+	default:
+		return fmt.Errorf("unsupported otlp protocol %q, use %s or %s", o.config.OtlpProtocol, otlpProtocolGrpc, otlpProtocolHttp)
+	}
+	if o.config.OtlpTracesExporter == "otlp" {
+		o.tracer = &tracer{queue: make(chan *tracepb.Span, otlpSpanQueueSize), dropped: o.metrics.spansDroppedTotal}
+		go o.traceWorker()
+	}
+	if o.config.OtlpMetricsExporter == "otlp" {
+		go o.metricsWorker(gatherer, devices)
+	}
+	log.Info().Str("endpoint", o.config.OtlpEndpoint).Str("protocol", o.config.OtlpProtocol).Str("metrics", o.config.OtlpMetricsExporter).Str("traces", o.config.OtlpTracesExporter).Msg("Will export to otlp")
+	return nil
+}
+
+// traceWorker exports the finished spans in batches
+func (o *otlpExporter) traceWorker() {
+	ticker := time.NewTicker(5 * time.Second)
+	batch := make([]*tracepb.Span, 0, otlpSpanBatch)
+	for {
+		select {
+		case s := <-o.tracer.queue:
+			batch = append(batch, s)
+			if len(batch) < otlpSpanBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		req := &coltracepb.ExportTraceServiceRequest{
+			ResourceSpans: []*tracepb.ResourceSpans{{
+				Resource:   &resourcepb.Resource{Attributes: o.serviceAttributes()},
+				ScopeSpans: []*tracepb.ScopeSpans{{Scope: otlpScope(), Spans: batch}},
+			}},
+		}
+		if err := o.export("traces", req); err != nil {
+			o.metrics.spansDroppedTotal.Add(float64(len(batch)))
+			log.Error().Err(err).Int("spans", len(batch)).Msg("Failed to export spans to otlp")
+		}
+		batch = make([]*tracepb.Span, 0, otlpSpanBatch)
+	}
+}
+
+// metricsWorker exports the device metrics every OTEL_METRIC_EXPORT_INTERVAL
+func (o *otlpExporter) metricsWorker(gatherer prometheus.Gatherer, devices *deviceRegistry) {
+	for range time.Tick(time.Duration(o.config.OtlpMetricInterval) * time.Millisecond) {
+		req, err := o.deviceMetrics(gatherer, devices)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to gather metrics for otlp")
+		}
+		if len(req.ResourceMetrics) == 0 {
+			continue
+		}
+		if err := o.export("metrics", req); err != nil {
+			log.Error().Err(err).Msg("Failed to export metrics to otlp")
+		}
+	}
+}
+
+// deviceMetrics converts the per device series into otlp, one resource per
+// device with its tenant/application/device as resource attributes. Exporter
+// internals (series without a deviceEui) are left out.
+func (o *otlpExporter) deviceMetrics(gatherer prometheus.Gatherer, registry *deviceRegistry) (*colmetricspb.ExportMetricsServiceRequest, error) {
+	mfs, err := gatherer.Gather()
+	now := uint64(time.Now().UnixNano())
+	devices := map[string][]*metricspb.Metric{}
+	for _, mf := range mfs {
+		if mf.GetName() == metricsPrefix+"_device_info" {
+			continue // Its the resource attributes
+		}
+		points := map[string][]*metricspb.NumberDataPoint{}
+		for _, m := range mf.GetMetric() {
+			devEui := ""
+			attributes := []*commonpb.KeyValue{}
+			for _, label := range m.GetLabel() {
+				switch label.GetName() {
+				case "deviceEui":
+					devEui = label.GetValue()
+				case "deviceName", "tenantName", "applicationName":
+				default:
+					attributes = append(attributes, otlpString(label.GetName(), label.GetValue()))
+				}
+			}
+			if len(devEui) == 0 {
+				continue
+			}
+			point := &metricspb.NumberDataPoint{Attributes: attributes, TimeUnixNano: now}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				point.Value = &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetGauge().GetValue()}
+			case dto.MetricType_COUNTER:
+				point.StartTimeUnixNano = uint64(o.startTime.UnixNano())
+				point.Value = &metricspb.NumberDataPoint_AsDouble{AsDouble: m.GetCounter().GetValue()}
+			default:
+				continue
+			}
+			points[devEui] = append(points[devEui], point)
+		}
+		for devEui, dps := range points {
+			metric := &metricspb.Metric{Name: mf.GetName(), Description: mf.GetHelp()}
+			if mf.GetType() == dto.MetricType_COUNTER {
+				metric.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+					DataPoints:             dps,
+					AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+					IsMonotonic:            true,
+				}}
+			} else {
+				metric.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{DataPoints: dps}}
+			}
+			devices[devEui] = append(devices[devEui], metric)
+		}
+	}
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	for devEui, metrics := range devices {
+		info, found := registry.deviceInfo(devEui)
+		if !found {
+			info.DevEui = devEui
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource:     &resourcepb.Resource{Attributes: append(o.serviceAttributes(), otlpDeviceAttributes(info)...)},
+			ScopeMetrics: []*metricspb.ScopeMetrics{{Scope: otlpScope(), Metrics: metrics}},
+		})
+	}
+	return req, err
+}
+
+func (o *otlpExporter) serviceAttributes() []*commonpb.KeyValue {
+	return []*commonpb.KeyValue{
+		otlpString("service.name", o.config.OtlpServiceName),
+		otlpString("service.version", BuildVersion),
+	}
+}
+
+// otlpDeviceAttributes returns the chirpstack ids and names of a device
+func otlpDeviceAttributes(info chirpstack.DeviceInfo) []*commonpb.KeyValue {
+	attributes := []*commonpb.KeyValue{}
+	for _, kv := range [][2]string{
+		{"lora.device.eui", info.DevEui},
+		{"lora.device.name", info.DeviceName},
+		{"lora.device.profile.name", info.DeviceProfileName},
+		{"lora.tenant.id", info.TenantID},
+		{"lora.tenant.name", info.TenantName},
+		{"lora.application.id", info.ApplicationID},
+		{"lora.application.name", info.ApplicationName},
+	} {
+		if len(kv[1]) > 0 {
+			attributes = append(attributes, otlpString(kv[0], kv[1]))
+		}
+	}
+	return attributes
+}
+
+func otlpScope() *commonpb.InstrumentationScope {
+	return &commonpb.InstrumentationScope{Name: "lora_exporter", Version: BuildVersion}
+}
+
+func otlpString(key string, value string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: value}}}
+}
+
+// export sends a metrics or traces export request over grpc or http
+func (o *otlpExporter) export(signal string, req proto.Message) error {
+	label := prometheus.Labels{"signal": signal}
+	o.metrics.exportTotal.With(label).Inc()
+	err := o.send(signal, req)
+	if err != nil {
+		o.metrics.exportErrorTotal.With(label).Inc()
+	}
+	return err
+}
+
+func (o *otlpExporter) send(signal string, req proto.Message) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(o.config.OtlpTimeout)*time.Millisecond)
+	defer cancel()
+	if o.conn != nil {
+		for k, v := range o.headers {
+			ctx = metadata.AppendToOutgoingContext(ctx, k, v)
+		}
+		var err error
+		switch r := req.(type) {
+		case *colmetricspb.ExportMetricsServiceRequest:
+			_, err = colmetricspb.NewMetricsServiceClient(o.conn).Export(ctx, r)
+		case *coltracepb.ExportTraceServiceRequest:
+			_, err = coltracepb.NewTraceServiceClient(o.conn).Export(ctx, r)
+		}
+		return err
+	}
+	body, err := proto.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, o.endpoint+"/v1/"+signal, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range o.headers {
+		httpReq.Header.Set(k, v)
+	}
+	res, err := o.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("got non-2xx reply %d: %s", res.StatusCode, msg)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteSample is one decoded measurement with its series labels,
+// sorted by name as remote write requires
+type remoteWriteSample struct {
+	labels    []remoteWriteLabel
+	value     float64
+	timestamp int64 // milliseconds
+}
+
+type remoteWriteLabel struct {
+	name  string
+	value string
+}
+
+// remoteWriter pushes the measurements of every uplink with the prometheus
+// remote write protocol, in batches
+type remoteWriter struct {
+	url           string
+	username      string
+	password      string
+	bearerToken   string
+	client        *http.Client
+	queue         chan remoteWriteSample
+	queueSize     int
+	batchSize     int
+	flushInterval time.Duration
+	maxRetries    int
+	retryInitial  time.Duration
+	retryMax      time.Duration
+	metrics       *remoteWriteMetrics
+}
+
+func newRemoteWriter(config EnvConfig, reg prometheus.Registerer) *remoteWriter {
+	return &remoteWriter{
+		url:           config.RemoteWriteURL,
+		username:      config.RemoteWriteUsername,
+		password:      config.RemoteWritePassword,
+		bearerToken:   config.RemoteWriteBearerToken,
+		client:        &http.Client{Timeout: time.Duration(config.RemoteWriteTimeout) * time.Second},
+		queueSize:     config.RemoteWriteQueueSize,
+		batchSize:     config.RemoteWriteBatchSize,
+		flushInterval: time.Duration(config.RemoteWriteFlushInterval) * time.Second,
+		maxRetries:    config.RemoteWriteMaxRetries,
+		retryInitial:  time.Duration(config.RemoteWriteRetryInitial) * time.Second,
+		retryMax:      time.Duration(config.RemoteWriteRetryMax) * time.Second,
+		metrics:       newRemoteWriteMetrics(reg),
+	}
+}
+
+func (w *remoteWriter) start() {
+	w.queue = make(chan remoteWriteSample, w.queueSize)
+	go w.worker()
+	log.Info().Str("url", w.url).Msg("Will push measurements with remote write")
+}
+
+// enqueue queues a sample for every measurement of the uplink, with the same
+// labels as lora_devices_metric. The name differs so a prometheus that also
+// scrapes the exporter does not get both in one series. It never blocks.
+func (w *remoteWriter) enqueue(uplink *Uplink) {
+	timestamp := uplink.Time
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
+	for _, measurement := range uplink.Measurements {
+		sample := remoteWriteSample{
+			labels:    remoteWriteLabels(metricsPrefix+"_devices_measurement", mergeLabels(uplink.Labels, prometheus.Labels{"type": measurement.Type})),
+			value:     measurement.Value,
+			timestamp: timestamp.UnixMilli(),
+		}
+		select {
+		case w.queue <- sample:
+			w.metrics.queueDepth.Inc()
+		default:
+			w.metrics.droppedTotal.Inc()
+			log.Error().Str("devEui", uplink.DevEui).Str("type", measurement.Type).Msg("Remote write queue full, dropping sample")
+		}
+	}
+}
+
+// remoteWriteLabels returns the labels of a series with its name, sorted and
+// without empty values
+func remoteWriteLabels(name string, labels prometheus.Labels) []remoteWriteLabel {
+	list := []remoteWriteLabel{{name: "__name__", value: name}}
+	for k, v := range labels {
+		if len(v) > 0 {
+			list = append(list, remoteWriteLabel{name: k, value: v})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// worker sends the queued samples in batches, when the batch is full or every
+// REMOTE_WRITE_FLUSH_INTERVAL seconds
+func (w *remoteWriter) worker() {
+	ticker := time.NewTicker(w.flushInterval)
+	batch := make([]remoteWriteSample, 0, w.batchSize)
+	for {
+		select {
+		case sample := <-w.queue:
+			w.metrics.queueDepth.Dec()
+			batch = append(batch, sample)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		w.deliver(batch)
+		batch = batch[:0]
+	}
+}
+
+// deliver sends a batch with exponential backoff, it is dropped after the
+// last retry
+func (w *remoteWriter) deliver(batch []remoteWriteSample) {
+	body := snappy.Encode(nil, marshalWriteRequest(batch))
+	backoff := w.retryInitial
+	for attempt := 0; ; attempt++ {
+		err := w.post(body)
+		if err == nil {
+			w.metrics.samplesTotal.Add(float64(len(batch)))
+			return
+		}
+		w.metrics.errorTotal.Inc()
+		_, permanent := err.(errPermanent)
+		if permanent || attempt >= w.maxRetries {
+			w.metrics.droppedTotal.Add(float64(len(batch)))
+			log.Error().Err(err).Int("samples", len(batch)).Int("attempts", attempt+1).Msg("Giving up on remote write")
+			return
+		}
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("backoff", backoff).Msg("Remote write failed, will retry")
+		w.metrics.retryTotal.Inc()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > w.retryMax {
+			backoff = w.retryMax
+		}
+	}
+}
+
+func (w *remoteWriter) post(body []byte) error {
+	w.metrics.total.Inc()
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewBuffer(body))
+	if err != nil {
+		return errPermanent{err}
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "lora_exporter/"+BuildVersion)
+	if len(w.bearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+w.bearerToken)
+	} else if len(w.username) > 0 {
+		req.SetBasicAuth(w.username, w.password)
+	}
+	start := time.Now()
+	res, err := w.client.Do(req)
+	w.metrics.latency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		log.Debug().Int("status", res.StatusCode).Int("size", len(body)).Msg("Pushed remote write batch")
+		return nil
+	case res.StatusCode >= 400 && res.StatusCode < 500 && res.StatusCode != http.StatusRequestTimeout && res.StatusCode != http.StatusTooManyRequests:
+		// eg out of order or duplicate samples, a retry gets the same reply
+		return errPermanent{fmt.Errorf("got non-retryable reply %d", res.StatusCode)}
+	default:
+		return fmt.Errorf("got non-2xx reply %d", res.StatusCode)
+	}
+}
+
+// marshalWriteRequest encodes the samples as a prometheus.WriteRequest
+// protobuf, one TimeSeries per sample:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func marshalWriteRequest(batch []remoteWriteSample) []byte {
+	var req []byte
+	for _, sample := range batch {
+		var ts []byte
+		for _, label := range sample.labels {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, label.name)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			l = protowire.AppendString(l, label.value)
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, l)
+		}
+		var s []byte
+		s = protowire.AppendTag(s, 1, protowire.Fixed64Type)
+		s = protowire.AppendFixed64(s, math.Float64bits(sample.value))
+		s = protowire.AppendTag(s, 2, protowire.VarintType)
+		s = protowire.AppendVarint(s, uint64(sample.timestamp))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, s)
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, ts)
+	}
+	return req
+}
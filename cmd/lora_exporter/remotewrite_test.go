@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testTimeSeries is a TimeSeries of a WriteRequest as a receiver sees it
+type testTimeSeries struct {
+	labels  []remoteWriteLabel
+	samples []testSample
+}
+
+type testSample struct {
+	value     float64
+	timestamp int64
+}
+
+// consumeFields calls fn with every field of the protobuf message b
+func consumeFields(b []byte, fn func(num protowire.Number, typ protowire.Type, value []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n = protowire.ConsumeFieldValue(num, typ, b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		if err := fn(num, typ, b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// unmarshalWriteRequest decodes a prometheus.WriteRequest the way a remote
+// write receiver does, independent of marshalWriteRequest
+func unmarshalWriteRequest(b []byte) ([]testTimeSeries, error) {
+	var series []testTimeSeries
+	bytesField := func(typ protowire.Type, value []byte) ([]byte, error) {
+		if typ != protowire.BytesType {
+			return nil, fmt.Errorf("got wire type %d, want bytes", typ)
+		}
+		v, n := protowire.ConsumeBytes(value)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		return v, nil
+	}
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, value []byte) error {
+		if num != 1 {
+			return fmt.Errorf("unexpected WriteRequest field %d", num)
+		}
+		tsBytes, err := bytesField(typ, value)
+		if err != nil {
+			return err
+		}
+		var ts testTimeSeries
+		err = consumeFields(tsBytes, func(num protowire.Number, typ protowire.Type, value []byte) error {
+			msg, err := bytesField(typ, value)
+			if err != nil {
+				return err
+			}
+			switch num {
+			case 1:
+				var label remoteWriteLabel
+				err = consumeFields(msg, func(num protowire.Number, typ protowire.Type, value []byte) error {
+					s, err := bytesField(typ, value)
+					if num == 1 {
+						label.name = string(s)
+					} else if num == 2 {
+						label.value = string(s)
+					}
+					return err
+				})
+				ts.labels = append(ts.labels, label)
+			case 2:
+				var sample testSample
+				err = consumeFields(msg, func(num protowire.Number, typ protowire.Type, value []byte) error {
+					switch {
+					case num == 1 && typ == protowire.Fixed64Type:
+						v, _ := protowire.ConsumeFixed64(value)
+						sample.value = math.Float64frombits(v)
+					case num == 2 && typ == protowire.VarintType:
+						v, _ := protowire.ConsumeVarint(value)
+						sample.timestamp = int64(v)
+					default:
+						return fmt.Errorf("unexpected Sample field %d of wire type %d", num, typ)
+					}
+					return nil
+				})
+				ts.samples = append(ts.samples, sample)
+			default:
+				return fmt.Errorf("unexpected TimeSeries field %d", num)
+			}
+			return err
+		})
+		series = append(series, ts)
+		return err
+	})
+	return series, err
+}
+
+// TestRemoteWriteRoundTrip decodes what the remote writer pushes the way a
+// receiver does and checks the series
+func TestRemoteWriteRoundTrip(t *testing.T) {
+	requests := make(chan []testTimeSeries, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for header, want := range map[string]string{
+			"Content-Type":                      "application/x-protobuf",
+			"Content-Encoding":                  "snappy",
+			"X-Prometheus-Remote-Write-Version": "0.1.0",
+			"Authorization":                     "Bearer s3cret",
+		} {
+			if got := r.Header.Get(header); got != want {
+				t.Errorf("got %s %q, want %q", header, got, want)
+			}
+		}
+		compressed, _ := io.ReadAll(r.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		series, err := unmarshalWriteRequest(body)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests <- series
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c := config
+	c.RemoteWriteURL = server.URL
+	c.RemoteWriteBearerToken = "s3cret"
+	w := newRemoteWriter(c, prometheus.NewRegistry())
+	w.batchSize = 2
+	w.start()
+	uplinkTime := time.Date(2023, 8, 23, 12, 22, 49, 286299413, time.UTC)
+	w.enqueue(&Uplink{
+		Header: chirpstack.Header{Time: uplinkTime},
+		DevEui: "a84041fbd1889410",
+		Labels: prometheus.Labels{"deviceEui": "a84041fbd1889410", "deviceName": "dragino-lht52-889410", "site": ""},
+		Measurements: []decoder.Measurement{
+			{Type: "airTemperature", Value: 28.41},
+			{Type: "airHumidity", Value: -0.5},
+		},
+	})
+
+	var got []testTimeSeries
+	select {
+	case got = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing was pushed")
+	}
+	labels := func(typ string) []remoteWriteLabel {
+		return []remoteWriteLabel{
+			{"__name__", "lora_devices_measurement"},
+			{"deviceEui", "a84041fbd1889410"},
+			{"deviceName", "dragino-lht52-889410"},
+			{"type", typ},
+		}
+	}
+	want := []testTimeSeries{
+		{labels("airTemperature"), []testSample{{28.41, 1692793369286}}},
+		{labels("airHumidity"), []testSample{{-0.5, 1692793369286}}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
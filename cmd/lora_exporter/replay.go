@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+// replayFile is a dump or sample webhook to replay
+type replayFile struct {
+	name     string
+	envelope *DumpEnvelope
+}
+
+// ReplayError is a file that failed to read, parse or post
+type ReplayError struct {
+	File   string `json:"file"`
+	DevEui string `json:"devEui,omitempty"`
+	Error  string `json:"error"`
+}
+
+// ReplaySample is one series produced by the replay
+type ReplaySample struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+	Value  float64           `json:"value"`
+}
+
+// ReplayReport is what the replay found, printed as json with -format json
+type ReplayReport struct {
+	Files                     int                 `json:"files"`
+	Parsed                    int                 `json:"parsed"`
+	Posted                    int                 `json:"posted,omitempty"`
+	Errors                    []ReplayError       `json:"errors"`
+	DecodeErrors              []ReplayError       `json:"decodeErrors"`
+	UnsupportedOUIs           map[string][]string `json:"unsupportedOUIs"`
+	UnsupportedMeasurementIDs map[string]int      `json:"unsupportedMeasurementIds"`
+	Samples                   []ReplaySample      `json:"samples,omitempty"`
+}
+
+// replayCommand is `lora_exporter replay [flags] <dir|file...>`, it feeds
+// dumps and sample webhooks through the decoders offline and prints the
+// resulting series, optionally posting them to a running exporter too
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] <dir|file...>\n\nReplays dumps (.dump, .dump.gz) and webhook samples (.json).\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", "text", "Output format, text (prometheus exposition) or json")
+	post := flags.String("post", "", "Also POST the webhooks to a running exporter, eg http://localhost:5672/")
+	speed := flags.Float64("speed", 0, "With -post, replay at this multiple of the original pace, 0 for as fast as possible")
+	event := flags.String("event", "", "Event to replay as, by default the event of the dump or up")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+	if !config.Debug {
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel) // Everything worth knowing is in the report
+	}
+	e, err := NewExporter(config, prometheus.NewRegistry())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	report := &ReplayReport{
+		Errors:                    []ReplayError{},
+		DecodeErrors:              []ReplayError{},
+		UnsupportedOUIs:           map[string][]string{},
+		UnsupportedMeasurementIDs: map[string]int{},
+	}
+	files := loadReplayFiles(flags.Args(), report)
+	report.Files = len(files) + len(report.Errors)
+	var previous time.Time
+	for _, file := range files {
+		ev := file.envelope.Event
+		if len(*event) > 0 || len(ev) == 0 {
+			ev = *event
+		}
+		if len(ev) == 0 {
+			ev = "up"
+		}
+		replayDecode(e, file, ev, report)
+		if len(*post) > 0 {
+			if *speed > 0 && !previous.IsZero() && file.envelope.ReceivedTime.After(previous) {
+				time.Sleep(time.Duration(float64(file.envelope.ReceivedTime.Sub(previous)) / *speed))
+			}
+			previous = file.envelope.ReceivedTime
+			if err := replayPost(*post, ev, file.envelope.Payload()); err != nil {
+				report.Errors = append(report.Errors, ReplayError{File: file.name, Error: err.Error()})
+			} else {
+				report.Posted++
+			}
+		}
+	}
+
+	mfs, err := e.registry.Gather()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to gather metrics")
+	}
+	mfs = deviceFamilies(mfs)
+	if *format == "json" {
+		report.Samples = replaySamples(mfs)
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(report)
+	} else {
+		encoder := expfmt.NewEncoder(os.Stdout, expfmt.FmtText)
+		for _, mf := range mfs {
+			encoder.Encode(mf)
+		}
+		printReplayReport(os.Stderr, report)
+	}
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadReplayFiles reads the files and the dumps and samples in the dirs,
+// ordered by the time they were received
+func loadReplayFiles(args []string, report *ReplayReport) []replayFile {
+	var names []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			report.Errors = append(report.Errors, ReplayError{File: arg, Error: err.Error()})
+			continue
+		}
+		if !info.IsDir() {
+			names = append(names, arg)
+			continue
+		}
+		filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				report.Errors = append(report.Errors, ReplayError{File: path, Error: err.Error()})
+				return nil
+			}
+			if !d.IsDir() && (strings.HasSuffix(path, dumpSuffix) || strings.HasSuffix(path, dumpGzipSuffix) || strings.HasSuffix(path, ".json")) {
+				names = append(names, path)
+			}
+			return nil
+		})
+	}
+	files := []replayFile{}
+	for _, name := range names {
+		envelope, err := readDump(name)
+		if err != nil {
+			report.Errors = append(report.Errors, ReplayError{File: name, Error: err.Error()})
+			continue
+		}
+		files = append(files, replayFile{name: name, envelope: envelope})
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].envelope.ReceivedTime.Before(files[j].envelope.ReceivedTime)
+	})
+	return files
+}
+
+// replayDecode runs a webhook through the decoders and adds what went wrong
+// to the report
+func replayDecode(e *Exporter, file replayFile, event string, report *ReplayReport) {
+	uplink, _, err := e.parseChirpstackWebhook(event, file.envelope.Payload(), nil)
+	if errors.Is(err, chirpstack.ErrUnknownEvent) {
+		return // the exporter ignores them too
+	}
+	if err != nil {
+		report.Errors = append(report.Errors, ReplayError{File: file.name, Error: err.Error()})
+		return
+	}
+	report.Parsed++
+	for _, e := range uplink.Errors {
+		report.DecodeErrors = append(report.DecodeErrors, ReplayError{File: file.name, DevEui: uplink.DevEui, Error: e})
+	}
+	if len(decoder.Vendor(uplink.DevEui)) == 0 && !contains(report.UnsupportedOUIs[uplink.OUI], uplink.DevEui) {
+		report.UnsupportedOUIs[uplink.OUI] = append(report.UnsupportedOUIs[uplink.OUI], uplink.DevEui)
+	}
+	for _, id := range uplink.UnsupportedMeasurementIDs {
+		report.UnsupportedMeasurementIDs[id]++
+	}
+}
+
+func replayPost(target string, event string, body []byte) error {
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	query := u.Query()
+	query.Set("event", event)
+	u.RawQuery = query.Encode()
+	res, err := http.Post(u.String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("got non-2xx reply %d: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func replaySamples(mfs []*dto.MetricFamily) []ReplaySample {
+	samples := []ReplaySample{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			sample := ReplaySample{Name: mf.GetName(), Labels: map[string]string{}}
+			for _, label := range m.GetLabel() {
+				sample.Labels[label.GetName()] = label.GetValue()
+			}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				sample.Value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				sample.Value = m.GetCounter().GetValue()
+			default:
+				continue
+			}
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+func printReplayReport(w io.Writer, report *ReplayReport) {
+	fmt.Fprintf(w, "# %d files, %d parsed", report.Files, report.Parsed)
+	if report.Posted > 0 {
+		fmt.Fprintf(w, ", %d posted", report.Posted)
+	}
+	fmt.Fprintf(w, ", %d errors, %d decode errors\n", len(report.Errors), len(report.DecodeErrors))
+	for _, e := range report.Errors {
+		fmt.Fprintf(w, "# error %s: %s\n", e.File, e.Error)
+	}
+	for _, e := range report.DecodeErrors {
+		fmt.Fprintf(w, "# decode error %s (%s): %s\n", e.File, e.DevEui, e.Error)
+	}
+	for _, oui := range sortedKeys(report.UnsupportedOUIs) {
+		fmt.Fprintf(w, "# unsupported OUI %s: %s\n", oui, strings.Join(report.UnsupportedOUIs[oui], ", "))
+	}
+	for _, id := range sortedKeys(report.UnsupportedMeasurementIDs) {
+		fmt.Fprintf(w, "# unsupported measurementId %s: %d times\n", id, report.UnsupportedMeasurementIDs[id])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
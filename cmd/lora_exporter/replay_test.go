@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestLoadReplayFiles checks dumps and samples are replayed in the order they
+// were received, legacy files by their modification time
+func TestLoadReplayFiles(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2023, 8, 23, 12, 0, 0, 0, time.UTC)
+	write := func(name string, data []byte, modTime time.Time) string {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filename, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	sample, err := os.ReadFile(filepath.Join(sampleDir, "dragino-lht52.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	envelope, err := json.Marshal(DumpEnvelope{DumpVersion: dumpVersion, ReceivedTime: start.Add(2 * time.Minute), Event: "up", Reasons: []string{dumpReasonDebug}, Body: sample})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The envelope time wins over the modification time of its file
+	third := write("a84041fbd1889410/b.dump", envelope, start)
+	first := write("sample.json", sample, start)
+	fourth := write("a84041fbd1889410/a.dump", sample, start.Add(3*time.Minute))
+	second := write("z.json", sample, start.Add(time.Minute))
+	write("notes.txt", []byte("not a webhook"), start)
+	fifth := write("extra.json", sample, start.Add(4*time.Minute))
+
+	report := &ReplayReport{}
+	missing := filepath.Join(t.TempDir(), "missing")
+	files := loadReplayFiles([]string{dir, missing, fifth}, report)
+	var got []string
+	for _, file := range files {
+		got = append(got, file.name)
+	}
+	// A file given as an argument is replayed again, it is not a dir walk
+	want := []string{first, second, third, fourth, fifth, fifth}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got files\n%v\nwant\n%v", got, want)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].File != missing {
+		t.Errorf("got errors %+v, want the missing file", report.Errors)
+	}
+	if files[2].envelope.Event != "up" || !bytes.Equal(files[2].envelope.Payload(), sample) {
+		t.Errorf("got envelope %+v", files[2].envelope)
+	}
+}
+
+func TestReplayDecode(t *testing.T) {
+	newReport := func() *ReplayReport {
+		return &ReplayReport{
+			Errors:                    []ReplayError{},
+			DecodeErrors:              []ReplayError{},
+			UnsupportedOUIs:           map[string][]string{},
+			UnsupportedMeasurementIDs: map[string]int{},
+		}
+	}
+	newExporter := func() *Exporter {
+		e, err := NewExporter(config, prometheus.NewRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+
+	// The samples are all supported, two don't parse
+	report := newReport()
+	e := newExporter()
+	for _, file := range loadReplayFiles([]string{sampleDir}, report) {
+		replayDecode(e, file, "up", report)
+	}
+	var errorFiles []string
+	for _, replayError := range report.Errors {
+		errorFiles = append(errorFiles, filepath.Base(replayError.File))
+	}
+	if report.Parsed != 15 || !reflect.DeepEqual(errorFiles, []string{"badJson.json", "sensecap-t1000a.setup.json"}) {
+		t.Errorf("got %d parsed and errors %+v, want 15 and the two broken samples", report.Parsed, report.Errors)
+	}
+	if len(report.DecodeErrors) != 0 || len(report.UnsupportedOUIs) != 0 || len(report.UnsupportedMeasurementIDs) != 0 {
+		t.Errorf("got decode errors %+v, unsupported OUIs %v and measurement ids %v, want none", report.DecodeErrors, report.UnsupportedOUIs, report.UnsupportedMeasurementIDs)
+	}
+
+	sample, err := os.ReadFile(filepath.Join(sampleDir, "sensecapLightSensor.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownID := []string{`"measurementId":4099.0`, `"measurementId":4999`}
+	variants := []struct {
+		name         string
+		event        string
+		replacements []string
+	}{
+		{"unknown-id", "up", unknownID},
+		{"unknown-id-again", "up", unknownID},
+		{"unsupported-oui", "up", []string{`"devEui":"2cf7f1c052800195"`, `"devEui":"0016c001f0000001"`}},
+		{"unsupported-oui-again", "up", []string{`"devEui":"2cf7f1c052800195"`, `"devEui":"0016c001f0000001"`}},
+		{"unsupported-oui-other-device", "up", []string{`"devEui":"2cf7f1c052800195"`, `"devEui":"0016c001f0000002"`}},
+		{"unknown-event", "bogus", nil},
+		{"not-json", "up", []string{`{"deduplicationId"`, `{deduplicationId`}},
+	}
+	report = newReport()
+	e = newExporter()
+	for _, variant := range variants {
+		body := strings.NewReplacer(variant.replacements...).Replace(string(sample))
+		replayDecode(e, replayFile{name: variant.name, envelope: &DumpEnvelope{Body: json.RawMessage(body)}}, variant.event, report)
+	}
+
+	if report.Parsed != 5 {
+		t.Errorf("got %d parsed, want 5", report.Parsed)
+	}
+	if len(report.Errors) != 1 || report.Errors[0].File != "not-json" {
+		t.Errorf("got errors %+v, want the one that is not json", report.Errors)
+	}
+	wantDecodeErrors := []ReplayError{
+		{File: "unknown-id", DevEui: "2cf7f1c052800195", Error: "measurementId 4999 is not supported"},
+		{File: "unknown-id-again", DevEui: "2cf7f1c052800195", Error: "measurementId 4999 is not supported"},
+	}
+	if !reflect.DeepEqual(report.DecodeErrors, wantDecodeErrors) {
+		t.Errorf("got decode errors %+v, want %+v", report.DecodeErrors, wantDecodeErrors)
+	}
+	if want := map[string]int{"4999": 2}; !reflect.DeepEqual(report.UnsupportedMeasurementIDs, want) {
+		t.Errorf("got unsupported measurement ids %v, want %v", report.UnsupportedMeasurementIDs, want)
+	}
+	// Each device is listed once under its OUI
+	if want := map[string][]string{"00:16:c0": {"0016c001f0000001", "0016c001f0000002"}}; !reflect.DeepEqual(report.UnsupportedOUIs, want) {
+		t.Errorf("got unsupported OUIs %v, want %v", report.UnsupportedOUIs, want)
+	}
+
+	var buf bytes.Buffer
+	report.Files = 7
+	printReplayReport(&buf, report)
+	for _, want := range []string{
+		"# 7 files, 5 parsed, 1 errors, 2 decode errors\n",
+		"# decode error unknown-id (2cf7f1c052800195): measurementId 4999 is not supported\n",
+		"# unsupported OUI 00:16:c0: 0016c001f0000001, 0016c001f0000002\n",
+		"# unsupported measurementId 4999: 2 times\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("got report\n%s\nwithout %q", buf.String(), want)
+		}
+	}
+}
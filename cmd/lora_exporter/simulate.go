@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"time"
+)
+
+const simulateTenant = "simulator"
+
+// simVendor is a kind of device the simulator can pretend to be, object
+// builds the decoded object of an uplink like its chirpstack codec does
+type simVendor struct {
+	oui     string
+	profile string
+	object  func(d *simDevice, rng *rand.Rand) map[string]interface{}
+}
+
+var simVendors = []simVendor{
+	{oui: "2cf7f1", profile: "SenseCAP S2103 CO2, Temperature and Humidity", object: func(d *simDevice, rng *rand.Rand) map[string]interface{} {
+		return map[string]interface{}{"err": 0, "valid": true, "messages": []map[string]interface{}{
+			{"type": "report_telemetry", "measurementId": 4097, "measurementValue": d.walk("temperature", 18, 35, 0.3, 1, rng)},
+			{"type": "report_telemetry", "measurementId": 4098, "measurementValue": d.walk("humidity", 30, 90, 1, 2, rng)},
+			{"type": "report_telemetry", "measurementId": 4100, "measurementValue": d.walk("co2", 400, 2000, 30, 0, rng)},
+		}}
+	}},
+	{oui: "a84041", profile: "dragino-lht52", object: func(d *simDevice, rng *rand.Rand) map[string]interface{} {
+		return map[string]interface{}{
+			"TempC_SHT":    d.walk("temperature", 18, 35, 0.3, 2, rng),
+			"Hum_SHT":      d.walk("humidity", 30, 90, 1, 1, rng),
+			"TempC_DS":     327.67, // No external probe
+			"Ext":          2,
+			"Systimestamp": time.Now().Unix(),
+		}
+	}},
+	{oui: "24e124", profile: "EM300-TH", object: func(d *simDevice, rng *rand.Rand) map[string]interface{} {
+		return map[string]interface{}{"decoded": map[string]interface{}{
+			"temperature": d.walk("temperature", 18, 35, 0.3, 1, rng),
+			"humidity":    d.walk("humidity", 30, 90, 0.5, 1, rng),
+			"battery":     d.battery(),
+		}}
+	}},
+	{oui: "cacbb8", profile: "rejee-sl101as", object: func(d *simDevice, rng *rand.Rand) map[string]interface{} {
+		return map[string]interface{}{
+			"temperature": d.walk("temperature", 18, 35, 0.3, 1, rng),
+			"humidity":    d.walk("humidity", 30, 90, 1, 1, rng),
+			"battery":     d.battery(),
+			"vol":         math.Round(d.battery()*0.012*100+200) / 100,
+		}
+	}},
+}
+
+// simDevice is a virtual device with the gateways that can hear it
+type simDevice struct {
+	vendor    *simVendor
+	devEui    string
+	name      string
+	profileID string
+	fCnt      int
+	uplinks   int
+	readings  map[string]float64
+	gateways  []simGateway
+}
+
+// simGateway is a gateway and the average rssi it hears a device with
+type simGateway struct {
+	id   string
+	rssi float64
+}
+
+// walk moves a reading a random step within min and max, rounded to decimals
+func (d *simDevice) walk(name string, min, max, step float64, decimals int, rng *rand.Rand) float64 {
+	v, ok := d.readings[name]
+	if !ok {
+		v = min + rng.Float64()*(max-min)
+	}
+	v = math.Max(min, math.Min(max, v+(rng.Float64()*2-1)*step))
+	d.readings[name] = v
+	scale := math.Pow(10, float64(decimals))
+	return math.Round(v*scale) / scale
+}
+
+// battery drains a percent every 100 uplinks
+func (d *simDevice) battery() float64 {
+	return math.Max(1, 100-float64(d.uplinks/100))
+}
+
+// SimulateReport is what the simulator sent and how the exporter coped
+type SimulateReport struct {
+	Devices   int     `json:"devices"`
+	Seconds   float64 `json:"seconds"`
+	Sent      int     `json:"sent"`
+	Accepted  int     `json:"accepted"`
+	Rejected  int     `json:"rejected"`
+	Failed    int     `json:"failed"`
+	Malformed int     `json:"malformed"`
+	Lost      int     `json:"lost"`
+	Rate      float64 `json:"rate"`
+	// Latency of the posts in milliseconds
+	LatencyAvg float64 `json:"latencyAvgMs"`
+	LatencyMax float64 `json:"latencyMaxMs"`
+	// Scraped from the exporter at the end, 0 if that failed
+	Series       int     `json:"series"`
+	DeviceSeries int     `json:"deviceSeries"`
+	MemoryBytes  float64 `json:"memoryBytes"`
+	latencyTotal time.Duration
+	mutex        sync.Mutex
+}
+
+func (r *SimulateReport) record(status int, err error, latency time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	switch {
+	case err != nil:
+		r.Failed++
+	case status >= 200 && status < 300:
+		r.Accepted++
+	default:
+		r.Rejected++
+	}
+	r.latencyTotal += latency
+	r.LatencyMax = math.Max(r.LatencyMax, float64(latency.Microseconds())/1000)
+}
+
+// simulateMaxRate is the highest -rate, the ticker needs an interval of at
+// least a nanosecond and a microsecond is already more than one exporter takes
+const simulateMaxRate = 1e6
+
+// simulateCommand is `lora_exporter simulate [flags] <url>`, it posts
+// chirpstack webhooks of virtual devices to a running exporter at a steady
+// rate, to see how it copes with a large fleet
+func simulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s simulate [flags] <url>\n\nPosts webhooks of virtual devices to a running exporter, eg http://localhost:5672/\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	devices := flags.Int("devices", 100, "Number of virtual devices, spread over the supported vendors")
+	rate := flags.Float64("rate", 10, "Webhooks per second")
+	duration := flags.Duration("duration", time.Minute, "How long to run, 0 until interrupted")
+	gateways := flags.Int("gateways", 3, "Number of gateways, every device is heard by one or more")
+	loss := flags.Float64("loss", 0.05, "Fraction of uplinks lost, they show up as gaps in fCnt")
+	malformed := flags.Float64("malformed", 0.01, "Fraction of webhooks with a malformed body")
+	workers := flags.Int("workers", 4, "Concurrent posts")
+	seed := flags.Int64("seed", 1, "Random seed, the same seed simulates the same devices and readings")
+	format := flags.String("format", "text", "Output format of the report, text or json")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 || *devices < 1 || *rate <= 0 || *gateways < 1 || *workers < 1 || (*format != "text" && *format != "json") {
+		flags.Usage()
+		return 2
+	}
+	// Written so NaN fails too. A loss of 1 would never send anything.
+	if !(*rate > 0 && *rate <= simulateMaxRate) {
+		fmt.Fprintf(os.Stderr, "-rate must be more than 0 and at most %g, got %g\n", simulateMaxRate, *rate)
+		return 2
+	}
+	if !(*loss >= 0 && *loss < 1) {
+		fmt.Fprintf(os.Stderr, "-loss must be at least 0 and less than 1, got %g\n", *loss)
+		return 2
+	}
+	if !(*malformed >= 0 && *malformed <= 1) {
+		fmt.Fprintf(os.Stderr, "-malformed must be 0 to 1, got %g\n", *malformed)
+		return 2
+	}
+	target, err := url.Parse(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad url %s: %s\n", flags.Arg(0), err)
+		return 2
+	}
+	query := target.Query()
+	query.Set("event", "up")
+	target.RawQuery = query.Encode()
+
+	rng := rand.New(rand.NewSource(*seed))
+	fleet := newSimFleet(*devices, *gateways, rng)
+	report := &SimulateReport{Devices: len(fleet)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	bodies := make(chan []byte, *workers)
+	var wg sync.WaitGroup
+	for i := 0; i < *workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for body := range bodies {
+				start := time.Now()
+				status, err := simulatePost(client, target.String(), body)
+				report.record(status, err, time.Since(start))
+			}
+		}()
+	}
+
+	fmt.Fprintf(os.Stderr, "Simulating %d devices and %d gateways at %g webhooks/s to %s\n", len(fleet), *gateways, *rate, flags.Arg(0))
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	progress := time.NewTicker(10 * time.Second)
+	defer progress.Stop()
+	next := 0
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-progress.C:
+			report.mutex.Lock()
+			fmt.Fprintf(os.Stderr, "%s: %d sent, %d accepted, %d rejected, %d failed\n", time.Since(start).Round(time.Second), report.Sent, report.Accepted, report.Rejected, report.Failed)
+			report.mutex.Unlock()
+		case <-ticker.C:
+			device := fleet[next%len(fleet)]
+			next++
+			// A lost uplink still uses up its fCnt
+			for rng.Float64() < *loss {
+				device.fCnt++
+				report.Lost++
+			}
+			var body []byte
+			if rng.Float64() < *malformed {
+				body = simulateMalformed(device, rng)
+				report.Malformed++
+			} else {
+				body = simulateWebhook(device, rng)
+			}
+			select {
+			case bodies <- body:
+				report.mutex.Lock()
+				report.Sent++
+				report.mutex.Unlock()
+			case <-ctx.Done():
+				break loop
+			}
+		}
+	}
+	close(bodies)
+	wg.Wait()
+
+	report.Seconds = time.Since(start).Seconds()
+	report.Rate = float64(report.Sent) / report.Seconds
+	if report.Sent > 0 {
+		report.LatencyAvg = float64(report.latencyTotal.Microseconds()) / 1000 / float64(report.Sent)
+	}
+	simulateScrape(client, target, report)
+	if *format == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		e.Encode(report)
+	} else {
+		printSimulateReport(os.Stdout, report)
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// newSimFleet creates the devices round robin over the vendors, with the
+// gateways that hear them
+func newSimFleet(devices int, gateways int, rng *rand.Rand) []*simDevice {
+	profileIDs := make([]string, len(simVendors))
+	for i := range profileIDs {
+		profileIDs[i] = simulateUUID(rng)
+	}
+	fleet := make([]*simDevice, devices)
+	for i := range fleet {
+		vendor := &simVendors[i%len(simVendors)]
+		d := &simDevice{
+			vendor:    vendor,
+			devEui:    fmt.Sprintf("%s%010x", vendor.oui, i),
+			name:      fmt.Sprintf("sim-%s-%d", vendor.profile, i),
+			profileID: profileIDs[i%len(simVendors)],
+			fCnt:      rng.Intn(1000),
+			readings:  map[string]float64{},
+		}
+		// Always the nearest gateway, the others hear it sometimes
+		for g := 0; g < gateways; g++ {
+			if g == 0 || rng.Float64() < 0.5 {
+				d.gateways = append(d.gateways, simGateway{id: fmt.Sprintf("5153494d%08x", (i+g)%gateways), rssi: -125 + rng.Float64()*80})
+			}
+		}
+		fleet[i] = d
+	}
+	return fleet
+}
+
+func simulateWebhook(d *simDevice, rng *rand.Rand) []byte {
+	d.fCnt++
+	d.uplinks++
+	var rxInfo []map[string]interface{}
+	for _, gateway := range d.gateways {
+		r := math.Round(gateway.rssi + rng.NormFloat64()*4)
+		// SNR follows the RSSI until the demodulator floor, roughly
+		snr := math.Round(math.Max(-20, math.Min(13.5, (r+115)/3+rng.NormFloat64()*2))*10) / 10
+		rxInfo = append(rxInfo, map[string]interface{}{
+			"gatewayId": gateway.id,
+			"uplinkId":  rng.Intn(65536),
+			"rssi":      int(r),
+			"snr":       snr,
+			"channel":   rng.Intn(8),
+			"crcStatus": "CRC_OK",
+		})
+	}
+	webhook := map[string]interface{}{
+		"deduplicationId": simulateUUID(rng),
+		"time":            time.Now().UTC(),
+		"deviceInfo": map[string]interface{}{
+			"tenantId":           simulateTenantID,
+			"tenantName":         simulateTenant,
+			"applicationId":      simulateApplicationID,
+			"applicationName":    simulateTenant,
+			"deviceProfileId":    d.profileID,
+			"deviceProfileName":  d.vendor.profile,
+			"deviceName":         d.name,
+			"devEui":             d.devEui,
+			"deviceClassEnabled": "CLASS_A",
+			"tags":               map[string]string{"simulated": "true"},
+		},
+		"devAddr":   d.devEui[8:],
+		"adr":       true,
+		"dr":        5,
+		"fCnt":      d.fCnt,
+		"fPort":     2,
+		"confirmed": rng.Float64() < 0.1,
+		"object":    d.vendor.object(d, rng),
+		"rxInfo":    rxInfo,
+		"txInfo": map[string]interface{}{
+			"frequency": 923200000 + 200000*rng.Intn(8),
+			"modulation": map[string]interface{}{"lora": map[string]interface{}{
+				"bandwidth": 125000, "spreadingFactor": 7, "codeRate": "CR_4_5",
+			}},
+		},
+	}
+	body, _ := json.Marshal(webhook)
+	return body
+}
+
+// simulateMalformed is a webhook of a device that is cut short, not json or
+// has sensecap messages that are not messages
+func simulateMalformed(d *simDevice, rng *rand.Rand) []byte {
+	body := simulateWebhook(d, rng)
+	switch rng.Intn(3) {
+	case 0:
+		return body[:rng.Intn(len(body))]
+	case 1:
+		return []byte("This is not json")
+	default:
+		return []byte(fmt.Sprintf(`{"deviceInfo":{"devEui":%q},"fCnt":%d,"object":{"messages":"garbage"}}`, d.devEui, d.fCnt))
+	}
+}
+
+var (
+	simulateTenantID      = simulateUUID(rand.New(rand.NewSource(1)))
+	simulateApplicationID = simulateUUID(rand.New(rand.NewSource(2)))
+)
+
+func simulateUUID(rng *rand.Rand) string {
+	b := make([]byte, 16)
+	rng.Read(b)
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func simulatePost(client *http.Client, target string, body []byte) (int, error) {
+	res, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	return res.StatusCode, nil
+}
+
+// simulateScrape counts the series of the exporter and reads its memory use
+// from /metrics, next to the webhook url
+func simulateScrape(client *http.Client, target *url.URL, report *SimulateReport) {
+	metrics := target.ResolveReference(&url.URL{Path: "/metrics"})
+	res, err := client.Get(metrics.String())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to scrape %s: %s\n", metrics, err)
+		return
+	}
+	defer res.Body.Close()
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		report.Series++
+		if strings.HasPrefix(line, "lora_device") {
+			report.DeviceSeries++
+		}
+		if value, ok := strings.CutPrefix(line, "process_resident_memory_bytes "); ok {
+			fmt.Sscanf(value, "%g", &report.MemoryBytes)
+		}
+	}
+}
+
+func printSimulateReport(w io.Writer, report *SimulateReport) {
+	fmt.Fprintf(w, "Devices:   %d\n", report.Devices)
+	fmt.Fprintf(w, "Duration:  %.1fs\n", report.Seconds)
+	fmt.Fprintf(w, "Sent:      %d (%.1f/s), %d malformed, %d uplinks lost\n", report.Sent, report.Rate, report.Malformed, report.Lost)
+	fmt.Fprintf(w, "Replies:   %d accepted, %d rejected, %d failed\n", report.Accepted, report.Rejected, report.Failed)
+	fmt.Fprintf(w, "Latency:   %.2fms avg, %.2fms max\n", report.LatencyAvg, report.LatencyMax)
+	if report.Series > 0 {
+		fmt.Fprintf(w, "Series:    %d, %d of devices (lora_device*)\n", report.Series, report.DeviceSeries)
+		fmt.Fprintf(w, "Memory:    %.1fMB resident\n", report.MemoryBytes/1024/1024)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+	"github.com/visago/lora_exporter/pkg/decoder"
+)
+
+const streamKeepalive = 15 * time.Second
+
+// StreamEvent is what /api/v1/stream sends for every processed webhook
+type StreamEvent struct {
+	Time            time.Time          `json:"time"`
+	Event           string             `json:"event"`
+	DevEui          string             `json:"devEui,omitempty"`
+	DeviceName      string             `json:"deviceName,omitempty"`
+	ApplicationID   string             `json:"applicationId,omitempty"`
+	ApplicationName string             `json:"applicationName,omitempty"`
+	TenantName      string             `json:"tenantName,omitempty"`
+	OUI             string             `json:"oui,omitempty"`
+	Vendor          string             `json:"vendor,omitempty"`
+	DeduplicationID string             `json:"deduplicationId,omitempty"`
+	FCnt            int                `json:"fCnt"`
+	Measurements    map[string]float64 `json:"measurements,omitempty"`
+	GatewayID       string             `json:"gatewayId,omitempty"`
+	Rssi            *int               `json:"rssi,omitempty"`
+	Snr             *float64           `json:"snr,omitempty"`
+	Warnings        []string           `json:"warnings,omitempty"`
+	// Error is set when the webhook body could not be parsed
+	Error string `json:"error,omitempty"`
+}
+
+// streamClient is a subscriber, events it is too slow to take are dropped
+type streamClient struct {
+	events       chan StreamEvent
+	devEuis      []string
+	applications []string
+}
+
+// wsUpgrader keeps the default origin check, so a page of another site
+// can't open a websocket with the cached AUTHKEY login of the browser
+var wsUpgrader = websocket.Upgrader{}
+
+// streamHub hands the processed webhooks to the /api/v1/stream clients
+type streamHub struct {
+	bufferSize int
+	maxClients int
+	metrics    *streamMetrics
+
+	mutex       sync.RWMutex
+	subscribers map[*streamClient]struct{}
+}
+
+func newStreamHub(config EnvConfig, reg prometheus.Registerer) *streamHub {
+	return &streamHub{
+		bufferSize:  config.StreamBufferSize,
+		maxClients:  config.StreamMaxClients,
+		metrics:     newStreamMetrics(reg),
+		subscribers: map[*streamClient]struct{}{},
+	}
+}
+
+func (c *streamClient) wants(event StreamEvent) bool {
+	if len(c.devEuis) > 0 && !contains(c.devEuis, strings.ToLower(event.DevEui)) {
+		return false
+	}
+	if len(c.applications) > 0 && !contains(c.applications, event.ApplicationID) && !contains(c.applications, event.ApplicationName) {
+		return false
+	}
+	return true
+}
+
+// newStreamEvent normalizes a webhook for the stream, uplink is nil if the
+// body failed to parse
+func newStreamEvent(event string, uplink *Uplink, err error) StreamEvent {
+	e := StreamEvent{Time: time.Now().UTC(), Event: event}
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	info := uplink.DeviceInfo
+	e.DevEui = uplink.DevEui
+	e.DeviceName = info.DeviceName
+	e.ApplicationID = info.ApplicationID
+	e.ApplicationName = info.ApplicationName
+	e.TenantName = info.TenantName
+	e.OUI = uplink.OUI
+	e.Vendor = decoder.Vendor(uplink.DevEui)
+	e.DeduplicationID = uplink.DeduplicationID
+	e.FCnt = uplink.FCnt()
+	e.Warnings = uplink.Errors
+	if !uplink.Time.IsZero() {
+		e.Time = uplink.Time
+	}
+	if len(uplink.Measurements) > 0 {
+		e.Measurements = uplink.MeasurementMap()
+	}
+	rxInfo := uplink.RxInfo()
+	for i, rxinfo := range rxInfo {
+		if e.Rssi == nil || rxinfo.Rssi > *e.Rssi {
+			e.GatewayID = rxinfo.GatewayID
+			e.Rssi = &rxInfo[i].Rssi
+			e.Snr = &rxInfo[i].Snr
+		}
+	}
+	return e
+}
+
+// publish hands an event to every interested stream client, it never blocks
+// on a slow client
+func (h *streamHub) publish(event StreamEvent) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	for client := range h.subscribers {
+		if !client.wants(event) {
+			continue
+		}
+		select {
+		case client.events <- event:
+			h.metrics.eventsTotal.Inc()
+		default:
+			h.metrics.droppedTotal.Inc()
+		}
+	}
+}
+
+func (h *streamHub) subscribe(r *http.Request) (*streamClient, error) {
+	query := r.URL.Query()
+	client := &streamClient{
+		events:       make(chan StreamEvent, h.bufferSize),
+		devEuis:      splitList(strings.ToLower(query.Get("devEui"))),
+		applications: splitList(query.Get("application")),
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.maxClients > 0 && len(h.subscribers) >= h.maxClients {
+		return nil, fmt.Errorf("too many stream clients")
+	}
+	h.subscribers[client] = struct{}{}
+	h.metrics.clients.Set(float64(len(h.subscribers)))
+	return client, nil
+}
+
+func (h *streamHub) unsubscribe(client *streamClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, client)
+	h.metrics.clients.Set(float64(len(h.subscribers)))
+}
+
+// handler serves /api/v1/stream?devEui=&application= as server sent events,
+// or as a websocket if the client asks for an upgrade
+func (h *streamHub) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	client, err := h.subscribe(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer h.unsubscribe(client)
+	ip := ReadUserIP(r)
+	log.Info().Str("IP", ip).Str("devEui", strings.Join(client.devEuis, ",")).Str("application", strings.Join(client.applications, ",")).Msg("Stream client connected")
+	if websocket.IsWebSocketUpgrade(r) {
+		streamWebsocket(w, r, client)
+	} else {
+		streamSSE(w, r, client)
+	}
+	log.Info().Str("IP", ip).Msg("Stream client disconnected")
+}
+
+func streamSSE(w http.ResponseWriter, r *http.Request, client *streamClient) {
+	rc := http.NewResponseController(w)
+	// The server write timeout is for normal requests, a stream runs forever
+	rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, ": connected\n\n")
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprintf(w, ": keepalive\n\n")
+		case event := <-client.events:
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data)
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func streamWebsocket(w http.ResponseWriter, r *http.Request, client *streamClient) {
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // Upgrade already replied with the error
+	}
+	defer conn.Close()
+	// The hijacked connection keeps the read timeout of the server
+	conn.SetReadDeadline(time.Time{})
+	// We only read to notice the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		var err error
+		select {
+		case <-closed:
+			return
+		case <-keepalive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second))
+		case event := <-client.events:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			err = conn.WriteJSON(event)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	scopeTenant      = "tenant"
+	scopeApplication = "application"
+)
+
+// parseScopeTokens parses id=token,id=token into a map
+func parseScopeTokens(s string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, entry := range splitList(s) {
+		id, token, found := strings.Cut(entry, "=")
+		id = strings.TrimSpace(id)
+		if !found || len(id) == 0 || len(token) == 0 {
+			return nil, fmt.Errorf("token entry %q is not id=token", entry)
+		}
+		tokens[id] = token
+	}
+	return tokens, nil
+}
+
+// deviceFilterGatherer only returns the series of the given devices, series
+// without a deviceEui label (exporter internals) are never returned
+type deviceFilterGatherer struct {
+	gatherer prometheus.Gatherer
+	devices  map[string]bool
+}
+
+func (g deviceFilterGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.gatherer.Gather()
+	filtered := make([]*dto.MetricFamily, 0, len(mfs))
+	for _, mf := range mfs {
+		var metrics []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "deviceEui" && g.devices[label.GetValue()] {
+					metrics = append(metrics, m)
+					break
+				}
+			}
+		}
+		if len(metrics) > 0 {
+			filtered = append(filtered, &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type, Metric: metrics})
+		}
+	}
+	return filtered, err
+}
+
+// scopedMetricsHandler serves /metrics/tenant/{id} or /metrics/application/{id}
+// with only the series of that tenant/application, each protected by its own
+// bearer token. Ids without a token get the same 401 as a wrong token, so the
+// ids can't be probed.
+func (e *Exporter) scopedMetricsHandler(scope string) http.HandlerFunc {
+	prefix := "/metrics/" + scope + "/"
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+		token, found := e.scopeToken(scope, id)
+		bearer, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || len(token) == 0 || !isBearer || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+			log.Warn().Str("scope", scope).Str("id", id).Str("IP", ReadUserIP(r)).Msg("Unauthorized scoped metrics request")
+			w.Header().Set("WWW-Authenticate", `Bearer realm="lora_exporter"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		gatherer := deviceFilterGatherer{gatherer: e.registry, devices: e.devices.scopeDevices(scope, id)}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeviceFilterGatherer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	devices := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "devices", Help: "Per device"}, []string{"deviceEui"})
+	gateways := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "gateways", Help: "Per gateway and device"}, []string{"gatewayId", "deviceEui"})
+	internal := prometheus.NewCounter(prometheus.CounterOpts{Name: "internal_total", Help: "Exporter internal"})
+	registry.MustRegister(devices, gateways, internal)
+	devices.WithLabelValues("a84041fbd1889410").Set(1)
+	devices.WithLabelValues("24e124126d392076").Set(2)
+	gateways.WithLabelValues("2cf7f11353100025", "24e124126d392076").Set(3)
+	internal.Inc()
+
+	expected := `
+# HELP devices Per device
+# TYPE devices gauge
+devices{deviceEui="a84041fbd1889410"} 1
+`
+	gatherer := deviceFilterGatherer{gatherer: registry, devices: map[string]bool{"a84041fbd1889410": true}}
+	if err := testutil.GatherAndCompare(gatherer, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+	mfs, err := deviceFilterGatherer{gatherer: registry, devices: map[string]bool{}}.Gather()
+	if err != nil || len(mfs) != 0 {
+		t.Errorf("got %d families and %v without devices, want none", len(mfs), err)
+	}
+}
+
+func TestScopedMetricsHandler(t *testing.T) {
+	c := config
+	c.TenantTokens = "tenant-a=token-a,tenant-b=token-b"
+	c.ApplicationTokens = "app-a=token-app"
+	e, err := NewExporter(c, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhooks := []string{
+		`{"deviceInfo":{"tenantId":"tenant-a","applicationId":"app-a","deviceName":"a","devEui":"a84041fbd1889410"},"fCnt":1,"object":{"TempC_SHT":28.41},"rxInfo":[{"gatewayId":"2cf7f11353100025","rssi":-87,"snr":9.5}]}`,
+		`{"deviceInfo":{"tenantId":"tenant-b","applicationId":"app-b","deviceName":"b","devEui":"24e124126d392076"},"fCnt":1,"object":{"temperature":26.8},"rxInfo":[{"gatewayId":"2cf7f11353100025","rssi":-95,"snr":12.2}]}`,
+	}
+	for _, body := range webhooks {
+		w := httptest.NewRecorder()
+		e.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/?event=up", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("webhook got %d: %s", w.Code, w.Body)
+		}
+	}
+	// A failed gRPC lookup must not drop the device from its tenant
+	e.devices.forgetDevice("a84041fbd1889410")
+
+	tests := []struct {
+		name       string
+		path       string
+		auth       string
+		wantCode   int
+		wantDevice string
+	}{
+		{"tenant a", "/metrics/tenant/tenant-a", "Bearer token-a", http.StatusOK, "a84041fbd1889410"},
+		{"tenant b", "/metrics/tenant/tenant-b", "Bearer token-b", http.StatusOK, "24e124126d392076"},
+		{"application", "/metrics/application/app-a", "Bearer token-app", http.StatusOK, "a84041fbd1889410"},
+		{"token of another tenant", "/metrics/tenant/tenant-b", "Bearer token-a", http.StatusUnauthorized, ""},
+		{"tenant token for its application", "/metrics/application/app-a", "Bearer token-a", http.StatusUnauthorized, ""},
+		{"no token", "/metrics/tenant/tenant-a", "", http.StatusUnauthorized, ""},
+		{"token without bearer", "/metrics/tenant/tenant-a", "token-a", http.StatusUnauthorized, ""},
+		{"unknown id", "/metrics/tenant/tenant-c", "Bearer token-a", http.StatusUnauthorized, ""},
+		{"unknown id without token", "/metrics/tenant/tenant-c", "", http.StatusUnauthorized, ""},
+		{"no id", "/metrics/tenant/", "Bearer token-a", http.StatusUnauthorized, ""},
+		{"sub path", "/metrics/tenant/tenant-a/x", "Bearer token-a", http.StatusUnauthorized, ""},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if len(test.auth) > 0 {
+				r.Header.Set("Authorization", test.auth)
+			}
+			w := httptest.NewRecorder()
+			e.Handler().ServeHTTP(w, r)
+			if w.Code != test.wantCode {
+				t.Fatalf("got %d, want %d", w.Code, test.wantCode)
+			}
+			body, _ := io.ReadAll(w.Body)
+			if w.Code != http.StatusOK {
+				if strings.Contains(string(body), "deviceEui") {
+					t.Errorf("got series without auth: %s", body)
+				}
+				return
+			}
+			var samples int
+			for _, line := range strings.Split(string(body), "\n") {
+				if len(line) == 0 || strings.HasPrefix(line, "#") {
+					continue
+				}
+				samples++
+				// Every series is of the device, nothing of the other
+				// tenant and no exporter internals
+				if !strings.Contains(line, `deviceEui="`+test.wantDevice+`"`) {
+					t.Errorf("got series %s", line)
+				}
+			}
+			if samples == 0 {
+				t.Errorf("got no series of %s", test.wantDevice)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+)
+
+// traceContext identifies a span, it is what children and forwarded
+// requests need to join the trace
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+}
+
+func (c traceContext) valid() bool {
+	return c.traceID != [16]byte{} && c.spanID != [8]byte{}
+}
+
+// traceparent returns the w3c traceparent header value
+func (c traceContext) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", c.traceID, c.spanID)
+}
+
+// parseTraceparent reads a w3c traceparent header, the zero value if it is
+// missing or invalid
+func parseTraceparent(header string) traceContext {
+	var c traceContext
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceContext{}
+	}
+	if _, err := hex.Decode(c.traceID[:], []byte(parts[1])); err != nil {
+		return traceContext{}
+	}
+	if _, err := hex.Decode(c.spanID[:], []byte(parts[2])); err != nil {
+		return traceContext{}
+	}
+	return c
+}
+
+// tracer queues the finished spans for export. All methods are safe on a nil
+// tracer, which is what you get with tracing off.
+type tracer struct {
+	queue   chan *tracepb.Span
+	dropped prometheus.Counter
+}
+
+// span is a span being recorded, it is queued for export when finished. All
+// methods are safe on a nil span, which is what a nil tracer starts.
+type span struct {
+	tracer *tracer
+	ctx    traceContext
+	proto  *tracepb.Span
+}
+
+// startSpan starts a span, a new trace if parent is not valid
+func (t *tracer) startSpan(parent traceContext, name string, kind tracepb.Span_SpanKind) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, ctx: traceContext{traceID: parent.traceID}}
+	if parent.traceID == [16]byte{} {
+		rand.Read(s.ctx.traceID[:])
+	}
+	rand.Read(s.ctx.spanID[:])
+	s.proto = &tracepb.Span{
+		TraceId:           s.ctx.traceID[:],
+		SpanId:            s.ctx.spanID[:],
+		Name:              name,
+		Kind:              kind,
+		StartTimeUnixNano: uint64(time.Now().UnixNano()),
+	}
+	if parent.valid() {
+		s.proto.ParentSpanId = parent.spanID[:]
+	}
+	return s
+}
+
+// child starts an internal span under s, eg a stage of the webhook
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.startSpan(s.ctx, name, tracepb.Span_SPAN_KIND_INTERNAL)
+}
+
+// context returns the trace context of s, the zero value for a nil span
+func (s *span) context() traceContext {
+	if s == nil {
+		return traceContext{}
+	}
+	return s.ctx
+}
+
+func (s *span) setString(key string, value string) {
+	if s == nil || len(value) == 0 {
+		return
+	}
+	s.proto.Attributes = append(s.proto.Attributes, otlpString(key, value))
+}
+
+func (s *span) setInt(key string, value int) {
+	if s == nil {
+		return
+	}
+	s.proto.Attributes = append(s.proto.Attributes, &commonpb.KeyValue{Key: key, Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: int64(value)}}})
+}
+
+// setDevice adds the chirpstack ids and names of the device to the span
+func (s *span) setDevice(info chirpstack.DeviceInfo) {
+	if s == nil {
+		return
+	}
+	s.proto.Attributes = append(s.proto.Attributes, otlpDeviceAttributes(info)...)
+}
+
+// finish ends the span, with an error status if err is set, and queues it
+// for export
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.proto.EndTimeUnixNano = uint64(time.Now().UnixNano())
+	if err != nil {
+		s.proto.Status = &tracepb.Status{Code: tracepb.Status_STATUS_CODE_ERROR, Message: err.Error()}
+	}
+	select {
+	case s.tracer.queue <- s.proto:
+	default:
+		s.tracer.dropped.Inc()
+	}
+}
+
+// startWebhookSpan starts the root span of a webhook request, joining the
+// trace of the caller if it sent a traceparent header
+func (t *tracer) startWebhookSpan(r *http.Request) *span {
+	s := t.startSpan(parseTraceparent(r.Header.Get("traceparent")), "webhook", tracepb.Span_SPAN_KIND_SERVER)
+	s.setString("http.method", r.Method)
+	s.setString("http.target", r.URL.Path)
+	return s
+}
@@ -0,0 +1,118 @@
+// Dashboard of the devices known to lora_exporter, refreshed every 15s
+"use strict";
+
+const api = "../api/v1/devices";
+let devices = [];
+let selected = null;
+
+function esc(s) {
+  return String(s === null || s === undefined ? "" : s).replace(/[&<>"']/g, (c) => ({
+    "&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;",
+  }[c]));
+}
+
+function ago(t) {
+  const secs = Math.round((Date.now() - new Date(t).getTime()) / 1000);
+  if (secs < 60) return secs + "s ago";
+  if (secs < 3600) return Math.round(secs / 60) + "m ago";
+  if (secs < 86400) return Math.round(secs / 3600) + "h ago";
+  return Math.round(secs / 86400) + "d ago";
+}
+
+// bestGateway is the gateway with the strongest last rssi
+function bestGateway(d) {
+  return d.gateways.reduce((best, g) => (best === null || g.rssi > best.rssi ? g : best), null);
+}
+
+function readings(d) {
+  return Object.keys(d.measurements).sort()
+    .map((k) => esc(k) + "=" + esc(d.measurements[k])).join(", ");
+}
+
+function battery(d) {
+  if (d.battery === null) return d.externalPower ? "external" : "";
+  return '<span class="' + (d.battery < 20 ? "low" : "") + '">' + esc(d.battery) + "</span>";
+}
+
+function matches(d, filter) {
+  return [d.devEui, d.name, d.vendor, d.deviceProfileName, d.applicationName, d.tenantName]
+    .some((s) => s.toLowerCase().includes(filter));
+}
+
+function render() {
+  const filter = document.getElementById("filter").value.toLowerCase();
+  const shown = devices.filter((d) => matches(d, filter));
+  document.getElementById("count").textContent = "(" + shown.length + "/" + devices.length + ")";
+  document.querySelector("#devices tbody").innerHTML = shown.map((d) => {
+    const g = bestGateway(d);
+    return '<tr data-eui="' + esc(d.devEui) + '">' +
+      '<td><span class="dot' + (d.stale ? " stale" : "") + '" title="' + (d.stale ? "stale" : "ok") + '"></span></td>' +
+      "<td>" + esc(d.name) + '<div class="small">' + esc(d.devEui) + "</div></td>" +
+      "<td>" + esc(d.vendor || d.oui) + '<div class="small">' + esc(d.deviceProfileName) + "</div></td>" +
+      "<td>" + esc(d.applicationName) + '<div class="small">' + esc(d.tenantName) + "</div></td>" +
+      '<td title="' + esc(d.lastSeen) + '">' + ago(d.lastSeen) + "</td>" +
+      "<td>" + battery(d) + "</td>" +
+      "<td>" + (g ? esc(g.rssi) + " / " + esc(g.snr) + '<div class="small">' + esc(g.gatewayId) + "</div>" : "") + "</td>" +
+      "<td>" + readings(d) + "</td></tr>";
+  }).join("");
+
+  const unsupported = devices.filter((d) => !d.supported || d.unsupportedMeasurementIds.length > 0);
+  document.querySelector("#unsupported tbody").innerHTML = unsupported.map((d) => {
+    const reason = !d.supported ? "unsupported OUI" : "unknown measurementId " + d.unsupportedMeasurementIds.join(", ");
+    return '<tr data-eui="' + esc(d.devEui) + '">' +
+      "<td>" + esc(d.name) + '<div class="small">' + esc(d.devEui) + "</div></td>" +
+      "<td>" + esc(d.oui) + "</td><td>" + esc(d.deviceProfileName) + "</td>" +
+      "<td>" + esc(reason) + "</td>" +
+      '<td title="' + esc(d.lastSeen) + '">' + ago(d.lastSeen) + "</td></tr>";
+  }).join("") || '<tr><td colspan="5" class="hint">None</td></tr>';
+}
+
+async function showDetail(devEui) {
+  selected = devEui;
+  const res = await fetch(api + "/" + encodeURIComponent(devEui));
+  const section = document.getElementById("detail");
+  if (!res.ok) {
+    section.hidden = true;
+    return;
+  }
+  const d = await res.json();
+  const gateways = d.gateways.map((g) =>
+    "<li>" + esc(g.gatewayId) + ": rssi " + esc(g.rssi) + ", snr " + esc(g.snr) + ", " + ago(g.lastSeen) + "</li>").join("");
+  const errors = d.errors.slice().reverse().map((e) =>
+    "<li>" + esc(e.time) + " [" + esc(e.event) + "] " + esc(e.error) + "</li>").join("");
+  const dumps = d.dumps.slice().reverse().map((f) =>
+    '<li><a href="' + api + "/" + encodeURIComponent(d.devEui) + "/dumps/" + encodeURIComponent(f.name) + '">' +
+    esc(f.name) + "</a> " + ago(f.time) + "</li>").join("");
+  section.innerHTML = "<h2>" + esc(d.name) + " <span class=\"small\">" + esc(d.devEui) + "</span></h2>" +
+    "<p>" + esc(d.vendor || "unsupported") + " " + esc(d.deviceProfileName) + ", " + esc(d.uplinks) +
+    " uplinks since " + esc(d.firstSeen) + ", last seen " + ago(d.lastSeen) + "</p>" +
+    "<h3>Readings</h3><p>" + (readings(d) || "none") + ' <span class="small">' +
+    (d.measurementsTime.startsWith("0001") ? "" : ago(d.measurementsTime)) + "</span></p>" +
+    "<h3>Gateways</h3><ul>" + gateways + "</ul>" +
+    "<h3>Decode errors</h3>" + (errors ? "<ul>" + errors + "</ul>" : "<p>none</p>") +
+    "<h3>Recent dumps</h3>" + (dumps ? "<ul>" + dumps + "</ul>" : '<p class="hint">none, set DUMP_FOLDER to keep them</p>') +
+    "<h3>Last uplink</h3><pre>" + esc(JSON.stringify(d.lastUplink, null, 2)) + "</pre>";
+  section.hidden = false;
+}
+
+async function refresh() {
+  try {
+    const res = await fetch(api);
+    devices = (await res.json()).devices;
+    render();
+    document.getElementById("updated").textContent = "updated " + new Date().toLocaleTimeString();
+    if (selected) showDetail(selected);
+  } catch (e) {
+    document.getElementById("updated").textContent = "update failed: " + e;
+  }
+}
+
+document.getElementById("filter").addEventListener("input", render);
+for (const id of ["devices", "unsupported"]) {
+  document.querySelector("#" + id + " tbody").addEventListener("click", (e) => {
+    const row = e.target.closest("tr[data-eui]");
+    if (row && e.target.tagName !== "A") showDetail(row.dataset.eui);
+  });
+}
+refresh();
+setInterval(refresh, 15000);
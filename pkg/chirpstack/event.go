@@ -0,0 +1,192 @@
+// Package chirpstack has the events the chirpstack v4 http integration posts,
+// as typed structs.
+package chirpstack
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The event query parameter chirpstack sets on every webhook
+const (
+	EventUp          = "up"
+	EventJoin        = "join"
+	EventAck         = "ack"
+	EventTxAck       = "txack"
+	EventLog         = "log"
+	EventStatus      = "status"
+	EventLocation    = "location"
+	EventIntegration = "integration"
+)
+
+// Event is one of the typed events below, use a type switch to get at it
+type Event interface {
+	EventHeader() Header
+}
+
+// Header is what every event has. DeduplicationID is empty for the events
+// that are not about an uplink.
+type Header struct {
+	DeduplicationID string     `json:"deduplicationId"`
+	Time            time.Time  `json:"time"`
+	DeviceInfo      DeviceInfo `json:"deviceInfo"`
+}
+
+// EventHeader returns the header of the event
+func (h Header) EventHeader() Header {
+	return h
+}
+
+type DeviceInfo struct {
+	TenantID           string            `json:"tenantId"`
+	TenantName         string            `json:"tenantName"`
+	ApplicationID      string            `json:"applicationId"`
+	ApplicationName    string            `json:"applicationName"`
+	DeviceProfileID    string            `json:"deviceProfileId"`
+	DeviceProfileName  string            `json:"deviceProfileName"`
+	DeviceName         string            `json:"deviceName"`
+	DevEui             string            `json:"devEui"`
+	DeviceClassEnabled string            `json:"deviceClassEnabled"`
+	Tags               map[string]string `json:"tags"`
+}
+
+// RxInfo is a gateway that received the uplink
+type RxInfo struct {
+	GatewayID string  `json:"gatewayId"`
+	UplinkID  int     `json:"uplinkId"`
+	Rssi      int     `json:"rssi"`
+	Snr       float64 `json:"snr"`
+	Channel   int     `json:"channel"`
+	Location  struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+	} `json:"location"`
+	Context  string `json:"context"`
+	Metadata struct {
+		RegionConfigID   string `json:"region_config_id"`
+		RegionCommonName string `json:"region_common_name"`
+	} `json:"metadata"`
+	CrcStatus string `json:"crcStatus"`
+}
+
+type TxInfo struct {
+	Frequency  int `json:"frequency"`
+	Modulation struct {
+		Lora struct {
+			Bandwidth       int    `json:"bandwidth"`
+			SpreadingFactor int    `json:"spreadingFactor"`
+			CodeRate        string `json:"codeRate"`
+		} `json:"lora"`
+	} `json:"modulation"`
+}
+
+// UplinkEvent is an uplink, Object is what the codec of the device profile
+// decoded and is left for the vendor decoders
+type UplinkEvent struct {
+	Header
+	DevAddr   string          `json:"devAddr"`
+	Adr       bool            `json:"adr"`
+	Dr        int             `json:"dr"`
+	FCnt      int             `json:"fCnt"`
+	FPort     int             `json:"fPort"`
+	Confirmed bool            `json:"confirmed"`
+	Data      string          `json:"data"`
+	Object    json.RawMessage `json:"object"`
+	RxInfo    []RxInfo        `json:"rxInfo"`
+	TxInfo    TxInfo          `json:"txInfo"`
+}
+
+type JoinEvent struct {
+	Header
+	DevAddr string `json:"devAddr"`
+}
+
+type AckEvent struct {
+	Header
+	QueueItemID  string `json:"queueItemId"`
+	Acknowledged bool   `json:"acknowledged"`
+	FCntDown     int    `json:"fCntDown"`
+}
+
+type TxAckEvent struct {
+	Header
+	DownlinkID  int    `json:"downlinkId"`
+	QueueItemID string `json:"queueItemId"`
+	FCntDown    int    `json:"fCntDown"`
+	GatewayID   string `json:"gatewayId"`
+	TxInfo      TxInfo `json:"txInfo"`
+}
+
+// LogEvent is an error or warning chirpstack logged for the device, eg a
+// codec that failed
+type LogEvent struct {
+	Header
+	Level       string            `json:"level"`
+	Code        string            `json:"code"`
+	Description string            `json:"description"`
+	Context     map[string]string `json:"context"`
+}
+
+// StatusEvent is the answer of the device to a DevStatusReq
+type StatusEvent struct {
+	Header
+	Margin                  int     `json:"margin"`
+	ExternalPowerSource     bool    `json:"externalPowerSource"`
+	BatteryLevelUnavailable bool    `json:"batteryLevelUnavailable"`
+	BatteryLevel            float64 `json:"batteryLevel"`
+}
+
+// LocationEvent is a location chirpstack resolved, eg by geolocation
+type LocationEvent struct {
+	Header
+	Location struct {
+		Latitude  float64 `json:"latitude"`
+		Longitude float64 `json:"longitude"`
+		Altitude  float64 `json:"altitude"`
+		Source    string  `json:"source"`
+		Accuracy  float64 `json:"accuracy"`
+	} `json:"location"`
+}
+
+type IntegrationEvent struct {
+	Header
+	IntegrationName string          `json:"integrationName"`
+	EventType       string          `json:"eventType"`
+	Object          json.RawMessage `json:"object"`
+}
+
+// ErrUnknownEvent is returned by ParseEvent for an event it has no type for,
+// newer chirpstack versions may post those
+var ErrUnknownEvent = errors.New("unknown event")
+
+// ParseEvent unmarshals a webhook body into the typed event of event, eg
+// *UplinkEvent for up
+func ParseEvent(event string, body []byte) (Event, error) {
+	var ev Event
+	switch event {
+	case EventUp:
+		ev = &UplinkEvent{}
+	case EventJoin:
+		ev = &JoinEvent{}
+	case EventAck:
+		ev = &AckEvent{}
+	case EventTxAck:
+		ev = &TxAckEvent{}
+	case EventLog:
+		ev = &LogEvent{}
+	case EventStatus:
+		ev = &StatusEvent{}
+	case EventLocation:
+		ev = &LocationEvent{}
+	case EventIntegration:
+		ev = &IntegrationEvent{}
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownEvent, event)
+	}
+	if err := json.Unmarshal(body, ev); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
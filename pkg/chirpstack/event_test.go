@@ -0,0 +1,142 @@
+package chirpstack
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDeviceInfo = `"deviceInfo":{"tenantName":"moomooland","applicationName":"elvinApps","deviceName":"dragino-lht52-889410","devEui":"a84041fbd1889410","tags":{"site":"lab"}}`
+
+func TestParseEvent(t *testing.T) {
+	eventTime := time.Date(2023, 8, 23, 12, 22, 49, 286299413, time.UTC)
+	header := Header{
+		Time: eventTime,
+		DeviceInfo: DeviceInfo{
+			TenantName:      "moomooland",
+			ApplicationName: "elvinApps",
+			DeviceName:      "dragino-lht52-889410",
+			DevEui:          "a84041fbd1889410",
+			Tags:            map[string]string{"site": "lab"},
+		},
+	}
+	uplinkHeader := header
+	uplinkHeader.DeduplicationID = "7c7e7a67-0e1a-4a5c-8d1c-0f5d3a4b1c2d"
+
+	tests := []struct {
+		event string
+		body  string
+		check func(t *testing.T, ev Event)
+	}{
+		{EventUp, `{"deduplicationId":"7c7e7a67-0e1a-4a5c-8d1c-0f5d3a4b1c2d","time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,
+			"fCnt":9,"fPort":2,"object":{"TempC_SHT":28.41},"rxInfo":[{"gatewayId":"2cf7f11353100025","rssi":-87,"snr":9.5}],
+			"txInfo":{"frequency":923200000,"modulation":{"lora":{"spreadingFactor":7}}}}`,
+			func(t *testing.T, ev Event) {
+				up := ev.(*UplinkEvent)
+				if up.FCnt != 9 || up.FPort != 2 || string(up.Object) != `{"TempC_SHT":28.41}` {
+					t.Errorf("got fCnt %d, fPort %d and object %s", up.FCnt, up.FPort, up.Object)
+				}
+				if len(up.RxInfo) != 1 || up.RxInfo[0].GatewayID != "2cf7f11353100025" || up.RxInfo[0].Rssi != -87 || up.RxInfo[0].Snr != 9.5 {
+					t.Errorf("got rxInfo %+v", up.RxInfo)
+				}
+				if up.TxInfo.Frequency != 923200000 || up.TxInfo.Modulation.Lora.SpreadingFactor != 7 {
+					t.Errorf("got txInfo %+v", up.TxInfo)
+				}
+			}},
+		{EventJoin, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"devAddr":"00d4b4a1"}`,
+			func(t *testing.T, ev Event) {
+				if join := ev.(*JoinEvent); join.DevAddr != "00d4b4a1" {
+					t.Errorf("got devAddr %q", join.DevAddr)
+				}
+			}},
+		{EventAck, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"queueItemId":"q1","acknowledged":true,"fCntDown":3}`,
+			func(t *testing.T, ev Event) {
+				if ack := ev.(*AckEvent); ack.QueueItemID != "q1" || !ack.Acknowledged || ack.FCntDown != 3 {
+					t.Errorf("got %+v", ack)
+				}
+			}},
+		{EventTxAck, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"downlinkId":12,"queueItemId":"q1","fCntDown":3,"gatewayId":"2cf7f11353100025"}`,
+			func(t *testing.T, ev Event) {
+				if txack := ev.(*TxAckEvent); txack.DownlinkID != 12 || txack.GatewayID != "2cf7f11353100025" {
+					t.Errorf("got %+v", txack)
+				}
+			}},
+		{EventLog, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"level":"ERROR","code":"UPLINK_CODEC","description":"codec failed","context":{"deduplication_id":"x"}}`,
+			func(t *testing.T, ev Event) {
+				log := ev.(*LogEvent)
+				if log.Level != "ERROR" || log.Code != "UPLINK_CODEC" || log.Description != "codec failed" || log.Context["deduplication_id"] != "x" {
+					t.Errorf("got %+v", log)
+				}
+			}},
+		{EventStatus, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"margin":7,"externalPowerSource":false,"batteryLevel":87.5}`,
+			func(t *testing.T, ev Event) {
+				if status := ev.(*StatusEvent); status.Margin != 7 || status.BatteryLevel != 87.5 || status.BatteryLevelUnavailable {
+					t.Errorf("got %+v", status)
+				}
+			}},
+		{EventLocation, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"location":{"latitude":1.4437,"longitude":103.8074,"altitude":15,"source":"GEO_RESOLVER_TDOA","accuracy":20}}`,
+			func(t *testing.T, ev Event) {
+				loc := ev.(*LocationEvent).Location
+				if loc.Latitude != 1.4437 || loc.Longitude != 103.8074 || loc.Altitude != 15 || loc.Source != "GEO_RESOLVER_TDOA" || loc.Accuracy != 20 {
+					t.Errorf("got %+v", loc)
+				}
+			}},
+		{EventIntegration, `{"time":"2023-08-23T12:22:49.286299413Z",` + testDeviceInfo + `,"integrationName":"loracloud","eventType":"geolocation","object":{"a":1}}`,
+			func(t *testing.T, ev Event) {
+				integration := ev.(*IntegrationEvent)
+				if integration.IntegrationName != "loracloud" || integration.EventType != "geolocation" || string(integration.Object) != `{"a":1}` {
+					t.Errorf("got %+v", integration)
+				}
+			}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.event, func(t *testing.T) {
+			ev, err := ParseEvent(test.event, []byte(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := header
+			if test.event == EventUp {
+				want = uplinkHeader
+			}
+			if got := ev.EventHeader(); !reflect.DeepEqual(got, want) {
+				t.Errorf("got header %+v, want %+v", got, want)
+			}
+			test.check(t, ev)
+		})
+	}
+}
+
+func TestParseEventErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       string
+		body        string
+		wantErr     string
+		wantUnknown bool
+	}{
+		{"unknown event", "downlink", `{}`, `unknown event "downlink"`, true},
+		{"no event", "", `{}`, `unknown event ""`, true},
+		{"event is case sensitive", "UP", `{}`, `unknown event "UP"`, true},
+		{"body does not parse", EventUp, `{"fCnt":`, "unexpected end of JSON input", false},
+		{"wrong type", EventStatus, `{"margin":"high"}`, "cannot unmarshal string", false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ev, err := ParseEvent(test.event, []byte(test.body))
+			if err == nil {
+				t.Fatalf("got %+v, want an error", ev)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("got error %q, want %q", err, test.wantErr)
+			}
+			if errors.Is(err, ErrUnknownEvent) != test.wantUnknown {
+				t.Errorf("got error %q, want ErrUnknownEvent %v", err, test.wantUnknown)
+			}
+		})
+	}
+}
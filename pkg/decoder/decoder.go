@@ -0,0 +1,124 @@
+// Package decoder turns the decoded object of chirpstack uplinks into typed
+// measurements, with a decoder per vendor picked by the OUI of the devEui.
+package decoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+)
+
+// Measurement is a single decoded value of an uplink, type is what ends up in
+// the type label of lora_devices_metric
+type Measurement struct {
+	Type  string    `json:"type"`
+	Value float64   `json:"value"`
+	Unit  string    `json:"unit,omitempty"`
+	Time  time.Time `json:"time"`
+	// Field is where in the webhook the value came from, eg object.TempC_SHT
+	Field string `json:"field,omitempty"`
+}
+
+// Location is a position fix reported by a device. Fields the decoder did
+// not find are left null.
+type Location struct {
+	Latitude  null.Float
+	Longitude null.Float
+	Altitude  null.Float
+	Accuracy  null.Float
+}
+
+// Result is what the decoders found in an uplink
+type Result struct {
+	// Decoder is the vendor decoder used, empty for an unsupported OUI
+	Decoder      string
+	Measurements []Measurement
+	Location     Location
+	// Errors are what could not be decoded, the rest of the uplink still is
+	Errors []error
+	// SenseCAP measurement ids without a type in SenseCAPMeasurementTypes
+	UnsupportedMeasurementIDs []string
+	// UsedFields are the object fields the decoder looked at, set or not
+	UsedFields []string
+
+	time time.Time
+}
+
+// vendor is a supported OUI, decode adds what it finds in the object to r
+type vendor struct {
+	name    string
+	decoder string
+	decode  func(object json.RawMessage, r *Result) error
+}
+
+var vendors = map[string]vendor{
+	"2c:f7:f1": {name: "SenseCAP", decoder: "sensecap", decode: decodeSensecap},
+	"ca:cb:b8": {name: "Rejee", decoder: "rejee", decode: decodeRejee},
+	"a8:40:41": {name: "Dragino", decoder: "dragino", decode: decodeDragino},
+	"24:e1:24": {name: "Milesight", decoder: "milesight", decode: decodeMilesight},
+}
+
+// Decode runs the vendor decoder of the device and picks up the generic gps
+// fields. It only fails if the object does not parse, an unsupported
+// measurement is in Result.Errors and an unsupported OUI leaves
+// Result.Decoder empty.
+func Decode(ev *chirpstack.UplinkEvent) (*Result, error) {
+	r := &Result{time: ev.Time}
+	oui := OUI(ev.DeviceInfo.DevEui)
+	if v, found := vendors[oui]; found {
+		r.Decoder = v.decoder
+		if err := v.decode(ev.Object, r); err != nil {
+			return nil, err
+		}
+	}
+	if err := decodeLocation(ev.Object, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// OUI returns the OUI of a devEui in xx:xx:xx hex format
+func OUI(devEui string) string {
+	if len(devEui) >= 6 {
+		return strings.ToLower(fmt.Sprintf("%s:%s:%s", devEui[0:2], devEui[2:4], devEui[4:6]))
+	} else {
+		return "00:00:00"
+	}
+}
+
+// Vendor returns the vendor name of a devEui, empty if there is no decoder
+// for its OUI
+func Vendor(devEui string) string {
+	return vendors[OUI(devEui)].name
+}
+
+func (r *Result) addMeasurement(metricType string, value float64, field string) {
+	r.Measurements = append(r.Measurements, Measurement{Type: metricType, Value: value, Unit: Types[metricType].Unit, Time: r.time, Field: field})
+}
+
+// addField adds a nullable field of the decoded object as a measurement if it
+// is set, field is its json path in object
+func (r *Result) addField(metricType string, value null.Float, field string) {
+	r.UsedFields = append(r.UsedFields, field)
+	if value.Valid {
+		r.addMeasurement(metricType, value.Float64, "object."+field)
+	}
+}
+
+// unmarshalObject is json.Unmarshal that takes a missing object as empty
+func unmarshalObject(object json.RawMessage, v interface{}) error {
+	if len(object) == 0 {
+		return nil
+	}
+	return json.Unmarshal(object, v)
+}
+
+// This casts json.Number without the error
+func castToFloat64(num json.Number) float64 {
+	f, _ := num.Float64()
+	return f
+}
@@ -0,0 +1,281 @@
+package decoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/visago/lora_exporter/pkg/chirpstack"
+)
+
+type decodeTest struct {
+	name        string
+	devEui      string
+	object      string
+	want        []string // type=value, in order
+	wantErrors  []string
+	wantIDs     []string
+	wantDecoder string
+	wantErr     bool
+}
+
+func runDecodeTests(t *testing.T, tests []decodeTest) {
+	t.Helper()
+	uplinkTime := time.Date(2023, 8, 23, 12, 22, 49, 0, time.UTC)
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ev := &chirpstack.UplinkEvent{Object: json.RawMessage(test.object)}
+			ev.Time = uplinkTime
+			ev.DeviceInfo.DevEui = test.devEui
+			r, err := Decode(ev)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, m := range r.Measurements {
+				got = append(got, fmt.Sprintf("%s=%v", m.Type, m.Value))
+				if !m.Time.Equal(uplinkTime) {
+					t.Errorf("%s has time %s, want the uplink time", m.Type, m.Time)
+				}
+				if m.Unit != Types[m.Type].Unit {
+					t.Errorf("%s has unit %q, want %q", m.Type, m.Unit, Types[m.Type].Unit)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got measurements %v, want %v", got, test.want)
+			}
+			var errors []string
+			for _, err := range r.Errors {
+				errors = append(errors, err.Error())
+			}
+			if !reflect.DeepEqual(errors, test.wantErrors) {
+				t.Errorf("got errors %v, want %v", errors, test.wantErrors)
+			}
+			if !reflect.DeepEqual(r.UnsupportedMeasurementIDs, test.wantIDs) {
+				t.Errorf("got unsupported ids %v, want %v", r.UnsupportedMeasurementIDs, test.wantIDs)
+			}
+			if r.Decoder != test.wantDecoder {
+				t.Errorf("got decoder %q, want %q", r.Decoder, test.wantDecoder)
+			}
+		})
+	}
+}
+
+func TestDecodeSenseCAP(t *testing.T) {
+	runDecodeTests(t, []decodeTest{
+		{
+			name:   "messages",
+			devEui: "2cf7f1c053300259",
+			object: `{"messages":[
+				{"measurementId":"4097","measurementValue":28.4,"type":"report_telemetry"},
+				{"measurementId":4098,"measurementValue":"61"},
+				{"type":"upload_battery","battery":93},
+				{"type":"upload_interval","interval":3600}]}`,
+			want:        []string{"airTemperature=28.4", "airHumidity=61", "battery=93", "interval=3600"},
+			wantDecoder: "sensecap",
+		},
+		{
+			name:   "array of message arrays",
+			devEui: "2cf7f1c053300259",
+			object: `{"messages":[
+				[{"measurementId":"4198","measurementValue":1.4437},{"measurementId":"4197","measurementValue":103.8074}],
+				[{"measurementId":"3000","measurementValue":80}]]}`,
+			want:        []string{"latitude=1.4437", "longitude=103.8074", "battery=80"},
+			wantDecoder: "sensecap",
+		},
+		{
+			name:        "unknown measurementId",
+			devEui:      "2cf7f1c053300259",
+			object:      `{"messages":[{"measurementId":"9999","measurementValue":1},{"measurementId":"4097.5","measurementValue":2},{"measurementId":"4100","measurementValue":412}]}`,
+			want:        []string{"co2=412"},
+			wantErrors:  []string{"measurementId 9999 is not supported", "measurementId 4097.5 is not supported"},
+			wantIDs:     []string{"9999", "4097.5"},
+			wantDecoder: "sensecap",
+		},
+		{
+			name:        "no measurementId",
+			devEui:      "2cf7f1c053300259",
+			object:      `{"messages":[{"measurementValue":1,"type":"report_telemetry"}]}`,
+			wantDecoder: "sensecap",
+		},
+		{
+			name:        "no object",
+			devEui:      "2cf7f1c053300259",
+			wantDecoder: "sensecap",
+		},
+		{
+			name:    "messages not an array",
+			devEui:  "2cf7f1c053300259",
+			object:  `{"messages":{"measurementId":"4097"}}`,
+			wantErr: true,
+		},
+	})
+}
+
+func TestDecodeDragino(t *testing.T) {
+	runDecodeTests(t, []decodeTest{
+		{
+			name:        "lht52",
+			devEui:      "a84041fbd1889410",
+			object:      `{"TempC_SHT":28.41,"Hum_SHT":40.8,"TempC_DS":null,"BAT_V":3.07}`,
+			want:        []string{"airTemperature=28.41", "airHumidity=40.8", "batteryVolts=3.07"},
+			wantDecoder: "dragino",
+		},
+		{
+			name:        "ld02 door",
+			devEui:      "A840410000000001",
+			object:      `{"DOOR_OPEN_STATUS":1,"DOOR_OPEN_TIMES":12,"LAST_DOOR_OPEN_DURATION":0,"ALARM":null,"MOD":1}`,
+			want:        []string{"lastOpenDuration=0", "openCount=12", "mod=1", "openStatus=1"},
+			wantDecoder: "dragino",
+		},
+		{
+			name:        "all null",
+			devEui:      "a84041fbd1889410",
+			object:      `{"TempC_SHT":null,"Hum_SHT":null,"WATER_LEAK_STATUS":null}`,
+			wantDecoder: "dragino",
+		},
+		{
+			name:    "wrong type",
+			devEui:  "a84041fbd1889410",
+			object:  `{"TempC_SHT":"hot"}`,
+			wantErr: true,
+		},
+	})
+}
+
+func TestDecodeMilesight(t *testing.T) {
+	runDecodeTests(t, []decodeTest{
+		{
+			name:        "em300",
+			devEui:      "24e124126d392076",
+			object:      `{"temperature":26.8,"humidity":null,"battery":95}`,
+			want:        []string{"temperature=26.8", "battery=95"},
+			wantDecoder: "milesight",
+		},
+		{
+			name:        "decoded",
+			devEui:      "24e124126d392076",
+			object:      `{"decoded":{"temperature":21.5,"humidity":55,"battery":null}}`,
+			want:        []string{"airTemperature=21.5", "airHumidity=55"},
+			wantDecoder: "milesight",
+		},
+		{
+			name:        "position",
+			devEui:      "24e124126d392076",
+			object:      `{"distance":1200,"position":"tilt"}`,
+			want:        []string{"distance=1200", "position=1"},
+			wantDecoder: "milesight",
+		},
+		{
+			name:        "all null",
+			devEui:      "24e124126d392076",
+			object:      `{"temperature":null,"distance":null,"position":""}`,
+			wantDecoder: "milesight",
+		},
+	})
+}
+
+func TestDecodeRejee(t *testing.T) {
+	runDecodeTests(t, []decodeTest{
+		{
+			name:        "temperature",
+			devEui:      "cacbb80000000001",
+			object:      `{"temperature":24,"humidity":70,"battery":null,"vol":3.3}`,
+			want:        []string{"airTemperature=24", "airHumidity=70", "vol=3.3"},
+			wantDecoder: "rejee",
+		},
+	})
+}
+
+func TestDecodeUnsupported(t *testing.T) {
+	runDecodeTests(t, []decodeTest{
+		{
+			name:   "unsupported OUI",
+			devEui: "0016c001f0000001",
+			object: `{"temperature":20}`,
+		},
+		{
+			name:   "short devEui",
+			devEui: "0016",
+		},
+		{
+			name:    "object does not parse",
+			devEui:  "0016c001f0000001",
+			object:  `[1,2]`,
+			wantErr: true,
+		},
+	})
+}
+
+func TestDecodeLocation(t *testing.T) {
+	tests := []struct {
+		name   string
+		devEui string
+		object string
+		want   Location
+	}{
+		{"full fix", "0016c001f0000001", `{"latitude":1.4437,"longitude":103.8074,"altitude":15,"accuracy":5}`,
+			Location{null.FloatFrom(1.4437), null.FloatFrom(103.8074), null.FloatFrom(15), null.FloatFrom(5)}},
+		{"no altitude or accuracy", "0016c001f0000001", `{"latitude":1.4437,"longitude":103.8074,"altitude":null}`,
+			Location{Latitude: null.FloatFrom(1.4437), Longitude: null.FloatFrom(103.8074)}},
+		{"latitude only", "0016c001f0000001", `{"latitude":1.4437}`, Location{}},
+		{"sensecap", "2cf7f1c053300259", `{"messages":[{"measurementId":"4198","measurementValue":1.5},{"measurementId":"4197","measurementValue":103.9}]}`,
+			Location{Latitude: null.FloatFrom(1.5), Longitude: null.FloatFrom(103.9)}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			ev := &chirpstack.UplinkEvent{Object: json.RawMessage(test.object)}
+			ev.DeviceInfo.DevEui = test.devEui
+			r, err := Decode(ev)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(r.Location, test.want) {
+				t.Errorf("got %+v, want %+v", r.Location, test.want)
+			}
+		})
+	}
+}
+
+func TestOUIAndVendor(t *testing.T) {
+	tests := []struct {
+		devEui     string
+		wantOUI    string
+		wantVendor string
+	}{
+		{"2CF7F1C053300259", "2c:f7:f1", "SenseCAP"},
+		{"a84041fbd1889410", "a8:40:41", "Dragino"},
+		{"24e124126d392076", "24:e1:24", "Milesight"},
+		{"cacbb80000000001", "ca:cb:b8", "Rejee"},
+		{"0016c001f0000001", "00:16:c0", ""},
+		{"", "00:00:00", ""},
+	}
+	for _, test := range tests {
+		if got := OUI(test.devEui); got != test.wantOUI {
+			t.Errorf("OUI(%q) = %q, want %q", test.devEui, got, test.wantOUI)
+		}
+		if got := Vendor(test.devEui); got != test.wantVendor {
+			t.Errorf("Vendor(%q) = %q, want %q", test.devEui, got, test.wantVendor)
+		}
+	}
+}
+
+// TestTypes checks every measurement a decoder can produce has a type
+func TestTypes(t *testing.T) {
+	for id, name := range SenseCAPMeasurementTypes {
+		if _, ok := Types[name]; !ok {
+			t.Errorf("sensecap measurementId %d is %s, which is not in Types", id, name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package decoder
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/guregu/null"
+)
+
+// SenseCAPMeasurementTypes are the measurement types of the SenseCAP
+// measurement ids, https://sensecap-docs.seeed.cc/measurement_list.html
+var SenseCAPMeasurementTypes = map[int]string{
+	3000: "battery",
+	3940: "sosMode",
+	3941: "workMode",
+	4097: "airTemperature",
+	4098: "airHumidity",
+	4099: "lightIntensity",
+	4100: "co2",
+	4101: "barometricPressure",
+	4102: "soilTemperature",
+	4103: "soilMoisture",
+	4104: "windDirection",
+	4105: "windSpeed",
+	4106: "pH",
+	4107: "lightQuantum",
+	4108: "electricalConductivity",
+	4109: "dissolvedOxygen",
+	4204: "soilPoreWaterEletricalConductivity",
+	4205: "epsilon",
+	4197: "longitude",
+	4198: "latitude",
+	4199: "lightIntensityPercent",
+	4200: "sosEvent",
+}
+
+type sensecapMessage struct {
+	MeasurementValue json.Number `json:"measurementValue"`
+	MeasurementID    json.Number `json:"measurementId"`
+	Battery          json.Number `json:"battery"`
+	Interval         json.Number `json:"interval"`
+	Type             string      `json:"type"`
+}
+
+func decodeSensecap(object json.RawMessage, r *Result) error {
+	var doc struct {
+		Messages json.RawMessage `json:"messages"`
+	}
+	if err := unmarshalObject(object, &doc); err != nil {
+		return err
+	}
+	r.UsedFields = append(r.UsedFields, "messages")
+	messages, err := sensecapMessages(doc.Messages)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		switch m.Type {
+		case "upload_battery":
+			r.addMeasurement("battery", castToFloat64(m.Battery), "object.messages[type=upload_battery].battery")
+		case "upload_interval":
+			r.addMeasurement("interval", castToFloat64(m.Interval), "object.messages[type=upload_interval].interval")
+		default:
+			id := castToFloat64(m.MeasurementID)
+			if id <= 0 {
+				continue
+			}
+			field := fmt.Sprintf("object.messages[measurementId=%s].measurementValue", m.MeasurementID)
+			metricType, ok := SenseCAPMeasurementTypes[int(id)]
+			if !ok || float64(int(id)) != id {
+				r.Errors = append(r.Errors, fmt.Errorf("measurementId %s is not supported", m.MeasurementID))
+				r.UnsupportedMeasurementIDs = append(r.UnsupportedMeasurementIDs, m.MeasurementID.String())
+				continue
+			}
+			value := castToFloat64(m.MeasurementValue)
+			r.addMeasurement(metricType, value, field)
+			if metricType == "longitude" {
+				r.Location.Longitude = null.FloatFrom(value)
+			} else if metricType == "latitude" {
+				r.Location.Latitude = null.FloatFrom(value)
+			}
+		}
+	}
+	return nil
+}
+
+// sensecapMessages parses the messages of a SenseCAP uplink, some devices
+// send an array of arrays of messages
+func sensecapMessages(raw json.RawMessage) ([]sensecapMessage, error) {
+	var messages []sensecapMessage
+	if len(raw) == 0 {
+		return messages, nil
+	}
+	if err := json.Unmarshal(raw, &messages); err == nil {
+		return messages, nil
+	}
+	var deArray []json.RawMessage
+	if err := json.Unmarshal(raw, &deArray); err != nil {
+		return nil, err
+	}
+	for _, rawJson := range deArray {
+		var newMessages []sensecapMessage
+		if err := json.Unmarshal(rawJson, &newMessages); err != nil {
+			return nil, err
+		}
+		messages = append(messages, newMessages...)
+	}
+	return messages, nil
+}
@@ -0,0 +1,50 @@
+package decoder
+
+// MeasurementType describes a measurement type the decoders produce. The
+// device class follows home assistant naming.
+type MeasurementType struct {
+	Unit        string
+	DeviceClass string
+	Binary      bool // on/off values, 0 is off
+}
+
+// Types are the measurement types the decoders produce, by name
+var Types = map[string]MeasurementType{
+	"battery":                            {Unit: "%", DeviceClass: "battery"},
+	"batteryVolts":                       {Unit: "V", DeviceClass: "voltage"},
+	"interval":                           {Unit: "s", DeviceClass: "duration"},
+	"airTemperature":                     {Unit: "°C", DeviceClass: "temperature"},
+	"airHumidity":                        {Unit: "%", DeviceClass: "humidity"},
+	"temperature":                        {Unit: "°C", DeviceClass: "temperature"},
+	"externalTemperature":                {Unit: "°C", DeviceClass: "temperature"},
+	"soilTemperature":                    {Unit: "°C", DeviceClass: "temperature"},
+	"soilMoisture":                       {Unit: "%", DeviceClass: "moisture"},
+	"lightIntensity":                     {Unit: "lx", DeviceClass: "illuminance"},
+	"lightIntensityPercent":              {Unit: "%"},
+	"lightQuantum":                       {Unit: "μmol/m²/s"},
+	"co2":                                {Unit: "ppm", DeviceClass: "carbon_dioxide"},
+	"barometricPressure":                 {Unit: "Pa", DeviceClass: "pressure"},
+	"windDirection":                      {Unit: "°"},
+	"windSpeed":                          {Unit: "m/s", DeviceClass: "wind_speed"},
+	"pH":                                 {Unit: "pH", DeviceClass: "ph"},
+	"electricalConductivity":             {Unit: "dS/m"},
+	"soilPoreWaterEletricalConductivity": {Unit: "dS/m"},
+	"dissolvedOxygen":                    {Unit: "mg/L"},
+	"epsilon":                            {},
+	"latitude":                           {Unit: "°"},
+	"longitude":                          {Unit: "°"},
+	"sosEvent":                           {Binary: true, DeviceClass: "safety"},
+	"sosMode":                            {},
+	"workMode":                           {},
+	"distance":                           {Unit: "mm", DeviceClass: "distance"},
+	"position":                           {Binary: true, DeviceClass: "tamper"},
+	"lastOpenDuration":                   {Unit: "min", DeviceClass: "duration"},
+	"alarm":                              {Binary: true, DeviceClass: "problem"},
+	"openCount":                          {},
+	"mod":                                {},
+	"openStatus":                         {Binary: true, DeviceClass: "door"},
+	"waterLeakStatus":                    {Binary: true, DeviceClass: "moisture"},
+	"waterLeakLastDuration":              {Unit: "min", DeviceClass: "duration"},
+	"waterLeakCount":                     {},
+	"vol":                                {},
+}
@@ -0,0 +1,119 @@
+package decoder
+
+import (
+	"encoding/json"
+
+	"github.com/guregu/null"
+)
+
+func decodeRejee(object json.RawMessage, r *Result) error {
+	var doc struct {
+		Battery     null.Float `json:"battery"`
+		Temperature null.Float `json:"temperature"`
+		Humidity    null.Float `json:"humidity"`
+		Vol         null.Float `json:"vol"`
+	}
+	if err := unmarshalObject(object, &doc); err != nil {
+		return err
+	}
+	r.addField("battery", doc.Battery, "battery")
+	r.addField("airTemperature", doc.Temperature, "temperature")
+	r.addField("airHumidity", doc.Humidity, "humidity")
+	r.addField("vol", doc.Vol, "vol")
+	return nil
+}
+
+// decodeDragino handles the lht52 (temperature), ld02 (door) and lwl02
+// (water leak) codecs
+func decodeDragino(object json.RawMessage, r *Result) error {
+	var doc struct {
+		TempCSHT              null.Float `json:"TempC_SHT"`
+		TempCDS               null.Float `json:"TempC_DS"`
+		HumSHT                null.Float `json:"Hum_SHT"`
+		LastDoorOpenDuration  null.Float `json:"LAST_DOOR_OPEN_DURATION"`
+		Alarm                 null.Float `json:"ALARM"`
+		DoorOpenTimes         null.Float `json:"DOOR_OPEN_TIMES"`
+		BatV                  null.Float `json:"BAT_V"`
+		Mod                   null.Float `json:"MOD"`
+		DoorOpenStatus        null.Float `json:"DOOR_OPEN_STATUS"`
+		WaterLeakStatus       null.Float `json:"WATER_LEAK_STATUS"`
+		WaterLeakLastDuration null.Float `json:"LAST_WATER_LEAK_DURATION"`
+		WaterLeakCount        null.Float `json:"WATER_LEAK_TIMES"`
+	}
+	if err := unmarshalObject(object, &doc); err != nil {
+		return err
+	}
+	r.addField("airTemperature", doc.TempCSHT, "TempC_SHT")
+	r.addField("externalTemperature", doc.TempCDS, "TempC_DS")
+	r.addField("airHumidity", doc.HumSHT, "Hum_SHT")
+	r.addField("lastOpenDuration", doc.LastDoorOpenDuration, "LAST_DOOR_OPEN_DURATION")
+	r.addField("alarm", doc.Alarm, "ALARM")
+	r.addField("openCount", doc.DoorOpenTimes, "DOOR_OPEN_TIMES")
+	r.addField("batteryVolts", doc.BatV, "BAT_V")
+	r.addField("mod", doc.Mod, "MOD")
+	r.addField("openStatus", doc.DoorOpenStatus, "DOOR_OPEN_STATUS")
+	r.addField("waterLeakStatus", doc.WaterLeakStatus, "WATER_LEAK_STATUS")
+	r.addField("waterLeakLastDuration", doc.WaterLeakLastDuration, "LAST_WATER_LEAK_DURATION")
+	r.addField("waterLeakCount", doc.WaterLeakCount, "WATER_LEAK_TIMES")
+	return nil
+}
+
+func decodeMilesight(object json.RawMessage, r *Result) error {
+	var doc struct {
+		Temperature null.Float `json:"temperature"`
+		Humidity    null.Float `json:"humidity"`
+		Distance    null.Float `json:"distance"`
+		Position    string     `json:"position"`
+		Battery     null.Float `json:"battery"`
+		Decoded     struct {
+			Humidity    null.Float `json:"humidity"`
+			Temperature null.Float `json:"temperature"`
+			Battery     null.Float `json:"battery"`
+		} `json:"decoded"`
+	}
+	if err := unmarshalObject(object, &doc); err != nil {
+		return err
+	}
+	r.addField("temperature", doc.Temperature, "temperature") // We use temperature when we don't know if its for liquid or air
+	r.addField("airHumidity", doc.Humidity, "humidity")
+	r.addField("airTemperature", doc.Decoded.Temperature, "decoded.temperature")
+	r.addField("airHumidity", doc.Decoded.Humidity, "decoded.humidity")
+	r.addField("distance", doc.Distance, "distance")
+	r.UsedFields = append(r.UsedFields, "position")
+	if len(doc.Position) > 0 {
+		if doc.Position == "normal" {
+			r.addMeasurement("position", float64(0), "object.position")
+		} else { // "tilt"
+			r.addMeasurement("position", float64(1), "object.position")
+		}
+	}
+	r.addField("battery", doc.Decoded.Battery, "decoded.battery")
+	r.addField("battery", doc.Battery, "battery")
+	return nil
+}
+
+// decodeLocation picks up the generic gps fields most tracker codecs use, for
+// any vendor
+func decodeLocation(object json.RawMessage, r *Result) error {
+	var doc struct {
+		Latitude  null.Float `json:"latitude"`
+		Longitude null.Float `json:"longitude"`
+		Altitude  null.Float `json:"altitude"`
+		Accuracy  null.Float `json:"accuracy"`
+	}
+	if err := unmarshalObject(object, &doc); err != nil {
+		return err
+	}
+	r.UsedFields = append(r.UsedFields, "latitude", "longitude", "altitude", "accuracy")
+	if doc.Latitude.Valid && doc.Longitude.Valid {
+		r.Location.Latitude = doc.Latitude
+		r.Location.Longitude = doc.Longitude
+	}
+	if doc.Altitude.Valid {
+		r.Location.Altitude = doc.Altitude
+	}
+	if doc.Accuracy.Valid {
+		r.Location.Accuracy = doc.Accuracy
+	}
+	return nil
+}